@@ -0,0 +1,20 @@
+package main
+
+import "fmt"
+
+// runCommand runs one of the maintenance commands which can be given after the flags,
+// for example "auth -apiKey=... verify-chain", instead of starting the server.
+func (app *application) runCommand(args []string) error {
+	switch args[0] {
+	case "verify-chain":
+		return app.verifyChainCommand(args[1:])
+	case "build-breach-corpus":
+		return app.buildBreachCorpusCommand(args[1:])
+	case "users":
+		return app.usersCommand(args[1:])
+	case "scim-client":
+		return app.createSCIMClientCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
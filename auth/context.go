@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/auth/internals/jsonschema"
+)
+
+// Define a custom contextKey type, with the underlying type string, so that our keys
+// can't collide with keys set by other packages.
+type contextKey string
+
+const (
+	userContextKey       = contextKey("user")
+	requestIDContextKey  = contextKey("request_id")
+	orgContextKey        = contextKey("organization")
+	membershipContextKey = contextKey("membership")
+	tokenContextKey      = contextKey("token")
+	bodySchemaContextKey = contextKey("body_schema")
+)
+
+// The contextSetUser() method returns a new copy of the request with the provided
+// User struct added to the context.
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// The contextGetUser() retrieves the User struct from the request context. The only
+// time that we'll use this helper is when we logically expect there to be User struct
+// value in the context, and if it doesn't exist it will firmly be an 'unexpected' error.
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
+
+// contextSetRequestID returns a new copy of the request with the request ID added to
+// the context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns the request ID, or an empty string if the request didn't
+// go through the requestID middleware.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// contextSetOrganization adds the organization the request is made in, and the
+// membership of the current user in it (nil for anonymous users or non members).
+func (app *application) contextSetOrganization(r *http.Request, org *data.Organization, membership *data.Membership) *http.Request {
+	ctx := context.WithValue(r.Context(), orgContextKey, org)
+	ctx = context.WithValue(ctx, membershipContextKey, membership)
+	return r.WithContext(ctx)
+}
+
+// contextGetOrganization returns the organization the request is made in, or nil when
+// the request isn't made in an organization.
+func (app *application) contextGetOrganization(r *http.Request) *data.Organization {
+	org, _ := r.Context().Value(orgContextKey).(*data.Organization)
+	return org
+}
+
+// contextGetMembership returns the membership of the current user in the current
+// organization, or nil.
+func (app *application) contextGetMembership(r *http.Request) *data.Membership {
+	membership, _ := r.Context().Value(membershipContextKey).(*data.Membership)
+	return membership
+}
+
+// contextSetToken adds the authentication token the request was made with.
+func (app *application) contextSetToken(r *http.Request, token *data.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken returns the authentication token the request was made with, or nil
+// for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) *data.Token {
+	token, _ := r.Context().Value(tokenContextKey).(*data.Token)
+	return token
+}
+
+// contextGetTokenOrgID returns the organization the authentication token is scoped to,
+// 0 for unscoped tokens and anonymous requests.
+func (app *application) contextGetTokenOrgID(r *http.Request) int64 {
+	if token := app.contextGetToken(r); token != nil {
+		return token.OrganizationID
+	}
+	return 0
+}
+
+// contextGetImpersonatorID returns the ID of the admin impersonating the user, or 0
+// when the request isn't made with an impersonation token.
+func (app *application) contextGetImpersonatorID(r *http.Request) int64 {
+	if token := app.contextGetToken(r); token != nil {
+		return token.ImpersonatorID
+	}
+	return 0
+}
+
+// contextSetBodySchema adds the schema readInput checks the body against once it is
+// decoded, for the bodies validateBody can't check itself.
+func (app *application) contextSetBodySchema(r *http.Request, schema *jsonschema.Schema) *http.Request {
+	ctx := context.WithValue(r.Context(), bodySchemaContextKey, schema)
+	return r.WithContext(ctx)
+}
+
+// contextGetBodySchema returns the schema added by contextSetBodySchema, or nil.
+func (app *application) contextGetBodySchema(r *http.Request) *jsonschema.Schema {
+	schema, _ := r.Context().Value(bodySchemaContextKey).(*jsonschema.Schema)
+	return schema
+}
@@ -0,0 +1,12 @@
+window.onload = function() {
+  // The document is served next to the viewer, at /openapi.json.
+  window.ui = SwaggerUIBundle({
+    url: "../openapi.json",
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    presets: [
+      SwaggerUIBundle.presets.apis
+    ],
+    layout: "BaseLayout"
+  });
+};
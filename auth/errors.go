@@ -1,8 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/islamghany/go-workshop/auth/internals/i18n"
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+	"github.com/islamghany/go-workshop/jsonio"
+	"github.com/islamghany/go-workshop/negotiate"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -12,72 +20,267 @@ func (app *application) logError(r *http.Request, err error) {
 	})
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
-	err := app.writeJSON(w, status, env, nil)
+// language returns the language to answer the request in, and records it in the
+// response headers.
+func (app *application) language(w http.ResponseWriter, r *http.Request) string {
+	lang := i18n.Negotiate(r.Header.Get("Accept-Language"))
+
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	return lang
+}
+
+// problemTypePrefix is prepended to the message code to make the type of a problem.
+// The codes are stable, so clients can dispatch on either.
+const problemTypePrefix = "urn:go-workshop:auth:problem:"
+
+// problem is an RFC 7807 problem details object. Code and Params repeat the type as
+// the catalog message, and Errors lists the fields which failed validation.
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Instance  string       `json:"instance"`
+	Code      string       `json:"code"`
+	Params    i18n.Params  `json:"params,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// fieldError is an error of the field at the JSON pointer Field.
+type fieldError struct {
+	Field   string      `json:"field"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Params  i18n.Params `json:"params,omitempty"`
+	Reasons []string    `json:"reasons,omitempty"`
+}
+
+// wantsProblem reports whether the client should get an application/problem+json
+// response rather than the legacy {"error": ...} envelope. The envelope is only sent
+// to clients which accept application/json and prefer it over application/problem+json,
+// so clients which don't care get problems.
+func wantsProblem(r *http.Request) bool {
+	prefs := negotiate.ParseAccept(r.Header.Get("Accept"))
+
+	jsonQ := negotiate.Quality(prefs, "application/json")
+	return jsonQ <= 0 || negotiate.Quality(prefs, "application/problem+json") >= jsonQ
+}
+
+// writeProblem sends p, or the legacy envelope made of env when the client asks for
+// it.
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, p problem, env envelope) {
+	w.Header().Add("Vary", "Accept")
+
+	if !wantsProblem(r) {
+		err := app.writeJSON(w, p.Status, env, nil)
+		if err != nil {
+			app.logError(r, err)
+			w.WriteHeader(500)
+		}
+		return
+	}
 
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = app.contextGetRequestID(r)
+
+	err := app.writeJSON(w, p.Status, p, http.Header{"Content-Type": {"application/problem+json"}})
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
+
+// errorResponse sends the message in the client's language, along with its code and
+// parameters so that clients can tell errors apart without parsing the text.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message i18n.Message) {
+	text := message.In(app.language(w, r))
+
+	env := envelope{"error": text, "code": message.Code}
+	if len(message.Params) > 0 {
+		env["params"] = message.Params
+	}
+
+	app.writeProblem(w, r, problem{
+		Type:   problemTypePrefix + message.Code,
+		Status: status,
+		Detail: text,
+		Code:   message.Code,
+		Params: message.Params,
+	}, env)
+}
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
-	message := "the server encountered a problem and could not process your request"
+	message := i18n.New("server_error")
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
-	message := "the requested resource could not be found"
+	message := i18n.New("not_found")
 	app.errorResponse(w, r, http.StatusNotFound, message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
+	message := i18n.New("method_not_allowed", "method", r.Method)
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+// unsupportedMediaTypeResponse answers a body sent in a format the route doesn't read,
+// listing the media types it does.
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, allowed []string) {
+	message := i18n.New("unsupported_media_type", "allowed", strings.Join(allowed, ", "))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request, available []string) {
+	message := i18n.New("not_acceptable", "available", strings.Join(available, ", "))
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
+
+// patchErrorResponse sends the errors of jsonio.ReadPatch. A patch which doesn't fit
+// the resource as it is gets a 409, as the client's idea of the resource is out of
+// date, the other errors are those of any body.
+func (app *application) patchErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, jsonio.ErrPathNotFound) || errors.Is(err, jsonio.ErrTestFailed) {
+		app.errorResponse(w, r, http.StatusConflict, bodyError(err).(i18n.Message))
+		return
+	}
+	app.badRequestResponse(w, r, bodyError(err))
+}
+
+// badRequestResponse sends err, translated when it is an i18n message. Other errors
+// are sent as they are, under the bad_request code, but for a body in a format which
+// can't be read, which gets a 415.
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	var contentTypeErr *jsonio.ContentTypeError
+	if errors.As(err, &contentTypeErr) {
+		app.unsupportedMediaTypeResponse(w, r, contentTypeErr.Allowed)
+		return
+	}
+
+	var schemaErr *schemaError
+	if errors.As(err, &schemaErr) {
+		app.failedValidationResponse(w, r, schemaErr.v)
+		return
+	}
+
+	var message i18n.Message
+	if !errors.As(err, &message) {
+		message = i18n.New("bad_request", "reason", err.Error())
+	}
+	app.errorResponse(w, r, http.StatusBadRequest, message)
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+// failedValidationResponse sends the validator errors in the client's language. The
+// errors of the problem are every error of every field, whose JSON pointers are sorted
+// and whose errors keep their order, and the reasons behind an error are sent along
+// with the first error of the field. The legacy envelope only has the first error of
+// every field.
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+	lang := app.language(w, r)
+
+	messages := make(map[string]string, len(v.Errors))
+	for key, message := range v.Errors {
+		messages[key] = message.In(lang)
+	}
+
+	pointers := make([]string, 0, len(v.Details))
+	for pointer := range v.Details {
+		pointers = append(pointers, pointer)
+	}
+	sort.Strings(pointers)
+
+	var errs []fieldError
+	for _, pointer := range pointers {
+		for i, message := range v.Details[pointer] {
+			fe := fieldError{
+				Field:   pointer,
+				Code:    message.Code,
+				Message: message.In(lang),
+				Params:  message.Params,
+			}
+			if i == 0 {
+				fe.Reasons = v.Reasons[v.Key(pointer)]
+			}
+			errs = append(errs, fe)
+		}
+	}
+
+	env := envelope{"error": messages, "details": v.Errors}
+	if len(v.Reasons) > 0 {
+		env["reasons"] = v.Reasons
+	}
+
+	message := i18n.New("failed_validation")
+	app.writeProblem(w, r, problem{
+		Type:   problemTypePrefix + message.Code,
+		Status: http.StatusUnprocessableEntity,
+		Detail: message.In(lang),
+		Code:   message.Code,
+		Errors: errs,
+	}, env)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
-	message := "unable to update the record due to an edit conflict, please try again"
+	message := i18n.New("edit_conflict")
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := i18n.New("precondition_required")
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
-	message := "rate limit exceeded"
+	message := i18n.New("rate_limit_exceeded")
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
-	message := "invalid authentication credentials"
+	message := i18n.New("invalid_credentials")
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
-	message := "invalid or missing authentication token"
+	message := i18n.New("invalid_token")
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
-	message := "you must be authenticated to access this resource"
+	message := i18n.New("authentication_required")
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
-	message := "your user account must be activated to access this resource"
+	message := i18n.New("inactive_account")
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
-	message := "your user account doesn't have the necessary permissions to access this resource"
+	message := i18n.New("not_permitted")
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) organizationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := i18n.New("organization_required")
+	app.errorResponse(w, r, http.StatusBadRequest, message)
+}
+
+func (app *application) impersonationNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := i18n.New("impersonation_not_allowed")
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) orgScopedTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := i18n.New("org_scoped_token")
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) lastOwnerResponse(w http.ResponseWriter, r *http.Request) {
+	message := i18n.New("org.last_owner")
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/julienschmidt/httprouter"
+)
+
+/*
+Personal data export
+
+-The user asks for an export with POST /users/me/export and gets a 202 straight away.
+-A background goroutine writes a zip archive with one JSON file per kind of data to the exports directory.
+-The archive is written entry by entry straight to disk, so we never hold the whole export in memory.
+-The user is emailed a link to GET /exports/:id which carries an expiry time and an HMAC-SHA256 signature
+ over the id and the expiry, so the link can't be forged or extended, and it works without logging in.
+-Archives are removed once their link has expired.
+*/
+
+// exportTimeout bounds the time spent collecting the data for a single export.
+const exportTimeout = time.Minute
+
+// exportSection is a single JSON file in the export archive.
+type exportSection struct {
+	name    string
+	collect func(ctx context.Context, user *data.User) (interface{}, error)
+}
+
+// exportSections lists the files written to the archive, in order.
+func (app *application) exportSections() []exportSection {
+	return []exportSection{
+		{name: "profile.json", collect: func(ctx context.Context, user *data.User) (interface{}, error) {
+			return user, nil
+		}},
+		{name: "tokens.json", collect: app.collectTokenMetadata},
+		{name: "permissions.json", collect: func(ctx context.Context, user *data.User) (interface{}, error) {
+			return app.models.Permissions.GetAllForUser(user.ID)
+		}},
+		{name: "memberships.json", collect: func(ctx context.Context, user *data.User) (interface{}, error) {
+			return app.models.Organizations.GetAllMembershipsForUser(user.ID)
+		}},
+		{name: "audit_events.json", collect: func(ctx context.Context, user *data.User) (interface{}, error) {
+			return app.models.Audit.GetAllForUser(user.ID)
+		}},
+	}
+}
+
+// collectTokenMetadata returns the scope and expiry of the user's sessions and other
+// tokens. The token hashes are deliberately left out.
+func (app *application) collectTokenMetadata(ctx context.Context, user *data.User) (interface{}, error) {
+	tokens, err := app.models.Tokens.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	type tokenMetadata struct {
+		Scope  string    `json:"scope"`
+		Expiry time.Time `json:"expiry"`
+	}
+
+	metadata := make([]tokenMetadata, 0, len(tokens))
+	for _, t := range tokens {
+		metadata = append(metadata, tokenMetadata{Scope: t.Scope, Expiry: t.Expiry})
+	}
+
+	return metadata, nil
+}
+
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	app.background(func() {
+		// The export outlives the request, so it can't use the request's context.
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+
+		id, err := app.writeExport(ctx, user)
+		if err != nil {
+			log.Println("writing data export:", err)
+			return
+		}
+
+		expires := time.Now().Add(app.config.export.ttl)
+		link := fmt.Sprintf("http://localhost/8000/exports/%s?expires=%d&signature=%s", id, expires.Unix(), app.signExport(id, expires.Unix()))
+
+		sender := "auth@example.com"
+		subject := "Your data export is ready"
+		body := `
+		<h4>your data export is ready, you can download it <a href="%s">here</a> until %s</h4>
+		<p>%s</p>
+		`
+
+		_, _, err = app.sendEmail(sender, subject, fmt.Sprintf(body, link, expires.Format(time.RFC1123), link), user.Email)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+
+	err := app.writeResponse(w, r, http.StatusAccepted, envelope{"message": "your data export is being prepared, you will receive an email with a download link"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// writeExport writes the archive for a user to the exports directory and returns its
+// id. The id is random so it can't be guessed from the user.
+func (app *application) writeExport(ctx context.Context, user *data.User) (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	id := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	err = os.MkdirAll(app.config.export.dir, 0o700)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(app.config.export.dir, id+".zip")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.writeExportArchive(ctx, f, user)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (app *application) writeExportArchive(ctx context.Context, f *os.File, user *data.User) error {
+	zw := zip.NewWriter(f)
+
+	for _, section := range app.exportSections() {
+		v, err := section.collect(ctx, user)
+		if err != nil {
+			return fmt.Errorf("collecting %s: %w", section.name, err)
+		}
+
+		entry, err := zw.Create(section.name)
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(entry)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(v)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", section.name, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// signExport returns the hex-encoded HMAC-SHA256 of the export id and expiry time.
+func (app *application) signExport(id string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(app.config.export.secret))
+	fmt.Fprintf(mac, "%s:%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (app *application) downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	// The id is used to build a file path, so only accept what writeExport generates.
+	if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(id); err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	signature, err := hex.DecodeString(r.URL.Query().Get("signature"))
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	expected, _ := hex.DecodeString(app.signExport(id, expires))
+	if !hmac.Equal(signature, expected) || time.Now().Unix() > expires {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(app.config.export.dir, id+".zip"))
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="data-export.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// removeExpiredExports periodically deletes the archives whose download link has
+// expired. It runs in its own goroutine for the lifetime of the server.
+func (app *application) removeExpiredExports() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		matches, err := filepath.Glob(filepath.Join(app.config.export.dir, "*.zip"))
+		if err != nil {
+			log.Println("removing expired exports:", err)
+			continue
+		}
+
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if time.Since(info.ModTime()) > app.config.export.ttl {
+				if err := os.Remove(path); err != nil {
+					log.Println("removing expired exports:", err)
+				}
+			}
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/islamghany/go-workshop/auth/internals/data"
 	"github.com/islamghany/go-workshop/auth/internals/validator"
+	"github.com/islamghany/go-workshop/jsonio"
 )
 
 func (app *application) hello(w http.ResponseWriter, r *http.Request) {
@@ -37,19 +39,160 @@ Activating the user process
 -If the hash of the token exists in the tokens table and hasn’t expired, then we’ll update the activated status for the relevant user to true.
 -Lastly, we’ll delete the activation token from our tokens table so that it can’t be used again.
 */
-func (app *application) activeUserHandler(w http.ResponseWriter, r *http.Request) {
+// activateUserInput is the request body of activateUserHandler.
+type activateUserInput struct {
+	TokenPlaintext string `json:"token"`
+}
+
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input activateUserInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// Retrieve the details of the user associated with the token. If no matching
+	// record is found, then we let the client know that the token they provided is
+	// not valid.
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid_activation")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Activated = true
+
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The token has done its job, so delete all activation tokens for the user.
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.EventUserActivated, user.ID, user.ID, nil)
+	app.enqueueWebhook(data.EventUserActivated, envelope{"user": user})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
 
+// setupAccountInput is the request body of setupAccountHandler.
+type setupAccountInput struct {
+	TokenPlaintext string `json:"token"`
+	Password       string `json:"password"`
 }
-func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
-	// Create an anonymous struct to hold the expected data from the request body.
-	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+
+// setupAccountHandler lets an imported user choose their password with the account
+// setup token they were emailed. As the token proves they own the email address, the
+// account is activated as well.
+func (app *application) setupAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var input setupAccountInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAccountSetup, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid_account_setup")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if data.ValidatePasswordPlaintext(v, input.Password, user.Name, user.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user.Activated = true
+
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
-	// Parse the request body into the anonymous struct.
-	err := app.readJSON(w, r, &input)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeAccountSetup, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.EventPasswordChanged, user.ID, user.ID, map[string]string{"reason": "account setup"})
+	app.audit(r, data.EventUserActivated, user.ID, user.ID, nil)
+	app.enqueueWebhook(data.EventUserActivated, envelope{"user": user})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// registerUserInput is the request body of registerUserHandler.
+type registerUserInput struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Hold the expected data from the request body, the type is also used to document it.
+	var input registerUserInput
+
+	// Parse the request body into the input struct.
+	err := app.readInput(r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -78,26 +221,30 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	// Validate the user struct and return the error messages to the client if any of
 	// the checks fail.
 	if data.ValidateUser(v, user); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
 	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	err = app.models.Users.Insert(r.Context(), user)
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
 		// add a message to the validator instance, and then call our
 		// failedValidationResponse() helper.
 		case errors.Is(err, data.ErrDuplicateEmail):
-			v.AddError("email", "a user with this email address already exists")
-			app.failedValidationResponse(w, r, v.Errors)
+			v.AddError("email", "taken")
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+
+	app.audit(r, data.EventUserRegistered, user.ID, user.ID, nil)
+	app.enqueueWebhook(data.EventUserRegistered, envelope{"user": user})
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -120,7 +267,406 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// Write a JSON response containing the user data along with a 201 Created status
 	// code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createAuthenticationTokenInput is the request body of createAuthenticationTokenHandler.
+type createAuthenticationTokenInput struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// createAuthenticationTokenHandler exchanges an email and password for a stateful
+// authentication token which is then sent as "Authorization: Bearer <token>". When an
+// organization slug is sent as well, the token is scoped to that organization and
+// can't be used in any other.
+func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input createAuthenticationTokenInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	// Only check that a password was sent, the strength rules are for new passwords
+	// and must not lock out users whose password predates them.
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "required")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.audit(r, data.EventLoginFailed, 0, 0, map[string]string{"email": input.Email, "reason": "unknown email"})
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, needsRehash, err := user.Password.Verify(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.audit(r, data.EventLoginFailed, 0, user.ID, map[string]string{"email": input.Email, "reason": "wrong password"})
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// The password matched a hash made with an older algorithm or cost. Now that we
+	// have the plaintext, upgrade the stored hash. Losing a race with another update
+	// isn't a problem, the upgrade will simply happen on the next login.
+	if needsRehash {
+		err = user.Password.Set(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Users.Update(r.Context(), user)
+		if err != nil && !errors.Is(err, data.ErrEditConflict) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	var orgID int64
+	if input.Organization != "" {
+		org, err := app.models.Organizations.GetBySlug(input.Organization)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// An unknown organization and one the user isn't a member of get the same
+		// response, so the endpoint can't be used to list organizations.
+		if err == nil {
+			_, err = app.models.Organizations.GetMembership(org.ID, user.ID)
+			if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+		if err != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		orgID = org.ID
+	}
+
+	token, err := app.models.Tokens.NewForOrganization(r.Context(), user.ID, orgID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	metadata := map[string]string{}
+	if input.Organization != "" {
+		metadata["organization"] = input.Organization
+	}
+	app.audit(r, data.EventLoginSucceeded, user.ID, user.ID, metadata)
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentUserHandler returns the authenticated user. The version is also sent as
+// an ETag so the client can echo it back in the If-Match header of a PATCH request.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	headers := make(http.Header)
+	headers.Set("ETag", fmt.Sprintf("%q", strconv.Itoa(user.Version)))
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserInput is the request body of updateCurrentUserHandler.
+type updateCurrentUserInput struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword *string `json:"current_password"`
+}
+
+// updateCurrentUserHandler applies a partial update to the authenticated user. The
+// client must tell us which version of the record it read, and if that is no longer
+// the current version we respond with an edit conflict instead of overwriting the
+// changes made by someone else.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	expectedVersion, ok, err := app.readExpectedVersion(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.preconditionRequiredResponse(w, r)
+		return
+	}
+	if expectedVersion != user.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	// Use pointers for the fields, so that we can tell a field which is missing from
+	// the request body (nil) apart from one which is set to its zero value.
+	var input updateCurrentUserInput
+
+	if jsonio.IsPatch(r.Header.Get("Content-Type")) {
+		// A JSON Merge Patch or a JSON Patch is applied to the current name and email
+		// of the user, the password fields starting out null.
+		current := updateCurrentUserInput{Name: &user.Name, Email: &user.Email}
+
+		err = jsonio.ReadPatch(r, current, &input, jsonio.MaxBytes(maxBodyBytes))
+		if err != nil {
+			app.patchErrorResponse(w, r, err)
+			return
+		}
+
+		// A name or an email set to null, or removed, can't be told apart from one
+		// left out of a partial update, so it is refused rather than ignored.
+		v := validator.New()
+		v.Check(input.Name != nil, "name", "required")
+		v.Check(input.Email != nil, "email", "required")
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+
+		// The patched input holds every field, the ones left as they were are dropped
+		// as if they were missing from a partial update.
+		if input.Name != nil && *input.Name == user.Name {
+			input.Name = nil
+		}
+		if input.Email != nil && *input.Email == user.Email {
+			input.Email = nil
+		}
+	} else {
+		err = app.readInput(r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	// An admin impersonating the user can fix their name, but must not be able to take
+	// over the account.
+	if (input.Email != nil || input.Password != nil) && app.contextGetImpersonatorID(r) != 0 {
+		app.impersonationNotAllowedResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	oldEmail := user.Email
+
+	// Changing the email address or the password requires the current password, so
+	// that a stolen token alone isn't enough to take over the account: a new email
+	// address would get the thief a password reset link.
+	if (input.Email != nil && *input.Email != user.Email) || input.Password != nil {
+		if input.CurrentPassword == nil || *input.CurrentPassword == "" {
+			v.AddError("current_password", "required_for_change")
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+
+		match, err := user.Password.Mathces(*input.CurrentPassword)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !match {
+			v.AddError("current_password", "incorrect")
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Email != nil {
+		user.Email = *input.Email
+	}
+	if input.Password != nil {
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "taken")
+			app.failedValidationResponse(w, r, v)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Password != nil {
+		app.audit(r, data.EventPasswordChanged, user.ID, user.ID, nil)
+	}
+	if user.Email != oldEmail {
+		app.audit(r, data.EventEmailChanged, user.ID, user.ID, map[string]string{"old_email": oldEmail, "new_email": user.Email})
+		app.enqueueWebhook(data.EventEmailChanged, envelope{"user": user, "old_email": oldEmail})
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", fmt.Sprintf("%q", strconv.Itoa(user.Version)))
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler soft-deletes the authenticated user. All of their tokens are
+// revoked, which logs them out everywhere, and we email them a link which can be used
+// to cancel the deletion until the grace period is over and the account is purged.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Users.SoftDelete(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.EventUserDeleted, user.ID, user.ID, nil)
+	app.enqueueWebhook(data.EventUserDeleted, envelope{"user_id": user.ID})
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeActivation} {
+		err = app.models.Tokens.DeleteAllForUser(r.Context(), scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.audit(r, data.EventTokensRevoked, user.ID, user.ID, map[string]string{"scope": scope})
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, app.config.deletion.gracePeriod, data.ScopeDeletionCancellation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		sender := "auth@example.com"
+		subject := "Your account is scheduled for deletion"
+		body := `
+		<h4>your account will be deleted on %s, if you didn't mean to delete it you can cancel the deletion <a href="http://localhost/8000/users/deletion/cancel/%s">here</a></h4>
+		<p>http://localhost/8000/users/deletion/cancel/%s</p>
+		`
+
+		_, _, err := app.sendEmail(sender, subject, fmt.Sprintf(body, token.Expiry.Format(time.RFC1123), token.Plaintext, token.Plaintext), user.Email)
+
+		if err != nil {
+			log.Println(err)
+		}
+	})
+
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"message": "your account has been scheduled for deletion, check your email to cancel it"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelUserDeletionInput is the request body of cancelUserDeletionHandler.
+type cancelUserDeletionInput struct {
+	Token string `json:"token"`
+}
+
+// cancelUserDeletionHandler restores a soft-deleted account from the token which was
+// emailed to the user when they deleted it.
+func (app *application) cancelUserDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	var input cancelUserDeletionInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user, err := app.models.Users.GetDeletedForToken(r.Context(), data.ScopeDeletionCancellation, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid_deletion_cancellation")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Users.Restore(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeDeletionCancellation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.EventUserRestored, user.ID, user.ID, nil)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
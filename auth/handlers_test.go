@@ -0,0 +1,772 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/mailgun/mailgun-go/v4"
+)
+
+// sentEmail is a message passed to the fake mailer.
+type sentEmail struct {
+	sender, subject, body string
+	recipients            []string
+}
+
+// fakeMailer records the messages instead of sending them. The rest of the
+// mailgun.Mailgun methods are left nil and panic if called.
+type fakeMailer struct {
+	mailgun.Mailgun
+
+	mu      sync.Mutex
+	pending map[*mailgun.Message]sentEmail
+	sent    []sentEmail
+}
+
+func (m *fakeMailer) NewMessage(from, subject, text string, to ...string) *mailgun.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message := new(mailgun.Message)
+	m.pending[message] = sentEmail{from, subject, text, to}
+	return message
+}
+
+func (m *fakeMailer) Send(ctx context.Context, message *mailgun.Message) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, m.pending[message])
+	delete(m.pending, message)
+	return "Queued. Thank you.", "<test@example.com>", nil
+}
+
+// newTestApplication returns an application whose users and tokens are kept in
+// memory and whose emails are recorded by the returned mailer. The other models use a
+// closed database, so audit events and webhooks fail and are only logged.
+func newTestApplication(t *testing.T) (*application, *fakeMailer) {
+	t.Helper()
+
+	db, err := sql.Open("postgres", "postgres://test@localhost/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	models := data.NewModels(db)
+	memory := data.NewMemoryModels()
+	models.Users = memory.Users
+	models.Tokens = memory.Tokens
+
+	mailer := &fakeMailer{pending: make(map[*mailgun.Message]sentEmail)}
+
+	return &application{models: models, email: mailer}, mailer
+}
+
+// do sends the request through the application's routes and decodes the JSON response.
+func do(t *testing.T, app *application, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, r)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s: invalid JSON response: %v\n%s", method, path, err, rr.Body)
+	}
+
+	return rr.Code, response
+}
+
+var activationLinkRX = regexp.MustCompile(`/users/activate/([A-Z0-9]+)`)
+
+func TestRegisterUser(t *testing.T) {
+	app, mailer := newTestApplication(t)
+
+	status, response := do(t, app, http.MethodPost, "/users",
+		`{"name": "Alice Smith", "email": "alice@example.com", "password": "correct horse battery staple"}`)
+
+	if status != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %v", status, http.StatusCreated, response)
+	}
+
+	user, ok := response["user"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("response has no user: %v", response)
+	}
+	if user["email"] != "alice@example.com" || user["activated"] != false {
+		t.Errorf("got user %v", user)
+	}
+	if _, exists := user["password"]; exists {
+		t.Errorf("the response contains the password: %v", user)
+	}
+
+	stored, err := app.models.Users.GetByEmail(context.Background(), "ALICE@example.com")
+	if err != nil {
+		t.Fatalf("the user wasn't stored: %v", err)
+	}
+	if match, _ := stored.Password.Mathces("correct horse battery staple"); !match {
+		t.Error("the stored password doesn't match")
+	}
+
+	tokens, err := app.models.Tokens.GetAllForUser(context.Background(), stored.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Scope != data.ScopeActivation {
+		t.Fatalf("got tokens %+v; want a single activation token", tokens)
+	}
+
+	app.wg.Wait()
+
+	if len(mailer.sent) != 1 {
+		t.Fatalf("sent %d emails; want 1", len(mailer.sent))
+	}
+	email := mailer.sent[0]
+	if len(email.recipients) != 1 || email.recipients[0] != "alice@example.com" {
+		t.Errorf("sent the email to %v", email.recipients)
+	}
+
+	// The email holds the plaintext token, which must activate the user.
+	link := activationLinkRX.FindStringSubmatch(email.body)
+	if link == nil {
+		t.Fatalf("the email has no activation link:\n%s", email.body)
+	}
+
+	activated, err := app.models.Users.GetForToken(context.Background(), data.ScopeActivation, link[1])
+	if err != nil {
+		t.Fatalf("the emailed token doesn't match: %v", err)
+	}
+	if activated.ID != stored.ID {
+		t.Errorf("the emailed token belongs to user %d; want %d", activated.ID, stored.ID)
+	}
+}
+
+func TestRegisterUserErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		errors  map[string]string
+		reasons []string
+		message string
+	}{
+		{
+			name:    "empty body",
+			body:    ``,
+			status:  http.StatusBadRequest,
+			message: "body must not be empty",
+		},
+		{
+			name:    "malformed JSON",
+			body:    `{"name": "Alice",}`,
+			status:  http.StatusBadRequest,
+			message: "body contains badly-formed JSON (at character 18)",
+		},
+		{
+			name:   "wrong type",
+			body:   `{"name": 42, "email": "bob@example.com", "password": "correct horse battery staple"}`,
+			status: http.StatusUnprocessableEntity,
+			errors: map[string]string{"/name": "must be of type string"},
+		},
+		{
+			name:   "unknown field",
+			body:   `{"name": "Alice", "admin": true}`,
+			status: http.StatusUnprocessableEntity,
+			errors: map[string]string{
+				"/admin":    "is not allowed",
+				"/email":    "must be provided",
+				"/password": "must be provided",
+			},
+		},
+		{
+			name:    "multiple values",
+			body:    `{"name": "Alice"}{"name": "Bob"}`,
+			status:  http.StatusBadRequest,
+			message: "body must only contain a single JSON value",
+		},
+		{
+			name:   "missing fields",
+			body:   `{}`,
+			status: http.StatusUnprocessableEntity,
+			errors: map[string]string{
+				"/name":     "must be provided",
+				"/email":    "must be provided",
+				"/password": "must be provided",
+			},
+		},
+		{
+			name:   "invalid email",
+			body:   `{"name": "Bob", "email": "bob@", "password": "correct horse battery staple"}`,
+			status: http.StatusUnprocessableEntity,
+			errors: map[string]string{"/email": "must be a valid email address"},
+		},
+		{
+			name:   "long name",
+			body:   `{"name": "` + strings.Repeat("a", 501) + `", "email": "bob@example.com", "password": "correct horse battery staple"}`,
+			status: http.StatusUnprocessableEntity,
+			errors: map[string]string{"/name": "must not be more than 500 bytes long"},
+		},
+		{
+			name:   "short password",
+			body:   `{"name": "Bob", "email": "bob@example.com", "password": "short"}`,
+			status: http.StatusUnprocessableEntity,
+			errors: map[string]string{"/password": "must be at least 8 bytes long"},
+		},
+		{
+			name:    "guessable password",
+			body:    `{"name": "Bob", "email": "bob@example.com", "password": "password1"}`,
+			status:  http.StatusUnprocessableEntity,
+			errors:  map[string]string{"/password": "is too easy to guess"},
+			reasons: []string{"/password"},
+		},
+		{
+			name:   "duplicate email",
+			body:   `{"name": "Alice", "email": "ALICE@example.com", "password": "correct horse battery staple"}`,
+			status: http.StatusUnprocessableEntity,
+			errors: map[string]string{"/email": "a user with this email address already exists"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			app, mailer := newTestApplication(t)
+
+			existing := &data.User{Name: "Alice", Email: "alice@example.com"}
+			if err := existing.Password.Set("correct horse battery staple"); err != nil {
+				t.Fatal(err)
+			}
+			if err := app.models.Users.Insert(context.Background(), existing); err != nil {
+				t.Fatal(err)
+			}
+
+			status, response := do(t, app, http.MethodPost, "/users", tt.body)
+			app.wg.Wait()
+
+			if status != tt.status {
+				t.Fatalf("got status %d; want %d: %v", status, tt.status, response)
+			}
+
+			if tt.message != "" && response["detail"] != tt.message {
+				t.Errorf("got detail %q; want %q", response["detail"], tt.message)
+			}
+
+			errors := make(map[string]interface{})
+			reasons := make(map[string]interface{})
+			list, _ := response["errors"].([]interface{})
+			for _, item := range list {
+				fe, _ := item.(map[string]interface{})
+				field, _ := fe["field"].(string)
+				if _, ok := errors[field]; !ok {
+					errors[field] = fe["message"]
+				}
+				if fe["reasons"] != nil {
+					reasons[field] = fe["reasons"]
+				}
+			}
+
+			if tt.errors != nil {
+				if len(errors) != len(tt.errors) {
+					t.Errorf("got errors %v; want %v", errors, tt.errors)
+				}
+				for key, want := range tt.errors {
+					if errors[key] != want {
+						t.Errorf("got %s error %v; want %q", key, errors[key], want)
+					}
+				}
+			}
+
+			for _, key := range tt.reasons {
+				if list, _ := reasons[key].([]interface{}); len(list) == 0 {
+					t.Errorf("got no %s reasons: %v", key, response)
+				}
+			}
+			if len(tt.reasons) == 0 && len(reasons) != 0 {
+				t.Errorf("got unexpected reasons %v", reasons)
+			}
+
+			if len(mailer.sent) != 0 {
+				t.Errorf("sent %d emails; want none", len(mailer.sent))
+			}
+			if users, _, _ := app.models.Users.GetAll(context.Background(), data.UserFilter{}, 0, 10); len(users) != 1 {
+				t.Errorf("got %d users; want only the existing one", len(users))
+			}
+		})
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		language       string
+		body           string
+		message        string
+		errors         map[string]string
+	}{
+		{
+			name:     "default language",
+			language: "en",
+			body:     `{"name": "Bob", "email": "bob@", "password": "short"}`,
+			errors: map[string]string{
+				"email":    "must be a valid email address",
+				"password": "must be at least 8 bytes long",
+			},
+		},
+		{
+			name:           "regional variant",
+			acceptLanguage: "fr;q=0.9, ar-EG",
+			language:       "ar",
+			body:           `{"name": "Bob", "email": "bob@", "password": "short"}`,
+			errors: map[string]string{
+				"email":    "يجب أن يكون عنوان بريد إلكتروني صالحًا",
+				"password": "يجب ألا يقل طوله عن 8 بايت",
+			},
+		},
+		{
+			name:           "request body",
+			acceptLanguage: "ar",
+			language:       "ar",
+			body:           `{"name": "Alice"}{"name": "Bob"}`,
+			message:        "يجب أن يحتوي الطلب على قيمة JSON واحدة فقط",
+		},
+	}
+
+	codes := map[string]string{"email": "email.invalid_email", "password": "password.too_short"}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tt.body))
+			r.Header.Set("Accept-Language", tt.acceptLanguage)
+			rr := httptest.NewRecorder()
+			app.routes().ServeHTTP(rr, r)
+
+			if got := rr.Header().Get("Content-Language"); got != tt.language {
+				t.Errorf("got Content-Language %q; want %q", got, tt.language)
+			}
+
+			var response problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid JSON response: %v\n%s", err, rr.Body)
+			}
+
+			if tt.message != "" {
+				if response.Detail != tt.message || response.Code != "body.multiple_values" {
+					t.Errorf("got detail %q (%s); want %q", response.Detail, response.Code, tt.message)
+				}
+				return
+			}
+
+			errors := make(map[string]fieldError)
+			for _, fe := range response.Errors {
+				errors[strings.TrimPrefix(fe.Field, "/")] = fe
+			}
+			for key, want := range tt.errors {
+				if errors[key].Message != want {
+					t.Errorf("got %s error %q; want %q", key, errors[key].Message, want)
+				}
+				if got := errors[key].Code; got != codes[key] {
+					t.Errorf("got %s code %q; want %q", key, got, codes[key])
+				}
+			}
+			if got := errors["password"].Params["min"]; got != "8" {
+				t.Errorf("got password min param %q; want 8", got)
+			}
+		})
+	}
+}
+
+func TestErrorNegotiation(t *testing.T) {
+	tests := []struct {
+		name    string
+		accept  string
+		problem bool
+	}{
+		{"no preference", "", true},
+		{"anything", "*/*", true},
+		{"problem", "application/problem+json", true},
+		{"problem preferred", "application/json;q=0.5, application/problem+json", true},
+		{"legacy", "application/json", false},
+		{"legacy preferred", "application/json, application/problem+json;q=0.1", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{}`))
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set("X-Request-ID", "req-42")
+			rr := httptest.NewRecorder()
+			app.routes().ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+			contentType := "application/json"
+			if tt.problem {
+				contentType = "application/problem+json"
+			}
+			if got := rr.Header().Get("Content-Type"); got != contentType {
+				t.Errorf("got Content-Type %q for Accept %q; want %q", got, tt.accept, contentType)
+			}
+
+			var response map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid JSON response: %v\n%s", err, rr.Body)
+			}
+
+			if !tt.problem {
+				if _, ok := response["error"].(map[string]interface{}); !ok {
+					t.Errorf("got %v; want the legacy envelope", response)
+				}
+				return
+			}
+
+			want := map[string]interface{}{
+				"type":       problemTypePrefix + "failed_validation",
+				"title":      "Unprocessable Entity",
+				"status":     float64(http.StatusUnprocessableEntity),
+				"instance":   "/users",
+				"code":       "failed_validation",
+				"request_id": "req-42",
+			}
+			for key, value := range want {
+				if response[key] != value {
+					t.Errorf("got %s %v; want %v", key, response[key], value)
+				}
+			}
+			if list, _ := response["errors"].([]interface{}); len(list) != 3 {
+				t.Errorf("got errors %v; want name, email and password", response["errors"])
+			}
+		})
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		accept      string
+		body        string
+		status      int
+		want        string
+	}{
+		{
+			name:        "xml",
+			contentType: "application/xml",
+			accept:      "application/xml",
+			body:        `<user><name>Alice</name><email>alice@example.com</email><password>correct horse battery staple</password></user>`,
+			status:      http.StatusCreated,
+			want:        "<response><user><id>1</id>",
+		},
+		{
+			name:        "msgpack",
+			contentType: "application/msgpack",
+			accept:      "application/json;q=0.1, application/msgpack",
+			body:        "\x83\xa4name\xa5Alice\xa5email\xb1alice@example.com\xa8password\xbccorrect horse battery staple",
+			status:      http.StatusCreated,
+			want:        "\x81\xa4user\x86\xa2id\x01",
+		},
+		{
+			name:   "not acceptable",
+			accept: "text/csv",
+			body:   `{"name": "Alice", "email": "alice@example.com", "password": "correct horse battery staple"}`,
+			status: http.StatusNotAcceptable,
+			want:   "the response can only be sent as application/json, application/xml, application/msgpack",
+		},
+		{
+			name:        "unsupported media type",
+			contentType: "text/csv",
+			body:        "name,email,password\n",
+			status:      http.StatusUnsupportedMediaType,
+			want:        "the request body must be sent as application/json, application/xml, application/msgpack",
+		},
+		{
+			name:        "malformed xml",
+			contentType: "application/xml",
+			body:        `<user><name>Alice</user>`,
+			status:      http.StatusBadRequest,
+			want:        "body contains badly-formed XML",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			r.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			app.routes().ServeHTTP(rr, r)
+			app.wg.Wait()
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if !strings.Contains(rr.Body.String(), tt.want) {
+				t.Errorf("got body %q; want it to contain %q", rr.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateCurrentUserPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		want        string
+	}{
+		{
+			name:        "merge patch",
+			contentType: "application/merge-patch+json",
+			body:        `{"name": "Alice Jones", "password": null}`,
+			status:      http.StatusOK,
+			want:        `"name":"Alice Jones","email":"alice@example.com"`,
+		},
+		{
+			name:        "json patch",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "test", "path": "/name", "value": "Alice Smith"}, {"op": "replace", "path": "/name", "value": "Alice Jones"}]`,
+			status:      http.StatusOK,
+			want:        `"name":"Alice Jones","email":"alice@example.com"`,
+		},
+		{
+			name:        "test failed",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "test", "path": "/name", "value": "Bob"}, {"op": "replace", "path": "/name", "value": "Alice Jones"}]`,
+			status:      http.StatusConflict,
+			want:        `patch operation 0 failed: \"/name\" does not hold the tested value`,
+		},
+		{
+			name:        "path not found",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "remove", "path": "/nickname"}]`,
+			status:      http.StatusConflict,
+			want:        `patch operation 0 refers to \"/nickname\", which does not exist`,
+		},
+		{
+			name:        "invalid operation",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "rename", "path": "/name"}]`,
+			status:      http.StatusBadRequest,
+			want:        "patch operation 0 is invalid",
+		},
+		{
+			name:        "email without the current password",
+			contentType: "application/merge-patch+json",
+			body:        `{"email": "alice@example.org"}`,
+			status:      http.StatusUnprocessableEntity,
+			want:        `"code":"current_password.required_for_change"`,
+		},
+		{
+			name:        "email with the current password",
+			contentType: "application/merge-patch+json",
+			body:        `{"email": "alice@example.org", "current_password": "correct horse battery staple"}`,
+			status:      http.StatusOK,
+			want:        `"email":"alice@example.org"`,
+		},
+		{
+			name:        "email with a wrong password",
+			contentType: "application/json",
+			body:        `{"email": "alice@example.org", "current_password": "wrong"}`,
+			status:      http.StatusUnprocessableEntity,
+			want:        `"code":"current_password.incorrect"`,
+		},
+		{
+			name:        "null email",
+			contentType: "application/merge-patch+json",
+			body:        `{"email": null}`,
+			status:      http.StatusUnprocessableEntity,
+			want:        `"field":"/email","code":"email.required"`,
+		},
+		{
+			name:        "null name",
+			contentType: "application/merge-patch+json",
+			body:        `{"name": null, "email": "alice@example.org"}`,
+			status:      http.StatusUnprocessableEntity,
+			want:        `"field":"/name","code":"name.required"`,
+		},
+		{
+			name:        "removed name",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "remove", "path": "/name"}]`,
+			status:      http.StatusUnprocessableEntity,
+			want:        `"field":"/name","code":"name.required"`,
+		},
+		{
+			name:        "unknown field",
+			contentType: "application/merge-patch+json",
+			body:        `{"nickname": "Al"}`,
+			status:      http.StatusBadRequest,
+			want:        `body contains unknown key \"nickname\"`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+
+			user := &data.User{Name: "Alice Smith", Email: "alice@example.com", Activated: true}
+			if err := user.Password.Set("correct horse battery staple"); err != nil {
+				t.Fatal(err)
+			}
+			if err := app.models.Users.Insert(context.Background(), user); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPatch, "/users/me", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set("If-Match", fmt.Sprintf("%q", strconv.Itoa(user.Version)))
+			r = app.contextSetUser(r, user)
+			rr := httptest.NewRecorder()
+			app.updateCurrentUserHandler(rr, r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if !strings.Contains(rr.Body.String(), tt.want) {
+				t.Errorf("got body %q; want it to contain %q", rr.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrgScopedTokens(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	user := &data.User{ID: 1, Name: "Alice Smith", Email: "alice@example.com", Activated: true}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	tests := []struct {
+		name    string
+		token   *data.Token
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"global token", &data.Token{UserID: 1}, app.requireAuthenticatedUser(ok), http.StatusNoContent},
+		{"scoped token", &data.Token{UserID: 1, OrganizationID: 7}, app.requireAuthenticatedUser(ok), http.StatusForbidden},
+		{"scoped token on an admin route", &data.Token{UserID: 1, OrganizationID: 7}, app.requirePermission(data.PermissionAuditRead, ok), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, tt.token)
+		rr := httptest.NewRecorder()
+		tt.handler(rr, r)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s: got status %d; want %d: %s", tt.name, rr.Code, tt.status, rr.Body)
+		}
+		if tt.status == http.StatusForbidden && !strings.Contains(rr.Body.String(), "scoped to an organization") {
+			t.Errorf("%s: got body %s", tt.name, rr.Body)
+		}
+	}
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	models := data.NewMemoryModels()
+
+	user := &data.User{Name: "Alice", Email: "alice@example.com"}
+	if err := user.Password.Set("correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := *user
+
+	user.Name = "Alice Smith"
+	if err := models.Users.Update(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Update(context.Background(), &stale); err != data.ErrEditConflict {
+		t.Errorf("updating a stale user: got %v; want %v", err, data.ErrEditConflict)
+	}
+
+	expired, err := models.Tokens.New(context.Background(), user.ID, -1, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.Users.GetForToken(context.Background(), data.ScopeAuthentication, expired.Plaintext); err != data.ErrRecordNotFound {
+		t.Errorf("looking up an expired token: got %v; want %v", err, data.ErrRecordNotFound)
+	}
+
+	if err := models.Users.SoftDelete(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.Users.Get(context.Background(), user.ID); err != data.ErrRecordNotFound {
+		t.Errorf("getting a deleted user: got %v; want %v", err, data.ErrRecordNotFound)
+	}
+
+	// A deleted user keeps their email address until they are purged.
+	other := &data.User{Name: "Mallory", Email: "Alice@Example.com"}
+	if err := other.Password.Set("correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(context.Background(), other); err != data.ErrDuplicateEmail {
+		t.Errorf("reusing a deleted user's email: got %v; want %v", err, data.ErrDuplicateEmail)
+	}
+
+	if n, err := models.Users.PurgeDeleted(context.Background(), 0); err != nil || n != 1 {
+		t.Fatalf("purging: got %d, %v; want 1, nil", n, err)
+	}
+	if err := models.Users.Insert(context.Background(), other); err != nil {
+		t.Errorf("reusing a purged user's email: %v", err)
+	}
+	if tokens, _ := models.Tokens.GetAllForUser(context.Background(), user.ID); len(tokens) != 0 {
+		t.Errorf("got %d tokens for a purged user; want none", len(tokens))
+	}
+}
+
+// Users deactivated through SCIM may still hold a token, it must not let them in.
+func TestInactiveUsers(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	user := &data.User{ID: 1, Name: "Alice Smith", Email: "alice@example.com", Activated: false}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"authenticated": app.requireAuthenticatedUser(ok),
+		"admin":         app.requirePermission(data.PermissionAuditRead, ok),
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, &data.Token{UserID: 1})
+		rr := httptest.NewRecorder()
+		handler(rr, r)
+
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "must be activated") {
+			t.Errorf("%s: got status %d: %s", name, rr.Code, rr.Body)
+		}
+	}
+}
@@ -2,125 +2,165 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/i18n"
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+	"github.com/islamghany/go-workshop/jsonio"
+	"github.com/islamghany/go-workshop/negotiate"
+	"github.com/julienschmidt/httprouter"
 )
 
-func (app *application) readJSON(w http.ResponseWriter, r *http.Request, input interface{}) error {
+// readIDParam retrieves the "id" URL parameter from the current request context, and
+// converts it to an integer. If the operation isn't successful, return 0 and an error.
+func (app *application) readIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid id parameter")
+	}
+
+	return id, nil
+}
 
-	// Use http.MaxBytesReader() to limit the size of the request body to 1MB.
-	maxBytes := 1_048_576
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+// readInt reads an integer from the query string. If the key is missing the default
+// value is returned, and if it can't be converted an error is recorded in the
+// validator.
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
 
-	// Initialize the json.Decoder, and call the DisallowUnknownFields() method on it
-	// before decoding. This means that if the JSON from the client now includes any
-	// field which cannot be mapped to the target destination, the decoder will return
-	// an error instead of just ignoring the field.
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-	// Decode the request body to the destination.
-	err := dec.Decode(input)
+	i, err := strconv.Atoi(s)
 	if err != nil {
-		// If there is an error during decoding, start the triage...
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
+		v.AddError(key, "not_integer")
+		return defaultValue
+	}
 
+	return i
+}
+
+// maxBodyBytes is the largest request body we accept, 1MB.
+const maxBodyBytes = jsonio.DefaultMaxBytes
+
+// readInput decodes the request body into input, in the format named by its
+// Content-Type: JSON (the default), XML or MessagePack. The errors it returns are i18n
+// messages, so that badRequestResponse can send them in the client's language, but
+// for the *jsonio.ContentTypeError of a format which can't be read and the
+// *schemaError of a body which validateBody left to be checked once decoded.
+func (app *application) readInput(r *http.Request, input interface{}) error {
+	opts := []jsonio.Option{jsonio.MaxBytes(maxBodyBytes)}
+	if schema := app.contextGetBodySchema(r); schema != nil {
+		opts = append(opts, schemaCheck(schema))
+	}
+
+	err := negotiate.Read(r, input, opts...)
+	if err != nil {
+		return bodyError(err)
+	}
+	return nil
+}
+
+// bodyError converts the errors of the jsonio package to i18n messages.
+func bodyError(err error) error {
+	var syntaxError *jsonio.SyntaxError
+	var typeError *jsonio.TypeError
+	var unknownFieldError *jsonio.UnknownFieldError
+	var tooLargeError *jsonio.TooLargeError
+	var tooManyItemsError *jsonio.TooManyItemsError
+	var malformedError *negotiate.MalformedError
+	var patchError *jsonio.PatchError
+
+	switch {
+	case errors.As(err, &syntaxError):
+		if syntaxError.Offset == 0 {
+			return i18n.New("body.malformed")
+		}
+		return i18n.New("body.malformed_at", "offset", strconv.FormatInt(syntaxError.Offset, 10))
+	case errors.As(err, &typeError):
+		if typeError.Field != "" {
+			return i18n.New("body.wrong_type", "field", typeError.Field)
+		}
+		return i18n.New("body.wrong_type_at", "offset", strconv.FormatInt(typeError.Offset, 10))
+	case errors.As(err, &unknownFieldError):
+		return i18n.New("body.unknown_field", "field", unknownFieldError.Field)
+	case errors.As(err, &tooLargeError):
+		return i18n.New("body.too_large", "max", strconv.FormatInt(tooLargeError.Limit, 10))
+	case errors.Is(err, jsonio.ErrEmptyBody):
+		return i18n.New("body.empty")
+	case errors.Is(err, jsonio.ErrMultipleValues):
+		return i18n.New("body.multiple_values")
+	case errors.Is(err, jsonio.ErrNotArray):
+		return i18n.New("body.not_array")
+	case errors.As(err, &tooManyItemsError):
+		return i18n.New("body.too_many_items", "max", strconv.Itoa(tooManyItemsError.Limit))
+	case errors.As(err, &malformedError):
+		return i18n.New("body.malformed_as", "format", malformedError.Format)
+	case errors.As(err, &patchError):
+		index := strconv.Itoa(patchError.Index)
 		switch {
-		// Use the errors.As() function to check whether the error has the type
-		// *json.SyntaxError. If it does, then return a plain-english error message
-		// which includes the location of the problem.
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
-
-			// In some circumstances Decode() may also return an io.ErrUnexpectedEOF error
-			// for syntax errors in the JSON. So we check for this using errors.Is() and
-			// return a generic error message. There is an open issue regarding this at
-			// https://github.com/golang/go/issues/25956.
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
-
-			// Likewise, catch any *json.UnmarshalTypeError errors. These occur when the
-			// JSON value is the wrong type for the target destination. If the error relates
-			// to a specific field, then we include that in our error message to make it
-			// easier for the client to debug.
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
-
-			// An io.EOF error will be returned by Decode() if the request body is empty. We
-			// check for this with errors.Is() and return a plain-english error message
-			// instead.
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
-
-			// If the JSON contains a field which cannot be mapped to the target destination
-			// then Decode() will now return an error message in the format "json: unknown
-			// field "<name>"". We check for this, extract the field name from the error,
-			// and interpolate it into our custom error message. Note that there's an open
-			// issue at https://github.com/golang/go/issues/29035 regarding turning this
-			// into a distinct error type in the future.
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
-
-		// If the request body exceeds 1MB in size the decode will now fail with the
-		// error "http: request body too large". There is an open issue about turning
-		// this into a distinct error type at https://github.com/golang/go/issues/30715.
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
-			// A json.InvalidUnmarshalError error will be returned if we pass a non-nil
-			// pointer to Decode(). We catch this and panic, rather than returning an error
-			// to our handler. At the end of this chapter we'll talk about panicking
-			// versus returning errors, and discuss why it's an appropriate thing to do in
-			// this specific situation.
-		case errors.As(err, &invalidUnmarshalError):
-			panic(err)
-
-			// For anything else, return the error message as-is.
+		case errors.Is(err, jsonio.ErrPathNotFound):
+			return i18n.New("patch.path_not_found", "index", index, "path", patchError.Path)
+		case errors.Is(err, jsonio.ErrTestFailed):
+			return i18n.New("patch.test_failed", "index", index, "path", patchError.Path)
 		default:
-			return err
+			return i18n.New("patch.invalid", "index", index, "reason", patchError.Err.Error())
 		}
+	default:
+		return err
 	}
-	// Call Decode() again, using a pointer to an empty anonymous struct as the
-	// destination. If the request body only contained a single JSON value this will
-	// return an io.EOF error. So if we get anything else, we know that there is
-	// additional data in the request body and we return our own custom error message.
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return errors.New("body must only contain a single JSON value")
-	}
-
-	return nil
 }
 
+// writeJSON sends data as JSON, whatever the client accepts. It is only used for the
+// errors, see writeProblem, the other responses go through writeResponse.
 func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
-	jsonData, err := json.Marshal(data)
+	return jsonio.Write(w, status, data, headers)
+}
 
-	if err != nil {
-		fmt.Println("an error has occur ", err)
-		return err
+// writeResponse sends data in the format the client prefers among JSON, XML,
+// MessagePack and, for lists, CSV. A client which accepts none of them gets a 406,
+// which is taken care of here.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data interface{}, headers http.Header) error {
+	err := negotiate.Write(w, r, status, data, headers)
+
+	var notAcceptable *negotiate.NotAcceptableError
+	if errors.As(err, &notAcceptable) {
+		app.notAcceptableResponse(w, r, notAcceptable.Available)
+		return nil
+	}
+	return err
+}
+
+// readExpectedVersion returns the record version the client expects to be updating.
+// It is read from the If-Match header (as an ETag such as "3" or W/"3") or from the
+// X-Expected-Version header. The second return value is false when neither header
+// has been sent.
+func (app *application) readExpectedVersion(r *http.Request) (int, bool, error) {
+	value := r.Header.Get("If-Match")
+	if value == "" {
+		value = r.Header.Get("X-Expected-Version")
+	}
+	if value == "" {
+		return 0, false, nil
 	}
 
-	// Append a newline to make it easier to view in terminal applications.
-	jsonData = append(jsonData, '\n')
+	value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+	value = strings.Trim(value, `"`)
 
-	// Go does't throw an error when iterating on a nil object so its fine.
-	for key, value := range headers {
-		w.Header()[key] = value
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, true, errors.New("invalid expected version header")
 	}
 
-	w.Header().Set("Content-Type", "application")
-	w.WriteHeader(status)
-	w.Write(jsonData)
-	return nil
+	return version, true, nil
 }
 
 func (app *application) sendEmail(sender, subject, body, recipient string) (resp string, id string, err error) {
@@ -148,3 +188,20 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// extendDeadlines gives a long running request d from now to be read and answered,
+// instead of the timeouts of the server. A ResponseWriter which can't change its
+// deadlines, such as the recorder of the tests, is left as it is.
+func extendDeadlines(w http.ResponseWriter, d time.Duration) error {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(d)
+
+	err := rc.SetReadDeadline(deadline)
+	if err == nil {
+		err = rc.SetWriteDeadline(deadline)
+	}
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/auth/internals/i18n"
+)
+
+/*
+Impersonation
+
+-Support staff with the users:impersonate permission can get a token to act as a user and see
+ what they see.
+-The token is an ordinary authentication token flagged with the ID of the admin, it expires
+ after impersonationTTL and can't be renewed.
+-Requests made with it carry an X-Impersonated-By response header, are written to the audit
+ log (see serveImpersonated), and can't reach the sensitive actions: password or email change,
+ account deletion, data export, accepting invitations and every admin endpoint.
+-Users with admin permissions can't be impersonated, so impersonation is never a way to gain
+ more permissions than the admin already has.
+*/
+
+const impersonationTTL = 15 * time.Minute
+
+// impersonateUserHandler issues an impersonation token for the user with the :id
+// parameter.
+func (app *application) impersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	if id == admin.ID {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, i18n.New("impersonation.self"))
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(permissions) > 0 {
+		app.errorResponse(w, r, http.StatusForbidden, i18n.New("impersonation.admin"))
+		return
+	}
+
+	token, err := app.models.Tokens.NewImpersonation(r.Context(), user.ID, admin.ID, impersonationTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.EventImpersonationStarted, admin.ID, user.ID, map[string]string{
+		"expiry": token.Expiry.UTC().Format(time.RFC3339),
+	})
+
+	headers := make(http.Header)
+	headers.Set("X-Impersonated-By", strconv.FormatInt(admin.ID, 10))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token, "user": user}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
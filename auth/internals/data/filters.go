@@ -0,0 +1,54 @@
+package data
+
+import (
+	"math"
+
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+)
+
+// Filters holds the pagination parameters read from the query string.
+type Filters struct {
+	Page     int
+	PageSize int
+}
+
+func (f Filters) limit() int {
+	return f.PageSize
+}
+
+func (f Filters) offset() int {
+	return (f.Page - 1) * f.PageSize
+}
+
+func ValidateFilters(v *validator.Validator, f Filters) {
+	v.Check(f.Page > 0, "page", "not_positive")
+	v.Check(f.Page <= 10_000_000, "page", "too_large", "max", "10000000")
+	v.Check(f.PageSize > 0, "page_size", "not_positive")
+	v.Check(f.PageSize <= 100, "page_size", "too_large", "max", "100")
+}
+
+// Metadata holds the pagination metadata sent along with a page of results.
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty"`
+}
+
+// calculateMetadata calculates the pagination metadata from the total number of
+// records, the current page and the page size. When there are no records an empty
+// Metadata is returned.
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
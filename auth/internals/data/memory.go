@@ -0,0 +1,396 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemoryModels returns Models whose Users and Tokens are kept in memory, for tests
+// and local experiments. They behave like the Postgres models: emails are unique
+// regardless of case (soft-deleted users keep theirs until they are purged), updates
+// are checked against the version, expired tokens are ignored and the tokens of a
+// purged user go with it. The other models are left unset.
+func NewMemoryModels() Models {
+	db := &memoryDB{
+		users:  make(map[int64]*memoryUser),
+		tokens: make(map[string]*Token),
+		nextID: 1,
+	}
+
+	return Models{
+		Users:  MemoryUserModel{db: db},
+		Tokens: MemoryTokenModel{db: db},
+	}
+}
+
+// memoryDB holds the rows shared by MemoryUserModel and MemoryTokenModel. Rows are
+// copied in and out, so callers can't change them without going through the models.
+type memoryDB struct {
+	mu     sync.Mutex
+	users  map[int64]*memoryUser
+	tokens map[string]*Token // by string(hash)
+	nextID int64
+}
+
+type memoryUser struct {
+	user      User
+	deletedAt *time.Time
+}
+
+// emailTaken reports whether another user than id has the email address.
+func (db *memoryDB) emailTaken(email string, id int64) bool {
+	for _, u := range db.users {
+		if u.user.ID != id && strings.EqualFold(u.user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedUsers returns the users which aren't soft-deleted, in ID order.
+func (db *memoryDB) sortedUsers() []*memoryUser {
+	users := make([]*memoryUser, 0, len(db.users))
+	for _, u := range db.users {
+		if u.deletedAt == nil {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].user.ID < users[j].user.ID })
+	return users
+}
+
+func copyUser(u *memoryUser) *User {
+	user := u.user
+	user.Password.plaintext = nil
+	user.Password.hash = append([]byte(nil), u.user.Password.hash...)
+	return &user
+}
+
+type MemoryUserModel struct {
+	db *memoryDB
+}
+
+func (m MemoryUserModel) Insert(ctx context.Context, user *User) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	return m.insert(user)
+}
+
+func (m MemoryUserModel) insert(user *User) error {
+	if m.db.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+
+	user.ID = m.db.nextID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Version = 1
+	m.db.nextID++
+
+	m.db.users[user.ID] = &memoryUser{user: *copyUser(&memoryUser{user: *user})}
+	return nil
+}
+
+func (m MemoryUserModel) InsertBatch(ctx context.Context, users []*User) ([]*User, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	var skipped []*User
+	for _, user := range users {
+		err := m.insert(user)
+		if err == ErrDuplicateEmail {
+			skipped = append(skipped, user)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return skipped, nil
+}
+
+func (m MemoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	u, ok := m.db.users[id]
+	if !ok || u.deletedAt != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyUser(u), nil
+}
+
+func (m MemoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	for _, u := range m.db.users {
+		if u.deletedAt == nil && strings.EqualFold(u.user.Email, email) {
+			return copyUser(u), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m MemoryUserModel) GetAll(ctx context.Context, filter UserFilter, offset, limit int) ([]*User, int, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	var matches []*User
+	for _, u := range m.db.sortedUsers() {
+		email := strings.ToLower(u.user.Email)
+
+		switch {
+		case filter.Email != "" && email != strings.ToLower(filter.Email):
+		case filter.EmailContains != "" && !strings.Contains(email, strings.ToLower(filter.EmailContains)):
+		case filter.EmailPrefix != "" && !strings.HasPrefix(email, strings.ToLower(filter.EmailPrefix)):
+		default:
+			matches = append(matches, copyUser(u))
+		}
+	}
+
+	total := len(matches)
+	if offset >= total {
+		return []*User{}, total, nil
+	}
+
+	matches = matches[offset:]
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	return matches, total, nil
+}
+
+func (m MemoryUserModel) Stream(ctx context.Context, fn func(user *User) error) error {
+	m.db.mu.Lock()
+	var users []*User
+	for _, u := range m.db.sortedUsers() {
+		users = append(users, copyUser(u))
+	}
+	m.db.mu.Unlock()
+
+	for _, user := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m MemoryUserModel) Update(ctx context.Context, user *User) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	u, ok := m.db.users[user.ID]
+	if !ok || u.deletedAt != nil || u.user.Version != user.Version {
+		return ErrEditConflict
+	}
+	if m.db.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	user.Version++
+	u.user = *copyUser(&memoryUser{user: *user})
+	return nil
+}
+
+func (m MemoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	user, _, err := m.getForToken(ctx, tokenScope, tokenPlaintext, false)
+	return user, err
+}
+
+func (m MemoryUserModel) GetForScopedToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, *Token, error) {
+	return m.getForToken(ctx, tokenScope, tokenPlaintext, false)
+}
+
+func (m MemoryUserModel) GetDeletedForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	user, _, err := m.getForToken(ctx, tokenScope, tokenPlaintext, true)
+	return user, err
+}
+
+func (m MemoryUserModel) getForToken(ctx context.Context, tokenScope, tokenPlaintext string, deleted bool) (*User, *Token, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	t, ok := m.db.tokens[string(hash[:])]
+	if !ok || t.Scope != tokenScope || !t.Expiry.After(time.Now()) {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	u, ok := m.db.users[t.UserID]
+	if !ok || (u.deletedAt != nil) != deleted {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	token := *t
+	token.Plaintext = ""
+
+	return copyUser(u), &token, nil
+}
+
+func (m MemoryUserModel) SoftDelete(ctx context.Context, user *User) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	u, ok := m.db.users[user.ID]
+	if !ok || u.deletedAt != nil || u.user.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	now := time.Now()
+	u.deletedAt = &now
+	u.user.Version++
+	user.Version = u.user.Version
+	return nil
+}
+
+func (m MemoryUserModel) Restore(ctx context.Context, user *User) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	u, ok := m.db.users[user.ID]
+	if !ok || u.deletedAt == nil || u.user.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	u.deletedAt = nil
+	u.user.Version++
+	user.Version = u.user.Version
+	return nil
+}
+
+func (m MemoryUserModel) PurgeDeleted(ctx context.Context, gracePeriod time.Duration) (int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	cutoff := time.Now().Add(-gracePeriod)
+
+	var n int64
+	for id, u := range m.db.users {
+		if u.deletedAt != nil && u.deletedAt.Before(cutoff) {
+			delete(m.db.users, id)
+			n++
+
+			for hash, t := range m.db.tokens {
+				if t.UserID == id {
+					delete(m.db.tokens, hash)
+				}
+			}
+		}
+	}
+
+	return n, nil
+}
+
+type MemoryTokenModel struct {
+	db *memoryDB
+}
+
+func (m MemoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return m.NewForOrganization(ctx, userID, 0, ttl, scope)
+}
+
+func (m MemoryTokenModel) NewForOrganization(ctx context.Context, userID, orgID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.OrganizationID = orgID
+
+	err = m.Insert(ctx, token)
+
+	return token, err
+}
+
+func (m MemoryTokenModel) NewImpersonation(ctx context.Context, userID, impersonatorID int64, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.ImpersonatorID = impersonatorID
+
+	err = m.Insert(ctx, token)
+
+	return token, err
+}
+
+// Insert stores the token. Like the foreign key on tokens.user_id, it fails with
+// ErrRecordNotFound when the user doesn't exist.
+func (m MemoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if _, ok := m.db.users[token.UserID]; !ok {
+		return ErrRecordNotFound
+	}
+
+	t := *token
+	t.Plaintext = ""
+	m.db.tokens[string(token.Hash)] = &t
+	return nil
+}
+
+func (m MemoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	for hash, t := range m.db.tokens {
+		if t.Scope == scope && t.UserID == userID {
+			delete(m.db.tokens, hash)
+		}
+	}
+
+	return nil
+}
+
+func (m MemoryTokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*Token, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	now := time.Now()
+	tokens := []*Token{}
+
+	for _, t := range m.db.tokens {
+		if t.UserID == userID && t.Expiry.After(now) {
+			token := *t
+			tokens = append(tokens, &token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Expiry.Before(tokens[j].Expiry) })
+
+	return tokens, nil
+}
+
+// DeleteExpired deletes the expired tokens. There is a single process to coordinate
+// with, so it never returns ErrLocked.
+func (m MemoryTokenModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	now := time.Now()
+
+	var n int64
+	for hash, t := range m.db.tokens {
+		if t.Expiry.Before(now) {
+			delete(m.db.tokens, hash)
+			n++
+		}
+	}
+
+	return n, nil
+}
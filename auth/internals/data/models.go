@@ -1,24 +1,77 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 	ErrEditConflict   = errors.New("edit conflict")
 	ErrRecordNotFound = errors.New("record not found")
+	ErrLocked         = errors.New("locked by another instance")
 )
 
+// QueryTimeout caps how long a single query may run. Queries are also cancelled when
+// the context passed in by the caller is, for example when a client disconnects.
+var QueryTimeout = 3 * time.Second
+
+// bulkQueryTimeout caps the statements which touch many rows at once, like a purge or
+// a COPY. It follows QueryTimeout, which may be changed after the package is loaded.
+func bulkQueryTimeout() time.Duration {
+	return 10 * QueryTimeout
+}
+
+// UserStore is implemented by UserModel, backed by Postgres, and by the in-memory
+// store returned by NewMemoryModels.
+type UserStore interface {
+	Insert(ctx context.Context, user *User) error
+	InsertBatch(ctx context.Context, users []*User) ([]*User, error)
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetAll(ctx context.Context, filter UserFilter, offset, limit int) ([]*User, int, error)
+	Stream(ctx context.Context, fn func(user *User) error) error
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	GetForScopedToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, *Token, error)
+	GetDeletedForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	SoftDelete(ctx context.Context, user *User) error
+	Restore(ctx context.Context, user *User) error
+	PurgeDeleted(ctx context.Context, gracePeriod time.Duration) (int64, error)
+}
+
+// TokenStore is implemented by TokenModel, backed by Postgres, and by the in-memory
+// store returned by NewMemoryModels.
+type TokenStore interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	NewForOrganization(ctx context.Context, userID, orgID int64, ttl time.Duration, scope string) (*Token, error)
+	NewImpersonation(ctx context.Context, userID, impersonatorID int64, ttl time.Duration) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	GetAllForUser(ctx context.Context, userID int64) ([]*Token, error)
+	DeleteExpired(ctx context.Context, batchSize int) (int64, error)
+}
+
 type Models struct {
-	Users  UserModel
-	Tokens TokenModel
+	Users         UserStore
+	Tokens        TokenStore
+	Permissions   PermissionModel
+	Audit         AuditModel
+	Webhooks      WebhookModel
+	Organizations OrganizationModel
+	SCIMClients   SCIMClientModel
 }
 
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Tokens: TokenModel{DB: db},
-		Users:  UserModel{DB: db}, // Initialize a new UserModel instance.
+		Tokens:        TokenModel{DB: db},
+		Users:         UserModel{DB: db}, // Initialize a new UserModel instance.
+		Permissions:   PermissionModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Webhooks:      WebhookModel{DB: db},
+		Organizations: OrganizationModel{DB: db},
+		SCIMClients:   SCIMClientModel{DB: db},
 	}
 }
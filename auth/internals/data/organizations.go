@@ -0,0 +1,543 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+)
+
+var (
+	ErrDuplicateSlug = errors.New("duplicate slug")
+	ErrLastOwner     = errors.New("last owner")
+)
+
+// The roles a user can have within an organization.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// The permissions which are evaluated within an organization. Unlike the global
+// permissions they aren't granted to users directly, they come with a role.
+const (
+	PermissionOrgRead         = "org:read"
+	PermissionOrgWrite        = "org:write"
+	PermissionOrgMembersRead  = "org:members:read"
+	PermissionOrgMembersWrite = "org:members:write"
+)
+
+// RolePermissions maps each role to the permissions it has within its organization.
+var RolePermissions = map[string]Permissions{
+	RoleOwner:  {PermissionOrgRead, PermissionOrgWrite, PermissionOrgMembersRead, PermissionOrgMembersWrite},
+	RoleAdmin:  {PermissionOrgRead, PermissionOrgMembersRead, PermissionOrgMembersWrite},
+	RoleMember: {PermissionOrgRead, PermissionOrgMembersRead},
+}
+
+var SlugRX = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type Organization struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	Version   int       `json:"version"`
+}
+
+// Membership is the role of a user within an organization. The user fields are only
+// filled in when listing the members of an organization.
+type Membership struct {
+	UserID         int64     `json:"user_id"`
+	OrganizationID int64     `json:"organization_id"`
+	Role           string    `json:"role"`
+	CreatedAt      time.Time `json:"created_at"`
+	Name           string    `json:"name,omitempty"`
+	Email          string    `json:"email,omitempty"`
+}
+
+// Permissions returns the permissions which come with the membership role.
+func (m *Membership) Permissions() Permissions {
+	return RolePermissions[m.Role]
+}
+
+type Invitation struct {
+	ID             int64      `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	OrganizationID int64      `json:"organization_id"`
+	Email          string     `json:"email"`
+	Role           string     `json:"role"`
+	Plaintext      string     `json:"-"`
+	Hash           []byte     `json:"-"`
+	Expiry         time.Time  `json:"expiry"`
+	InvitedBy      int64      `json:"invited_by"`
+	AcceptedAt     *time.Time `json:"accepted_at"`
+}
+
+func ValidateOrganization(v *validator.Validator, org *Organization) {
+	v.Check(org.Name != "", "name", "required")
+	v.Check(len(org.Name) <= 500, "name", "too_long", "max", "500")
+	v.Check(org.Slug != "", "slug", "required")
+	v.Check(org.Slug == "" || validator.Matches(org.Slug, SlugRX), "slug", "invalid")
+}
+
+func ValidateRole(v *validator.Validator, role string) {
+	v.Check(validator.In(role, RoleOwner, RoleAdmin, RoleMember), "role", "not_allowed", "values", "owner, admin, member")
+}
+
+type OrganizationModel struct {
+	DB *sql.DB
+}
+
+// Insert creates an organization with ownerID as its first owner.
+func (m OrganizationModel) Insert(org *Organization, ownerID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        INSERT INTO organizations (name, slug)
+        VALUES ($1, $2)
+        RETURNING id, created_at, version`
+
+	err = tx.QueryRowContext(ctx, query, org.Name, org.Slug).Scan(&org.ID, &org.CreatedAt, &org.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "organizations_slug_key"`:
+			return ErrDuplicateSlug
+		default:
+			return err
+		}
+	}
+
+	query = `
+        INSERT INTO memberships (user_id, org_id, role)
+        VALUES ($1, $2, $3)`
+
+	_, err = tx.ExecContext(ctx, query, ownerID, org.ID, RoleOwner)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m OrganizationModel) GetBySlug(slug string) (*Organization, error) {
+	return m.get(`WHERE slug = $1`, slug)
+}
+
+func (m OrganizationModel) Get(id int64) (*Organization, error) {
+	return m.get(`WHERE id = $1`, id)
+}
+
+func (m OrganizationModel) get(where string, arg interface{}) (*Organization, error) {
+	query := `
+        SELECT id, created_at, name, slug, version
+        FROM organizations
+        ` + where
+
+	var org Organization
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, arg).Scan(&org.ID, &org.CreatedAt, &org.Name, &org.Slug, &org.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &org, nil
+}
+
+// GetAll returns a page of organizations ordered by id.
+func (m OrganizationModel) GetAll(filters Filters) ([]*Organization, Metadata, error) {
+	query := `
+        SELECT count(*) OVER(), id, created_at, name, slug, version
+        FROM organizations
+        ORDER BY id
+        LIMIT $1 OFFSET $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	orgs := []*Organization{}
+
+	for rows.Next() {
+		var org Organization
+
+		err := rows.Scan(&totalRecords, &org.ID, &org.CreatedAt, &org.Name, &org.Slug, &org.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		orgs = append(orgs, &org)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return orgs, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// GetMembership returns the membership of a user in an organization, or
+// ErrRecordNotFound if the user isn't a member.
+func (m OrganizationModel) GetMembership(orgID, userID int64) (*Membership, error) {
+	query := `
+        SELECT user_id, org_id, role, created_at
+        FROM memberships
+        WHERE org_id = $1 AND user_id = $2`
+
+	var membership Membership
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, orgID, userID).Scan(&membership.UserID, &membership.OrganizationID, &membership.Role, &membership.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &membership, nil
+}
+
+// GetAllMembershipsForUser returns every organization membership of a user.
+func (m OrganizationModel) GetAllMembershipsForUser(userID int64) ([]*Membership, error) {
+	query := `
+        SELECT user_id, org_id, role, created_at
+        FROM memberships
+        WHERE user_id = $1
+        ORDER BY org_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []*Membership{}
+
+	for rows.Next() {
+		var membership Membership
+
+		err := rows.Scan(&membership.UserID, &membership.OrganizationID, &membership.Role, &membership.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		memberships = append(memberships, &membership)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return memberships, nil
+}
+
+// GetMembers returns the members of an organization along with their name and email.
+// Soft-deleted users are left out.
+func (m OrganizationModel) GetMembers(orgID int64) ([]*Membership, error) {
+	query := `
+        SELECT memberships.user_id, memberships.org_id, memberships.role, memberships.created_at, users.name, users.email
+        FROM memberships
+        INNER JOIN users ON users.id = memberships.user_id
+        WHERE memberships.org_id = $1 AND users.deleted_at IS NULL
+        ORDER BY memberships.created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Membership{}
+
+	for rows.Next() {
+		var membership Membership
+
+		err := rows.Scan(&membership.UserID, &membership.OrganizationID, &membership.Role, &membership.CreatedAt, &membership.Name, &membership.Email)
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, &membership)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// UpdateMemberRole changes the role of a member. It returns ErrLastOwner rather than
+// demote the only owner of the organization.
+func (m OrganizationModel) UpdateMemberRole(membership *Membership) error {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if membership.Role != RoleOwner {
+		err = checkLastOwner(ctx, tx, membership.OrganizationID, membership.UserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+        UPDATE memberships
+        SET role = $1
+        WHERE org_id = $2 AND user_id = $3`
+
+	result, err := tx.ExecContext(ctx, query, membership.Role, membership.OrganizationID, membership.UserID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+// RemoveMember deletes a membership, along with the authentication tokens of the user
+// which are scoped to the organization. It returns ErrLastOwner rather than remove the
+// only owner of the organization.
+func (m OrganizationModel) RemoveMember(orgID, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = checkLastOwner(ctx, tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM memberships WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkLastOwner returns ErrLastOwner if userID is the only owner of the organization.
+// The owners are locked until the end of tx, so that two transactions demoting two of
+// the last owners can't both see the other one as still being an owner.
+func checkLastOwner(ctx context.Context, tx *sql.Tx, orgID, userID int64) error {
+	query := `
+        SELECT user_id
+        FROM memberships
+        WHERE org_id = $1 AND role = $2
+        FOR UPDATE`
+
+	rows, err := tx.QueryContext(ctx, query, orgID, RoleOwner)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	owners := 0
+	isOwner := false
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		owners++
+		isOwner = isOwner || id == userID
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if isOwner && owners == 1 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// NewInvitation creates an invitation to join an organization. The plaintext token is
+// only available on the returned Invitation, only its hash is stored.
+func (m OrganizationModel) NewInvitation(orgID, invitedBy int64, email, role string, ttl time.Duration) (*Invitation, error) {
+	token, err := generateToken(0, ttl, ScopeInvitation)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := &Invitation{
+		OrganizationID: orgID,
+		Email:          email,
+		Role:           role,
+		Plaintext:      token.Plaintext,
+		Hash:           token.Hash,
+		Expiry:         token.Expiry,
+		InvitedBy:      invitedBy,
+	}
+
+	query := `
+        INSERT INTO invitations (org_id, email, role, hash, expiry, invited_by)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	args := []interface{}{orgID, email, role, token.Hash, token.Expiry, invitedBy}
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// GetInvitationForToken returns the pending, unexpired invitation for a token.
+func (m OrganizationModel) GetInvitationForToken(tokenPlaintext string) (*Invitation, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT id, created_at, org_id, email, role, hash, expiry, COALESCE(invited_by, 0)
+        FROM invitations
+        WHERE hash = $1 AND expiry > $2 AND accepted_at IS NULL`
+
+	var invitation Invitation
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.OrganizationID,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.Hash,
+		&invitation.Expiry,
+		&invitation.InvitedBy,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// AcceptInvitation marks the invitation as accepted and makes the user a member of
+// the organization, with the invitation role. If the user already is a member their
+// role is updated instead.
+func (m OrganizationModel) AcceptInvitation(invitation *Invitation, userID int64) (*Membership, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE invitations SET accepted_at = NOW() WHERE id = $1 AND accepted_at IS NULL`, invitation.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrEditConflict
+	}
+
+	query := `
+        INSERT INTO memberships (user_id, org_id, role)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (user_id, org_id) DO UPDATE SET role = EXCLUDED.role
+        RETURNING user_id, org_id, role, created_at`
+
+	var membership Membership
+
+	err = tx.QueryRowContext(ctx, query, userID, invitation.OrganizationID, invitation.Role).Scan(
+		&membership.UserID,
+		&membership.OrganizationID,
+		&membership.Role,
+		&membership.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &membership, tx.Commit()
+}
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	PermissionAuditRead        = "audit:read"
+	PermissionPermissionsWrite = "permissions:write"
+	PermissionWebhooksWrite    = "webhooks:write"
+	PermissionOrgsWrite        = "orgs:write"
+	PermissionUsersImpersonate = "users:impersonate"
+	PermissionMetricsRead      = "metrics:read"
+	PermissionUsersImport      = "users:import"
+	PermissionUsersExport      = "users:export"
+)
+
+// Permissions holds the permission codes for a single user.
+type Permissions []string
+
+// Include checks whether the Permissions slice contains a specific permission code.
+func (p Permissions) Include(code string) bool {
+	for i := range p {
+		if code == p[i] {
+			return true
+		}
+	}
+	return false
+}
+
+type PermissionModel struct {
+	DB *sql.DB
+}
+
+// GetAllForUser returns all permission codes for a specific user.
+func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	query := `
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+        WHERE users_permissions.user_id = $1
+        ORDER BY permissions.code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// UnknownPermissionsError is returned by AddForUser when some of the codes don't exist.
+type UnknownPermissionsError struct {
+	Codes []string
+}
+
+func (e *UnknownPermissionsError) Error() string {
+	return fmt.Sprintf("unknown permission codes: %s", strings.Join(e.Codes, ", "))
+}
+
+// AddForUser grants the provided permission codes to a user and returns the codes
+// which were granted, leaving out those the user already had. If any of the codes
+// doesn't exist nothing is granted, and an *UnknownPermissionsError is returned.
+func (m PermissionModel) AddForUser(userID int64, codes ...string) (Permissions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        SELECT coalesce(array_agg(DISTINCT requested.code ORDER BY requested.code), '{}')
+        FROM unnest($1::text[]) AS requested(code)
+        WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = requested.code)`
+
+	var unknown []string
+	err = tx.QueryRowContext(ctx, query, pq.Array(codes)).Scan(pq.Array(&unknown))
+	if err != nil {
+		return nil, err
+	}
+	if len(unknown) > 0 {
+		return nil, &UnknownPermissionsError{Codes: unknown}
+	}
+
+	query = `
+        WITH granted AS (
+            INSERT INTO users_permissions
+            SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+            ON CONFLICT DO NOTHING
+            RETURNING permission_id)
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN granted ON granted.permission_id = permissions.id
+        ORDER BY permissions.code`
+
+	rows, err := tx.QueryContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	granted := Permissions{}
+
+	for rows.Next() {
+		var code string
+
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+
+		granted = append(granted, code)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return granted, tx.Commit()
+}
@@ -0,0 +1,86 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+var ErrDuplicateName = errors.New("duplicate name")
+
+// SCIMClient is an identity provider allowed to provision users over SCIM.
+type SCIMClient struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+}
+
+type SCIMClientModel struct {
+	DB *sql.DB
+}
+
+// New creates a client and returns it along with its bearer secret. The secret can't
+// be recovered later, only its hash is stored.
+func (m SCIMClientModel) New(name string) (*SCIMClient, string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(secret))
+
+	query := `
+        INSERT INTO scim_clients (name, secret_hash)
+        VALUES ($1, $2)
+        RETURNING id, created_at`
+
+	client := &SCIMClient{Name: name}
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, name, hash[:]).Scan(&client.ID, &client.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "scim_clients_name_key"`:
+			return nil, "", ErrDuplicateName
+		default:
+			return nil, "", err
+		}
+	}
+
+	return client, secret, nil
+}
+
+// GetForSecret returns the client a bearer secret belongs to.
+func (m SCIMClientModel) GetForSecret(secret string) (*SCIMClient, error) {
+	hash := sha256.Sum256([]byte(secret))
+
+	query := `
+        SELECT id, created_at, name
+        FROM scim_clients
+        WHERE secret_hash = $1`
+
+	var client SCIMClient
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(&client.ID, &client.CreatedAt, &client.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &client, nil
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/base32"
 	"time"
 
@@ -12,15 +13,31 @@ import (
 )
 
 const (
-	ScopeActivation = "activation"
+	ScopeActivation           = "activation"
+	ScopeAuthentication       = "authentication"
+	ScopeDeletionCancellation = "deletion-cancellation"
+	ScopeInvitation           = "invitation"
+	ScopeAccountSetup         = "account-setup"
 )
 
+// Only the plaintext token and its expiry are sent back to the client, the rest of
+// the fields stay on the server.
+// OrganizationID is set for the authentication tokens which are scoped to a single
+// organization, and 0 otherwise. ImpersonatorID is set for the tokens an admin was
+// issued to act as the user, see NewImpersonation.
 type Token struct {
-	Plaintext string
-	Hash      []byte
-	UserID    int64
-	Expiry    time.Time
-	Scope     string
+	Plaintext      string    `json:"token"`
+	Hash           []byte    `json:"-"`
+	UserID         int64     `json:"-"`
+	Expiry         time.Time `json:"expiry"`
+	Scope          string    `json:"-"`
+	OrganizationID int64     `json:"organization_id,omitempty"`
+	ImpersonatorID int64     `json:"impersonator_id,omitempty"`
+}
+
+// IsImpersonation reports whether the token was issued to an admin acting as the user.
+func (t *Token) IsImpersonation() bool {
+	return t.ImpersonatorID != 0
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -71,30 +88,65 @@ type TokenModel struct {
 
 // Check that the plaintext token has been provided and is exactly 52 bytes long.
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-	v.Check(tokenPlaintext != "", "token", "must be provided")
-	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+	v.Check(tokenPlaintext != "", "token", "required")
+	v.Check(tokenPlaintext == "" || len(tokenPlaintext) == 26, "token", "wrong_length", "len", "26")
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 
 	if err != nil {
 		return nil, err
 	}
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+// NewForOrganization creates a token which is only valid within one organization.
+func (m TokenModel) NewForOrganization(ctx context.Context, userID, orgID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.OrganizationID = orgID
+
+	err = m.Insert(ctx, token)
+
+	return token, err
+}
+
+// NewImpersonation creates an authentication token for userID which is flagged as
+// being used by the admin impersonatorID.
+func (m TokenModel) NewImpersonation(ctx context.Context, userID, impersonatorID int64, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.ImpersonatorID = impersonatorID
+
+	err = m.Insert(ctx, token)
+
+	return token, err
+}
+
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry, scope) 
-	VALUES ($1, $2, $3, $4)`
+	INSERT INTO tokens (hash, user_id, expiry, scope, org_id, impersonator_id) 
+	VALUES ($1, $2, $3, $4, $5, $6)`
+
+	var orgID, impersonatorID sql.NullInt64
+	if token.OrganizationID != 0 {
+		orgID = sql.NullInt64{Int64: token.OrganizationID, Valid: true}
+	}
+	if token.ImpersonatorID != 0 {
+		impersonatorID = sql.NullInt64{Int64: token.ImpersonatorID, Valid: true}
+	}
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, orgID, impersonatorID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
@@ -103,14 +155,122 @@ func (m TokenModel) Insert(token *Token) error {
 }
 
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
         DELETE FROM tokens 
         WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// GetAllForUser returns every unexpired token belonging to a user. It is used for
+// reporting, so callers must never send the Hash field anywhere.
+func (m TokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*Token, error) {
+	query := `
+        SELECT hash, user_id, expiry, scope, COALESCE(org_id, 0), COALESCE(impersonator_id, 0)
+        FROM tokens
+        WHERE user_id = $1 AND expiry > $2
+        ORDER BY expiry`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		var token Token
+
+		err := rows.Scan(&token.Hash, &token.UserID, &token.Expiry, &token.Scope, &token.OrganizationID, &token.ImpersonatorID)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// tokenSweepLockID is the key of the session level advisory lock held while expired
+// tokens are deleted, so that only one instance sweeps at a time.
+const tokenSweepLockID = 7_202_902
+
+// DeleteExpired deletes the expired tokens, batchSize rows per statement so that no
+// statement holds its row locks for long, and returns how many were deleted. It
+// returns ErrLocked without deleting anything when another instance is already
+// sweeping. When ctx is cancelled it stops after the current batch and returns what
+// was deleted so far along with the error.
+func (m TokenModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	// Session level advisory locks belong to a connection, so take and release the
+	// lock on one we hold for the whole sweep rather than on whatever the pool hands
+	// out.
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, tokenSweepLockID).Scan(&locked)
+	if err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, ErrLocked
+	}
+
+	defer func() {
+		// ctx may be done by now, the unlock must still run.
+		unlockCtx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+		defer cancel()
+
+		_, err := conn.ExecContext(unlockCtx, `SELECT pg_advisory_unlock($1)`, tokenSweepLockID)
+		if err != nil {
+			// Don't put a connection which may still hold the lock back in the pool,
+			// no instance could sweep until it is closed.
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	query := `
+        DELETE FROM tokens
+        WHERE hash IN (
+            SELECT hash FROM tokens
+            WHERE expiry < $1
+            LIMIT $2)`
+
+	var total int64
+
+	for {
+		batchCtx, cancel := context.WithTimeout(ctx, QueryTimeout)
+		result, err := conn.ExecContext(batchCtx, query, time.Now(), batchSize)
+		cancel()
+		if err != nil {
+			return total, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+
+		if n < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
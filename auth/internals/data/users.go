@@ -2,91 +2,181 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"errors"
+	"strings"
 	"time"
 
+	"github.com/islamghany/go-workshop/auth/internals/hasher"
+	"github.com/islamghany/go-workshop/auth/internals/passcheck"
 	"github.com/islamghany/go-workshop/auth/internals/validator"
-
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 )
 
+var ErrInvalidPasswordHash = errors.New("must be a bcrypt hash with a cost of at most 16")
+
 // Define a User struct to represent an individual user. Importantly, notice how we are
-// using the json:"-" struct tag to prevent the Password and Version fields appearing in
-// any output when we encode it to JSON. Also notice that the Password field uses the
-// custom password type defined below.
+// using the json:"-" struct tag to prevent the Password field appearing in any output
+// when we encode it to JSON. The Version field is exposed so that clients can send it
+// back when updating the user (optimistic locking). Also notice that the Password field
+// uses the custom password type defined below.
 type User struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name",validate:"required,min=6,max=72"`
-	Email     string    `json:"email",validate:"required,email"`
+	Name      string    `json:"name" validate:"required,max=500"`
+	Email     string    `json:"email" validate:"required,email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	Version   int       `json:"version"`
+}
+
+// AnonymousUser represents a request which has not been authenticated.
+var AnonymousUser = &User{}
+
+// IsAnonymous checks if a User instance is the AnonymousUser.
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
 }
 
+// PasswordHashers hashes new passwords with argon2id, and still verifies the bcrypt
+// hashes which were stored before argon2id became the default.
+var PasswordHashers = hasher.NewRegistry(
+	hasher.NewArgon2id(hasher.DefaultArgon2idParams),
+	legacyHasher,
+)
+
+// legacyHasher checks the hashes imported from the legacy system, which are bcrypt.
+var legacyHasher = hasher.NewBcrypt(12)
+
 // Create a custom password type which is a struct containing the plaintext and hashed
 // versions of the password for a user. The plaintext field is a *pointer* to a string,
 // so that we're able to distinguish between a plaintext password not being present in
-// the struct at all, versus a plaintext password which is the empty string "".
+// the struct at all, versus a plaintext password which is the empty string "". The
+// hash is the encoded string produced by PasswordHashers, which records the algorithm
+// and parameters it was made with.
 type password struct {
 	plaintext *string
 	hash      []byte
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
+// The Set() method hashes a plaintext password with the default algorithm, and stores
+// both the hash and the plaintext versions in the struct.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := PasswordHashers.Hash([]byte(plaintextPassword))
 	if err != nil {
 		return err
 	}
 
-	p.hash = hash
+	p.hash = []byte(hash)
 	p.plaintext = &plaintextPassword
 	return nil
 }
 
+// SetHash stores a bcrypt hash made by the legacy system. The hash is parsed and its
+// cost bounded before it is accepted, as it is verified with the cost it records; it
+// is upgraded to the default algorithm on the next login.
+func (p *password) SetHash(encoded string) error {
+	if legacyHasher.Validate(encoded) != nil {
+		return ErrInvalidPasswordHash
+	}
+
+	p.hash = []byte(encoded)
+	p.plaintext = nil
+	return nil
+}
+
+// SetRandom sets a random password which nobody knows, for accounts whose owner is
+// expected to choose a password through an account setup token.
+func (p *password) SetRandom() error {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	err = p.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	p.plaintext = nil
+	return err
+}
+
+// Encoded returns the stored hash, for exports.
+func (p *password) Encoded() string {
+	return string(p.hash)
+}
+
 // The Matches() method checks whether the provided plaintext password matches the
 // hashed password stored in the struct, returning true if it matches and false
 // otherwise.
 func (p *password) Mathces(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			{
-				return false, nil
-			}
-		default:
-			return false, err
-		}
-	}
+	match, _, err := p.Verify(plaintextPassword)
+	return match, err
+}
 
-	return true, nil
+// Verify is Mathces, but also reports whether the stored hash was made with another
+// algorithm than the default, or with outdated parameters. It should then be replaced
+// (with Set) while we have the plaintext password at hand, that is after a successful
+// login.
+func (p *password) Verify(plaintextPassword string) (match, needsRehash bool, err error) {
+	return PasswordHashers.Verify(string(p.hash), []byte(plaintextPassword))
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", "email", "must be provided")
-	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+	if email == "" {
+		v.AddError("email", "required")
+		return
+	}
+	v.Check(validator.Matches(email, validator.EmailRX), "email", "invalid_email")
 }
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+
+// MinPasswordScore is the lowest passcheck strength score (0 to 4) accepted for a new
+// password.
+const MinPasswordScore = 2
+
+// BreachedPasswords is the corpus new passwords are checked against. It is nil, and
+// the check skipped, when no corpus has been configured.
+var BreachedPasswords *passcheck.Corpus
+
+// ValidatePasswordPlaintext checks a new password. Besides its length, it rejects the
+// passwords which appear in the breached password corpus, and the ones which are too
+// easy to guess, reporting both when both apply. userInputs are strings an attacker
+// would know about the user, like their name and email address. The reasons for a
+// rejection are recorded with v.AddReasons.
+func ValidatePasswordPlaintext(v *validator.Validator, password string, userInputs ...string) {
+	if password == "" {
+		v.AddError("password", "required")
+		return
+	}
+	v.Check(len(password) >= 8, "password", "too_short", "min", "8")
+	v.Check(len(password) <= 1024, "password", "too_long", "max", "1024")
+
+	if !v.Field("password").Valid() {
+		return
+	}
+
+	if BreachedPasswords != nil && BreachedPasswords.Contains(password) {
+		v.AddError("password", "breached")
+		v.AddReasons("password", passcheck.ReasonBreached)
+	}
+
+	strength := passcheck.CheckStrength(password, userInputs...)
+	if strength.Score < MinPasswordScore {
+		v.AddError("password", "too_weak")
+		v.AddReasons("password", strength.Reasons...)
+	}
 }
 
+// ValidateUser checks the fields declared in the validate tags of User, and the new
+// password if there is one.
 func ValidateUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "name", "must be provided")
-	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
-
-	// Call the standalone ValidateEmail() helper.
-	ValidateEmail(v, user.Email)
+	validator.Struct(v, user)
 
 	// If the plaintext password is not nil, call the standalone
 	// ValidatePasswordPlaintext() helper.
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordPlaintext(v, *user.Password.plaintext, user.Name, user.Email)
 	}
 
 	// If the password hash is ever nil, this will be due to a logic error in our
@@ -103,14 +193,14 @@ type UserModel struct {
 	DB *sql.DB
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 
 	query := `
 		INSERT INTO users(name, email, password_hash, activated)
 		VALUES ($1,$2,$3,$4)
 		RETURNING id, created_at, version;
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
 	defer cancel()
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
@@ -127,18 +217,121 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Get retrieves a user by ID, soft-deleted users are excluded.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, version
+        FROM users
+        WHERE id = $1 AND deleted_at IS NULL`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// UserFilter narrows down the users returned by GetAll, on their email address. Zero
+// values match anything, the comparisons are case-insensitive.
+type UserFilter struct {
+	Email         string
+	EmailContains string
+	EmailPrefix   string
+}
+
+// GetAll returns up to limit users matching the filter, skipping the first offset, in
+// ID order. The total number of matching users is returned as well.
+func (m UserModel) GetAll(ctx context.Context, filter UserFilter, offset, limit int) ([]*User, int, error) {
+	// The total is counted on its own, a count(*) OVER() column would be missing from
+	// the pages past the end.
+	where := `
+        WHERE deleted_at IS NULL
+        AND (email = $1 OR $1 = '')
+        AND (strpos(lower(email), lower($2)) > 0 OR $2 = '')
+        AND (strpos(lower(email), lower($3)) = 1 OR $3 = '')`
+
+	args := []interface{}{filter.Email, filter.EmailContains, filter.EmailPrefix}
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	totalRecords := 0
+	err := m.DB.QueryRowContext(ctx, `SELECT count(*) FROM users`+where, args...).Scan(&totalRecords)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, version
+        FROM users` + where + `
+        ORDER BY id
+        LIMIT $4 OFFSET $5`
+
+	rows, err := m.DB.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return users, totalRecords, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
         SELECT id, created_at, name, email, password_hash, activated, version
         FROM users
-        WHERE email = $1`
+        WHERE email = $1 AND deleted_at IS NULL`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -168,11 +361,11 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 // when updating a movie. And we also check for a violation of the "users_email_key"
 // constraint when performing the update, just like we did when inserting the user
 // record originally.
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
         UPDATE users 
         SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        WHERE id = $5 AND version = $6 AND deleted_at IS NULL
         RETURNING version`
 
 	args := []interface{}{
@@ -184,7 +377,7 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -201,3 +394,279 @@ func (m UserModel) Update(user *User) error {
 
 	return nil
 }
+
+// GetForToken retrieves the user associated with a token. We hash the plaintext token
+// before looking it up, because only the SHA-256 hash is stored in the tokens table,
+// and we ignore tokens which have already expired. Soft-deleted users are excluded.
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	user, _, err := m.getForToken(ctx, tokenScope, tokenPlaintext, "users.deleted_at IS NULL")
+	return user, err
+}
+
+// GetForScopedToken is like GetForToken, but also returns the token itself, with the
+// organization it is scoped to and the admin impersonating the user, if any. Only the
+// Hash, UserID, Expiry, Scope, OrganizationID and ImpersonatorID fields are set.
+func (m UserModel) GetForScopedToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, *Token, error) {
+	return m.getForToken(ctx, tokenScope, tokenPlaintext, "users.deleted_at IS NULL")
+}
+
+// GetDeletedForToken is the counterpart of GetForToken for accounts which are within
+// their deletion grace period. It is only used to cancel a pending deletion.
+func (m UserModel) GetDeletedForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	user, _, err := m.getForToken(ctx, tokenScope, tokenPlaintext, "users.deleted_at IS NOT NULL")
+	return user, err
+}
+
+func (m UserModel) getForToken(ctx context.Context, tokenScope, tokenPlaintext, deletedFilter string) (*User, *Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+        tokens.expiry, COALESCE(tokens.org_id, 0), COALESCE(tokens.impersonator_id, 0)
+        FROM users
+        INNER JOIN tokens
+        ON users.id = tokens.user_id
+        WHERE tokens.hash = $1
+        AND tokens.scope = $2
+        AND tokens.expiry > $3
+        AND ` + deletedFilter
+
+	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+
+	var user User
+	token := Token{Hash: tokenHash[:], Scope: tokenScope}
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&token.Expiry,
+		&token.OrganizationID,
+		&token.ImpersonatorID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+
+	return &user, &token, nil
+}
+
+// SoftDelete marks the user as deleted without removing the row, so the deletion can
+// still be cancelled during the grace period. Like Update, it checks the version to
+// avoid racing with a concurrent change.
+func (m UserModel) SoftDelete(ctx context.Context, user *User) error {
+	query := `
+        UPDATE users
+        SET deleted_at = NOW(), version = version + 1
+        WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+        RETURNING version`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore cancels a pending deletion by clearing deleted_at.
+func (m UserModel) Restore(ctx context.Context, user *User) error {
+	query := `
+        UPDATE users
+        SET deleted_at = NULL, version = version + 1
+        WHERE id = $1 AND version = $2 AND deleted_at IS NOT NULL
+        RETURNING version`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PurgeDeleted permanently removes the users which were soft-deleted more than
+// gracePeriod ago, and returns how many rows were removed. Their tokens are removed
+// along with them by the ON DELETE CASCADE on tokens.user_id.
+func (m UserModel) PurgeDeleted(ctx context.Context, gracePeriod time.Duration) (int64, error) {
+	query := `
+        DELETE FROM users
+        WHERE deleted_at IS NOT NULL AND deleted_at < $1`
+
+	ctx, cancel := context.WithTimeout(ctx, bulkQueryTimeout())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-gracePeriod))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// InsertBatch bulk-inserts users with COPY, in a single transaction. Users whose email
+// is already taken are left out and returned, the others have their ID, CreatedAt and
+// Version set.
+func (m UserModel) InsertBatch(ctx context.Context, users []*User) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, bulkQueryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	emails := make([]string, len(users))
+	for i, user := range users {
+		emails[i] = user.Email
+	}
+
+	// Soft-deleted users still hold their email until they are purged, so they count
+	// as taken as well.
+	rows, err := tx.QueryContext(ctx, `SELECT lower(email) FROM users WHERE email = ANY($1::citext[])`, pq.Array(emails))
+	if err != nil {
+		return nil, err
+	}
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		taken[email] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var skipped []*User
+	byEmail := make(map[string]*User, len(users))
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("users", "name", "email", "password_hash", "activated"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		email := strings.ToLower(user.Email)
+		if taken[email] {
+			skipped = append(skipped, user)
+			continue
+		}
+		byEmail[email] = user
+
+		_, err = stmt.ExecContext(ctx, user.Name, user.Email, user.Password.hash, user.Activated)
+		if err != nil {
+			stmt.Close()
+			return nil, err
+		}
+	}
+
+	// The final Exec without arguments flushes the COPY.
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return nil, err
+	}
+	if err = stmt.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT id, created_at, version, lower(email) FROM users WHERE email = ANY($1::citext[])`, pq.Array(emails))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var createdAt time.Time
+		var version int
+		var email string
+
+		if err := rows.Scan(&id, &createdAt, &version, &email); err != nil {
+			return nil, err
+		}
+
+		if user, ok := byEmail[email]; ok {
+			user.ID, user.CreatedAt, user.Version = id, createdAt, version
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return skipped, tx.Commit()
+}
+
+// Stream calls fn for every user which isn't soft-deleted, in ID order, without
+// loading them all in memory. It stops at the first error returned by fn.
+func (m UserModel) Stream(ctx context.Context, fn func(user *User) error) error {
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, version
+        FROM users
+        WHERE deleted_at IS NULL
+        ORDER BY id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(&user); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,350 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+)
+
+// WebhookEvents are the user lifecycle events which can be subscribed to. They share
+// their names with the matching audit events.
+var WebhookEvents = []string{
+	EventUserRegistered,
+	EventUserActivated,
+	EventEmailChanged,
+	EventUserDeleted,
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookSubscription sends every occurrence of Event to URL. The secret is only sent
+// to the client when the subscription is created.
+type WebhookSubscription struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Event     string    `json:"event"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+}
+
+// WebhookDelivery is one event queued for one subscription. URL and Secret are copied
+// from the subscription when the delivery is claimed by the worker.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	SubscriptionID int64           `json:"subscription_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseCode   *int            `json:"response_code"`
+	LastError      *string         `json:"last_error"`
+	URL            string          `json:"-"`
+	Secret         string          `json:"-"`
+}
+
+// WebhookAttempt is an entry of the delivery log.
+type WebhookAttempt struct {
+	ID           int64     `json:"id"`
+	DeliveryID   int64     `json:"delivery_id"`
+	AttemptedAt  time.Time `json:"attempted_at"`
+	ResponseCode *int      `json:"response_code"`
+	Error        *string   `json:"error"`
+	DurationMS   int       `json:"duration_ms"`
+}
+
+func ValidateWebhookSubscription(v *validator.Validator, s *WebhookSubscription) {
+	v.Check(validator.In(s.Event, WebhookEvents...), "event", "invalid")
+
+	u, err := url.Parse(s.URL)
+	v.Check(s.URL != "", "url", "required")
+	v.Check(s.URL == "" || err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "url", "not_http")
+
+	v.Check(len(s.Secret) >= 16, "secret", "too_short", "min", "16")
+}
+
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+func (m WebhookModel) InsertSubscription(s *WebhookSubscription) error {
+	query := `
+        INSERT INTO webhook_subscriptions (event, url, secret)
+        VALUES ($1, $2, $3)
+        RETURNING id, created_at, active`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, s.Event, s.URL, s.Secret).Scan(&s.ID, &s.CreatedAt, &s.Active)
+}
+
+// GetAllSubscriptions returns every subscription, without their secrets.
+func (m WebhookModel) GetAllSubscriptions() ([]*WebhookSubscription, error) {
+	query := `
+        SELECT id, created_at, event, url, active
+        FROM webhook_subscriptions
+        ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []*WebhookSubscription{}
+
+	for rows.Next() {
+		var s WebhookSubscription
+
+		err := rows.Scan(&s.ID, &s.CreatedAt, &s.Event, &s.URL, &s.Active)
+		if err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, &s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+func (m WebhookModel) DeleteSubscription(id int64) error {
+	query := `
+        DELETE FROM webhook_subscriptions
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Enqueue queues a delivery of the payload for every active subscription to event.
+func (m WebhookModel) Enqueue(event string, payload []byte) error {
+	query := `
+        INSERT INTO webhook_deliveries (subscription_id, event, payload)
+        SELECT id, $1, $2 FROM webhook_subscriptions
+        WHERE event = $1 AND active`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, event, payload)
+	return err
+}
+
+// ClaimDue returns up to limit pending deliveries which are due. Their next attempt is
+// pushed lease into the future, so that other workers (on this or another instance)
+// skip them while they are in flight. RecordAttempt sets the real next attempt time.
+func (m WebhookModel) ClaimDue(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+        UPDATE webhook_deliveries d
+        SET next_attempt_at = $2
+        FROM webhook_subscriptions s
+        WHERE s.id = d.subscription_id AND d.id IN (
+            SELECT id FROM webhook_deliveries
+            WHERE status = 'pending' AND next_attempt_at <= NOW()
+            ORDER BY next_attempt_at
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING d.id, d.created_at, d.subscription_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at, s.url, s.secret`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, time.Now().Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var d WebhookDelivery
+
+		err := rows.Scan(&d.ID, &d.CreatedAt, &d.SubscriptionID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.URL, &d.Secret)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, &d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// RecordAttempt writes an attempt to the delivery log and saves the new state of the
+// delivery (status, attempts, next attempt time, last response) in one transaction.
+func (m WebhookModel) RecordAttempt(d *WebhookDelivery, attempt *WebhookAttempt) error {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        INSERT INTO webhook_delivery_attempts (delivery_id, response_code, error, duration_ms)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, attempted_at`
+
+	err = tx.QueryRowContext(ctx, query, d.ID, attempt.ResponseCode, attempt.Error, attempt.DurationMS).Scan(&attempt.ID, &attempt.AttemptedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+        UPDATE webhook_deliveries
+        SET status = $1, attempts = $2, next_attempt_at = $3, response_code = $4, last_error = $5
+        WHERE id = $6`
+
+	_, err = tx.ExecContext(ctx, query, d.Status, d.Attempts, d.NextAttemptAt, d.ResponseCode, d.LastError, d.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetDeliveriesForSubscription returns a page of deliveries, newest first.
+func (m WebhookModel) GetDeliveriesForSubscription(subscriptionID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+        SELECT count(*) OVER(), id, created_at, subscription_id, event, payload, status, attempts, next_attempt_at, response_code, last_error
+        FROM webhook_deliveries
+        WHERE subscription_id = $1
+        ORDER BY id DESC
+        LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, subscriptionID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var d WebhookDelivery
+
+		err := rows.Scan(&totalRecords, &d.ID, &d.CreatedAt, &d.SubscriptionID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.ResponseCode, &d.LastError)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, &d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return deliveries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// GetAttempts returns the delivery log of a single delivery, oldest first.
+func (m WebhookModel) GetAttempts(deliveryID int64) ([]*WebhookAttempt, error) {
+	query := `
+        SELECT id, delivery_id, attempted_at, response_code, error, duration_ms
+        FROM webhook_delivery_attempts
+        WHERE delivery_id = $1
+        ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []*WebhookAttempt{}
+
+	for rows.Next() {
+		var a WebhookAttempt
+
+		err := rows.Scan(&a.ID, &a.DeliveryID, &a.AttemptedAt, &a.ResponseCode, &a.Error, &a.DurationMS)
+		if err != nil {
+			return nil, err
+		}
+
+		attempts = append(attempts, &a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// Redeliver puts a delivery back in the queue, whatever its current status, with a
+// fresh attempt counter. The previous attempts stay in the delivery log.
+func (m WebhookModel) Redeliver(id int64) (*WebhookDelivery, error) {
+	query := `
+        UPDATE webhook_deliveries
+        SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+        WHERE id = $1
+        RETURNING id, created_at, subscription_id, event, payload, status, attempts, next_attempt_at, response_code, last_error`
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	var d WebhookDelivery
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&d.ID, &d.CreatedAt, &d.SubscriptionID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.ResponseCode, &d.LastError)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &d, nil
+}
@@ -0,0 +1,146 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2idParams are the cost parameters of argon2id. Memory is in KiB.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// The bounds of the parameters accepted from an encoded hash. A hash is verified with
+// the parameters it records, so without them a single stored hash could make a login
+// allocate gigabytes of memory, or panic.
+const (
+	maxArgon2idMemory     = 1024 * 1024 // 1 GiB, in KiB
+	maxArgon2idIterations = 64
+)
+
+// DefaultArgon2idParams follow the OWASP recommendation of 19 MiB of memory and two
+// iterations.
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Argon2id hashes passwords with argon2id. Unlike bcrypt it doesn't truncate long
+// passwords.
+type Argon2id struct {
+	Params Argon2idParams
+}
+
+func NewArgon2id(params Argon2idParams) *Argon2id {
+	return &Argon2id{Params: params}
+}
+
+func (a *Argon2id) Identifies(encoded string) bool {
+	return algorithm(encoded) == "argon2id"
+}
+
+func (a *Argon2id) Hash(password []byte) (string, error) {
+	salt := make([]byte, a.Params.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(password, salt, a.Params.Iterations, a.Params.Memory, a.Params.Parallelism, a.Params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		a.Params.Memory,
+		a.Params.Iterations,
+		a.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a *Argon2id) Verify(encoded string, password []byte) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey(password, salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a *Argon2id) Validate(encoded string) error {
+	_, _, _, err := decodeArgon2id(encoded)
+	return err
+}
+
+func (a *Argon2id) Outdated(encoded string) bool {
+	params, _, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params != a.Params
+}
+
+// decodeArgon2id parses $argon2id$v=19$m=...,t=...,p=...$<salt>$<key>, and checks that
+// its parameters are within bounds.
+func decodeArgon2id(encoded string) (Argon2idParams, []byte, []byte, error) {
+	var params Argon2idParams
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("%w: unsupported argon2 version %d", ErrInvalidHash, version)
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil || parts[3] != fmt.Sprintf("m=%d,t=%d,p=%d", params.Memory, params.Iterations, params.Parallelism) {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	// argon2.IDKey panics without an iteration or a thread, and the memory must hold
+	// 8 KiB blocks for each thread.
+	switch {
+	case params.Iterations < 1 || params.Iterations > maxArgon2idIterations:
+		return params, nil, nil, ErrInvalidHash
+	case params.Parallelism < 1:
+		return params, nil, nil, ErrInvalidHash
+	case params.Memory < 8*uint32(params.Parallelism) || params.Memory > maxArgon2idMemory:
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return params, nil, nil, ErrInvalidHash
+	}
+	params.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrInvalidHash
+	}
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
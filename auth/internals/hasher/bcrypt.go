@@ -0,0 +1,83 @@
+package hasher
+
+import (
+	"errors"
+	"regexp"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxBcryptCost bounds the cost accepted from an encoded hash, every step doubles the
+// time it takes to verify a password.
+const maxBcryptCost = 16
+
+// bcryptRX matches a bcrypt hash: the version, the cost and 53 characters of salt and
+// hash in bcrypt's base64 alphabet.
+var bcryptRX = regexp.MustCompile(`^\$2[aby]\$[0-9]{2}\$[./A-Za-z0-9]{53}$`)
+
+// Bcrypt hashes passwords with bcrypt. Its hashes ($2a$<cost>$...) already follow the
+// PHC layout, so they are stored as they are. Keep in mind that bcrypt only looks at
+// the first 72 bytes of a password.
+type Bcrypt struct {
+	Cost int
+}
+
+func NewBcrypt(cost int) *Bcrypt {
+	return &Bcrypt{Cost: cost}
+}
+
+func (b *Bcrypt) Identifies(encoded string) bool {
+	switch algorithm(encoded) {
+	case "2a", "2b", "2y":
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Bcrypt) Hash(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b *Bcrypt) Verify(encoded string, password []byte) (bool, error) {
+	err := b.Validate(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(encoded), password)
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (b *Bcrypt) Validate(encoded string) error {
+	if !bcryptRX.MatchString(encoded) {
+		return ErrInvalidHash
+	}
+
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil || cost < bcrypt.MinCost || cost > maxBcryptCost {
+		return ErrInvalidHash
+	}
+	return nil
+}
+
+func (b *Bcrypt) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+	return cost != b.Cost
+}
@@ -0,0 +1,104 @@
+// Package hasher hashes and verifies passwords with more than one algorithm.
+//
+// Hashes are stored as self-describing strings in the PHC string format, such as
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+//	$2a$12$<salt and hash>
+//
+// so the algorithm and parameters used for a stored hash can always be recovered from
+// it. This lets us change the default algorithm (or its cost) without breaking the
+// passwords hashed before the change, and tell which hashes should be upgraded.
+package hasher
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("hasher: unknown hash algorithm")
+	ErrInvalidHash      = errors.New("hasher: invalid encoded hash")
+)
+
+// Hasher is a single password hashing algorithm.
+type Hasher interface {
+	// Identifies reports whether an encoded hash was produced by this algorithm.
+	Identifies(encoded string) bool
+	// Hash returns the encoded hash of the password, using the current parameters.
+	Hash(password []byte) (string, error)
+	// Verify reports whether the password matches the encoded hash.
+	Verify(encoded string, password []byte) (bool, error)
+	// Validate returns an error wrapping ErrInvalidHash if the encoded hash is malformed,
+	// or records parameters outside the bounds the Hasher accepts.
+	Validate(encoded string) error
+	// Outdated reports whether the encoded hash uses other parameters than the ones
+	// Hash would use now.
+	Outdated(encoded string) bool
+}
+
+// Registry hashes new passwords with its default Hasher, and verifies hashes made by
+// any of its Hashers.
+type Registry struct {
+	def    Hasher
+	others []Hasher
+}
+
+// NewRegistry returns a registry which hashes with def, and can also verify hashes
+// made by the others.
+func NewRegistry(def Hasher, others ...Hasher) *Registry {
+	return &Registry{def: def, others: others}
+}
+
+// Hash hashes the password with the default Hasher.
+func (r *Registry) Hash(password []byte) (string, error) {
+	return r.def.Hash(password)
+}
+
+// Verify checks the password against the encoded hash, with whichever Hasher produced
+// it. When the password matches, needsRehash tells whether the hash was made by
+// another algorithm than the default, or with outdated parameters.
+func (r *Registry) Verify(encoded string, password []byte) (match, needsRehash bool, err error) {
+	h := r.lookup(encoded)
+	if h == nil {
+		return false, false, ErrUnknownAlgorithm
+	}
+
+	match, err = h.Verify(encoded, password)
+	if err != nil || !match {
+		return false, false, err
+	}
+
+	return true, h != r.def || h.Outdated(encoded), nil
+}
+
+// NeedsRehash reports whether the encoded hash should be replaced by a new one.
+func (r *Registry) NeedsRehash(encoded string) bool {
+	return !r.def.Identifies(encoded) || r.def.Outdated(encoded)
+}
+
+// Identifies reports whether the encoded hash was made by one of the registry's
+// Hashers, and can therefore be verified.
+func (r *Registry) Identifies(encoded string) bool {
+	return r.lookup(encoded) != nil
+}
+
+func (r *Registry) lookup(encoded string) Hasher {
+	if r.def.Identifies(encoded) {
+		return r.def
+	}
+	for _, h := range r.others {
+		if h.Identifies(encoded) {
+			return h
+		}
+	}
+	return nil
+}
+
+// algorithm returns the identifier of a PHC string, the part between the first two $.
+func algorithm(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,145 @@
+package hasher
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, the tests are about the encoding rather than the cost.
+var (
+	testArgon2id = NewArgon2id(Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 16})
+	testBcrypt   = NewBcrypt(bcrypt.MinCost)
+)
+
+func TestHashRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher Hasher
+		prefix string
+	}{
+		{"argon2id", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$"},
+		{"bcrypt", testBcrypt, "$2a$04$"},
+	}
+
+	// Long enough for bcrypt to truncate it.
+	password := []byte(strings.Repeat("correct horse battery staple ", 3))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.hasher.Hash(password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(encoded, tt.prefix) {
+				t.Errorf("Hash() = %q, want the prefix %q", encoded, tt.prefix)
+			}
+			if !tt.hasher.Identifies(encoded) {
+				t.Errorf("Identifies(%q) = false", encoded)
+			}
+			if err := tt.hasher.Validate(encoded); err != nil {
+				t.Errorf("Validate(%q) error = %v", encoded, err)
+			}
+			if tt.hasher.Outdated(encoded) {
+				t.Errorf("Outdated(%q) = true for a fresh hash", encoded)
+			}
+
+			if match, err := tt.hasher.Verify(encoded, password); !match || err != nil {
+				t.Errorf("Verify(right password) = %t, %v; want true", match, err)
+			}
+			if match, err := tt.hasher.Verify(encoded, []byte("wrong")); match || err != nil {
+				t.Errorf("Verify(wrong password) = %t, %v; want false", match, err)
+			}
+		})
+	}
+}
+
+func TestRegistryVerify(t *testing.T) {
+	password := []byte("correct horse battery staple")
+
+	argon2idHash, err := testArgon2id.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := testBcrypt.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	costlierBcryptHash, err := NewBcrypt(bcrypt.MinCost + 1).Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		registry    *Registry
+		encoded     string
+		password    string
+		match       bool
+		needsRehash bool
+		err         error
+	}{
+		{"default algorithm", NewRegistry(testArgon2id, testBcrypt), argon2idHash, string(password), true, false, nil},
+		{"other algorithm", NewRegistry(testArgon2id, testBcrypt), bcryptHash, string(password), true, true, nil},
+		{"other algorithm, wrong password", NewRegistry(testArgon2id, testBcrypt), bcryptHash, "wrong", false, false, nil},
+		{"bcrypt default", NewRegistry(testBcrypt, testArgon2id), argon2idHash, string(password), true, true, nil},
+		{"outdated cost", NewRegistry(testBcrypt), costlierBcryptHash, string(password), true, true, nil},
+		{"outdated params", NewRegistry(NewArgon2id(DefaultArgon2idParams)), argon2idHash, string(password), true, true, nil},
+		{"unknown algorithm", NewRegistry(testArgon2id), bcryptHash, string(password), false, false, ErrUnknownAlgorithm},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, needsRehash, err := tt.registry.Verify(tt.encoded, []byte(tt.password))
+			if match != tt.match || needsRehash != tt.needsRehash || !errors.Is(err, tt.err) {
+				t.Errorf("Verify() = %t, %t, %v; want %t, %t, %v", match, needsRehash, err, tt.match, tt.needsRehash, tt.err)
+			}
+			if got := tt.registry.NeedsRehash(tt.encoded); tt.match && got != tt.needsRehash {
+				t.Errorf("NeedsRehash() = %t; want %t", got, tt.needsRehash)
+			}
+		})
+	}
+}
+
+func TestMalformedHashes(t *testing.T) {
+	const (
+		salt = "c29tZXNhbHQ"
+		key  = "c29tZWtleXNvbWVrZXk"
+	)
+
+	tests := []struct {
+		name    string
+		hasher  Hasher
+		encoded string
+	}{
+		{"argon2id no iteration", testArgon2id, "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key},
+		{"argon2id no thread", testArgon2id, "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key},
+		{"argon2id too many threads", testArgon2id, "$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key},
+		{"argon2id too much memory", testArgon2id, "$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key},
+		{"argon2id too little memory", testArgon2id, "$argon2id$v=19$m=8,t=1,p=2$" + salt + "$" + key},
+		{"argon2id too many iterations", testArgon2id, "$argon2id$v=19$m=64,t=1000000,p=1$" + salt + "$" + key},
+		{"argon2id empty salt", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$$" + key},
+		{"argon2id empty key", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$"},
+		{"argon2id bad base64", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$!!!"},
+		{"argon2id other version", testArgon2id, "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key},
+		{"argon2id trailing parameters", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1,x=1$" + salt + "$" + key},
+		{"argon2id missing part", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$" + salt},
+		{"bcrypt too costly", testBcrypt, "$2a$31$" + strings.Repeat("a", 53)},
+		{"bcrypt too cheap", testBcrypt, "$2a$03$" + strings.Repeat("a", 53)},
+		{"bcrypt truncated", testBcrypt, "$2a$04$" + strings.Repeat("a", 52)},
+		{"bcrypt bad alphabet", testBcrypt, "$2a$04$" + strings.Repeat("!", 53)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.hasher.Validate(tt.encoded); !errors.Is(err, ErrInvalidHash) {
+				t.Errorf("Validate() error = %v; want %v", err, ErrInvalidHash)
+			}
+			if match, err := tt.hasher.Verify(tt.encoded, []byte("password")); match || !errors.Is(err, ErrInvalidHash) {
+				t.Errorf("Verify() = %t, %v; want false, %v", match, err, ErrInvalidHash)
+			}
+		})
+	}
+}
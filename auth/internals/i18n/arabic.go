@@ -0,0 +1,85 @@
+package i18n
+
+var arabic = map[string]string{
+	// Validation, the codes are prefixed with the field they apply to.
+	"required":          "هذا الحقل مطلوب",
+	"empty":             "يجب ألا يكون فارغًا",
+	"not_integer":       "يجب أن يكون عددًا صحيحًا",
+	"not_positive":      "يجب أن يكون أكبر من صفر",
+	"too_short":         "يجب ألا يقل طوله عن {min} بايت",
+	"too_long":          "يجب ألا يزيد طوله عن {max} بايت",
+	"wrong_length":      "يجب أن يكون طوله {len} بايت بالضبط",
+	"too_few":           "يجب أن يحتوي على {min} عناصر على الأقل",
+	"too_many":          "يجب ألا يحتوي على أكثر من {max} عناصر",
+	"wrong_count":       "يجب أن يحتوي على {len} عناصر بالضبط",
+	"too_small":         "يجب ألا يقل عن {min}",
+	"too_large":         "يجب ألا يزيد عن {max}",
+	"not_exactly":       "يجب أن يساوي {value}",
+	"not_allowed":       "يجب أن يكون إحدى القيم التالية: {values}",
+	"wrong_type":        "يجب أن يكون من النوع {type}",
+	"no_match":          "يجب أن يطابق النمط {pattern}",
+	"shorter_than":      "يجب ألا يقل طوله عن {min} حرفًا",
+	"longer_than":       "يجب ألا يزيد طوله عن {max} حرفًا",
+	"unknown_field":     "غير مسموح به",
+	"invalid":           "غير صالح",
+	"invalid_email":     "يجب أن يكون عنوان بريد إلكتروني صالحًا",
+	"invalid_url":       "يجب أن يكون رابطًا صالحًا",
+	"invalid_uuid":      "يجب أن يكون معرّف UUID صالحًا",
+	"taken":             "مستخدم بالفعل",
+	"email.taken":       "يوجد مستخدم بهذا البريد الإلكتروني بالفعل",
+	"slug.taken":        "توجد منظمة بهذا المعرّف بالفعل",
+	"slug.invalid":      "يجب أن يحتوي على أحرف لاتينية صغيرة وأرقام وشرطات فقط",
+	"event.invalid":     "يجب أن يكون حدثًا مدعومًا",
+	"url.not_http":      "يجب أن يكون رابط http أو https كاملًا",
+	"unknown_email":     "لا يوجد مستخدم بهذا البريد الإلكتروني",
+	"incorrect":         "غير صحيح",
+	"password.too_weak": "كلمة المرور سهلة التخمين",
+	"password.breached": "ظهرت كلمة المرور هذه في تسريب بيانات ولا يجوز استخدامها",
+
+	"current_password.required_for_change": "يجب إدخال كلمة المرور الحالية لتغيير البريد الإلكتروني أو كلمة المرور",
+	"permissions.unknown":                  "يجب أن يكون رمز صلاحية موجودًا",
+	"token.invalid_activation":             "رمز التفعيل غير صالح أو منتهي الصلاحية",
+	"token.invalid_account_setup":          "رمز إعداد الحساب غير صالح أو منتهي الصلاحية",
+	"token.invalid_deletion_cancellation":  "رمز إلغاء الحذف غير صالح أو منتهي الصلاحية",
+	"token.invalid_invitation":             "رمز الدعوة غير صالح أو منتهي الصلاحية",
+
+	// Request bodies.
+	"body.malformed":       "يحتوي الطلب على JSON غير سليم",
+	"body.malformed_at":    "يحتوي الطلب على JSON غير سليم (عند الحرف {offset})",
+	"body.wrong_type":      `يحتوي الطلب على نوع JSON غير صحيح للحقل "{field}"`,
+	"body.wrong_type_at":   "يحتوي الطلب على نوع JSON غير صحيح (عند الحرف {offset})",
+	"body.empty":           "يجب ألا يكون محتوى الطلب فارغًا",
+	"body.unknown_field":   `يحتوي الطلب على مفتاح غير معروف "{field}"`,
+	"body.too_large":       "يجب ألا يزيد حجم محتوى الطلب عن {max} بايت",
+	"body.multiple_values": "يجب أن يحتوي الطلب على قيمة JSON واحدة فقط",
+	"body.not_array":       "يجب أن يكون محتوى الطلب مصفوفة JSON",
+	"body.too_many_items":  "يجب ألا يحتوي الطلب على أكثر من {max} عنصر",
+	"body.malformed_as":    "يحتوي الطلب على {format} غير سليم",
+
+	// Patches.
+	"patch.invalid":        "عملية التعديل {index} غير صالحة: {reason}",
+	"patch.path_not_found": `تشير عملية التعديل {index} إلى "{path}" وهو غير موجود`,
+	"patch.test_failed":    `فشلت عملية التعديل {index}: لا يحتوي "{path}" على القيمة المختبرة`,
+
+	// Errors.
+	"failed_validation":         "يحتوي الطلب على حقول غير صالحة",
+	"server_error":              "واجه الخادم مشكلة ولم يتمكن من معالجة طلبك",
+	"not_found":                 "تعذر العثور على المورد المطلوب",
+	"method_not_allowed":        "الطريقة {method} غير مدعومة لهذا المورد",
+	"unsupported_media_type":    "يجب إرسال محتوى الطلب بصيغة {allowed}",
+	"not_acceptable":            "لا يمكن إرسال الاستجابة إلا بصيغة {available}",
+	"edit_conflict":             "تعذر تحديث السجل بسبب تعارض في التعديل، يرجى المحاولة مرة أخرى",
+	"precondition_required":     "يجب أن يتضمن هذا الطلب الترويسة If-Match أو X-Expected-Version",
+	"rate_limit_exceeded":       "تم تجاوز الحد المسموح به من الطلبات",
+	"invalid_credentials":       "بيانات تسجيل الدخول غير صحيحة",
+	"invalid_token":             "رمز المصادقة غير صالح أو مفقود",
+	"authentication_required":   "يجب تسجيل الدخول للوصول إلى هذا المورد",
+	"inactive_account":          "يجب تفعيل حسابك للوصول إلى هذا المورد",
+	"not_permitted":             "لا يملك حسابك الصلاحيات اللازمة للوصول إلى هذا المورد",
+	"organization_required":     "هذا المورد يتبع منظمة، حدّدها باستخدام الترويسة X-Organization",
+	"impersonation_not_allowed": "هذا الإجراء غير متاح أثناء انتحال هوية مستخدم",
+	"impersonation.self":        "لا يمكنك انتحال هويتك",
+	"impersonation.admin":       "لا يمكن انتحال هوية المستخدمين ذوي صلاحيات المشرف",
+	"org.last_owner":            "يجب أن يكون للمنظمة مالك واحد على الأقل",
+	"org_scoped_token":          "هذا الرمز مقيّد بمنظمة ولا يمكن استخدامه إلا داخلها",
+}
@@ -0,0 +1,86 @@
+package i18n
+
+var english = map[string]string{
+	// Validation, the codes are prefixed with the field they apply to.
+	"required":          "must be provided",
+	"empty":             "must not be empty",
+	"not_integer":       "must be an integer value",
+	"not_positive":      "must be greater than zero",
+	"too_short":         "must be at least {min} bytes long",
+	"too_long":          "must not be more than {max} bytes long",
+	"wrong_length":      "must be exactly {len} bytes long",
+	"too_few":           "must contain at least {min} items",
+	"too_many":          "must not contain more than {max} items",
+	"wrong_count":       "must contain exactly {len} items",
+	"too_small":         "must be at least {min}",
+	"too_large":         "must not be more than {max}",
+	"not_exactly":       "must be exactly {value}",
+	"not_allowed":       "must be one of {values}",
+	"wrong_type":        "must be of type {type}",
+	"no_match":          "must match the pattern {pattern}",
+	"shorter_than":      "must be at least {min} characters long",
+	"longer_than":       "must not be more than {max} characters long",
+	"unknown_field":     "is not allowed",
+	"invalid":           "is invalid",
+	"invalid_email":     "must be a valid email address",
+	"invalid_url":       "must be a valid URL",
+	"invalid_uuid":      "must be a valid UUID",
+	"taken":             "is already taken",
+	"email.taken":       "a user with this email address already exists",
+	"slug.taken":        "an organization with this slug already exists",
+	"slug.invalid":      "must only contain lowercase letters, digits and dashes",
+	"event.invalid":     "must be a supported event",
+	"url.not_http":      "must be an absolute http or https URL",
+	"unknown_email":     "no user with this email address",
+	"incorrect":         "is incorrect",
+	"password.too_weak": "is too easy to guess",
+	"password.breached": "has appeared in a data breach and must not be used",
+
+	"current_password.required_for_change": "must be provided to change the email address or the password",
+	"permissions.unknown":                  "must be an existing permission code",
+	"token.invalid_activation":             "invalid or expired activation token",
+	"token.invalid_account_setup":          "invalid or expired account setup token",
+	"token.invalid_deletion_cancellation":  "invalid or expired deletion cancellation token",
+	"token.invalid_invitation":             "invalid or expired invitation token",
+
+	// Request bodies.
+	"body.malformed":       "body contains badly-formed JSON",
+	"body.malformed_at":    "body contains badly-formed JSON (at character {offset})",
+	"body.wrong_type":      `body contains incorrect JSON type for field "{field}"`,
+	"body.wrong_type_at":   "body contains incorrect JSON type (at character {offset})",
+	"body.empty":           "body must not be empty",
+	"body.unknown_field":   `body contains unknown key "{field}"`,
+	"body.too_large":       "body must not be larger than {max} bytes",
+	"body.multiple_values": "body must only contain a single JSON value",
+	"body.not_array":       "body must be a JSON array",
+	"body.too_many_items":  "body must not contain more than {max} items",
+	"body.malformed_as":    "body contains badly-formed {format}",
+
+	// Patches.
+	"patch.invalid":        "patch operation {index} is invalid: {reason}",
+	"patch.path_not_found": `patch operation {index} refers to "{path}", which does not exist`,
+	"patch.test_failed":    `patch operation {index} failed: "{path}" does not hold the tested value`,
+
+	// Errors, bad_request carries the text of the errors which have no code of their own.
+	"bad_request":               "{reason}",
+	"failed_validation":         "the request contains invalid fields",
+	"server_error":              "the server encountered a problem and could not process your request",
+	"not_found":                 "the requested resource could not be found",
+	"method_not_allowed":        "the {method} method is not supported for this resource",
+	"unsupported_media_type":    "the request body must be sent as {allowed}",
+	"not_acceptable":            "the response can only be sent as {available}",
+	"edit_conflict":             "unable to update the record due to an edit conflict, please try again",
+	"precondition_required":     "this request must include an If-Match or X-Expected-Version header",
+	"rate_limit_exceeded":       "rate limit exceeded",
+	"invalid_credentials":       "invalid authentication credentials",
+	"invalid_token":             "invalid or missing authentication token",
+	"authentication_required":   "you must be authenticated to access this resource",
+	"inactive_account":          "your user account must be activated to access this resource",
+	"not_permitted":             "your user account doesn't have the necessary permissions to access this resource",
+	"organization_required":     "this resource belongs to an organization, name it with the X-Organization header",
+	"impersonation_not_allowed": "this action isn't available while impersonating a user",
+	"impersonation.self":        "you can't impersonate yourself",
+	"impersonation.admin":       "users with admin permissions can't be impersonated",
+	"org.last_owner":            "an organization must have at least one owner",
+	"org_scoped_token":          "this token is scoped to an organization and can only be used within it",
+}
@@ -0,0 +1,161 @@
+// Package i18n holds the catalog of the messages sent to clients, in every language
+// we speak, and picks the language of a request from its Accept-Language header.
+//
+// A message is identified by a stable code, such as "email.required", and the texts
+// refer to their parameters by name, as in "must be at least {min} bytes long". Codes
+// are made of dot separated segments, and when a code has no text of its own the
+// leading segments are dropped until one is found: "email.required" falls back to
+// "required", so field specific texts are only needed where the generic one reads
+// badly.
+package i18n
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/islamghany/go-workshop/negotiate"
+)
+
+const (
+	English = "en"
+	Arabic  = "ar"
+)
+
+// Languages are the languages we have a catalog for, the first is the default.
+var Languages = []string{English, Arabic}
+
+var (
+	catalogMu sync.RWMutex
+	catalogs  = map[string]map[string]string{
+		English: english,
+		Arabic:  arabic,
+	}
+)
+
+// Register adds the text for a code to the catalog of a language, replacing any text
+// the code already had.
+func Register(lang, code, text string) {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	if catalogs[lang] == nil {
+		catalogs[lang] = make(map[string]string)
+	}
+	catalogs[lang][code] = text
+}
+
+// Params are the values interpolated into a message, by name.
+type Params map[string]string
+
+// Message is a code from the catalog along with its parameters. It is also an error
+// whose text is the English message, so that it can be returned by code which doesn't
+// know who will read it.
+type Message struct {
+	Code   string `json:"code"`
+	Params Params `json:"params,omitempty"`
+}
+
+// New returns the message for code, with params given as name and value pairs.
+func New(code string, params ...string) Message {
+	if len(params)%2 != 0 {
+		panic("i18n: odd number of params for " + code)
+	}
+
+	m := Message{Code: code}
+	if len(params) > 0 {
+		m.Params = make(Params, len(params)/2)
+		for i := 0; i < len(params); i += 2 {
+			m.Params[params[i]] = params[i+1]
+		}
+	}
+	return m
+}
+
+// In returns the text of the message in lang. It falls back to English when lang has
+// no text for the code, and to the code itself when English has none either.
+func (m Message) In(lang string) string {
+	text, ok := lookup(lang, m.Code)
+	if !ok {
+		text, ok = lookup(English, m.Code)
+	}
+	if !ok {
+		return m.Code
+	}
+
+	return interpolate(text, m.Params)
+}
+
+func (m Message) Error() string {
+	return m.In(English)
+}
+
+func lookup(lang, code string) (string, bool) {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+
+	catalog := catalogs[lang]
+	for {
+		if text, ok := catalog[code]; ok {
+			return text, true
+		}
+
+		i := strings.Index(code, ".")
+		if i < 0 {
+			return "", false
+		}
+		code = code[i+1:]
+	}
+}
+
+func interpolate(text string, params Params) string {
+	if len(params) == 0 {
+		return text
+	}
+
+	pairs := make([]string, 0, len(params)*2)
+	for name, value := range params {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// Negotiate returns the language to answer a request in, given its Accept-Language
+// header (RFC 9110 section 12.5.4). Regional variants match their language, so
+// "ar-EG" selects Arabic, and the default language is returned when none of the
+// acceptable languages is one of ours.
+func Negotiate(acceptLanguage string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+
+	var candidates []candidate
+
+	for _, p := range negotiate.ParseAccept(acceptLanguage) {
+		if p.Q <= 0 {
+			continue
+		}
+
+		lang := strings.SplitN(p.Value, "-", 2)[0]
+		if p.Value == "*" {
+			lang = Languages[0]
+		}
+		candidates = append(candidates, candidate{lang, p.Q})
+	}
+
+	// Highest quality first, and in the client's order among equals.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	for _, c := range candidates {
+		for _, lang := range Languages {
+			if c.lang == lang {
+				return lang
+			}
+		}
+	}
+
+	return Languages[0]
+}
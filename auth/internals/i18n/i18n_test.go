@@ -0,0 +1,48 @@
+package i18n
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", English},
+		{"ar", Arabic},
+		{"AR-eg", Arabic},
+		{"fr, ar;q=0.5", Arabic},
+		{"ar;q=0.5, en", English},
+		{"ar;q=0, en;q=0.1", English},
+		{"ar, en", Arabic},
+		{"de, *;q=0.1", English},
+		{"fr", English},
+	}
+
+	for _, tt := range tests {
+		if got := Negotiate(tt.acceptLanguage); got != tt.want {
+			t.Errorf("Negotiate(%q) = %q; want %q", tt.acceptLanguage, got, tt.want)
+		}
+	}
+}
+
+func TestMessageIn(t *testing.T) {
+	tests := []struct {
+		message Message
+		lang    string
+		want    string
+	}{
+		{New("too_short", "min", "8"), English, "must be at least 8 bytes long"},
+		{New("too_short", "min", "8"), Arabic, "يجب ألا يقل طوله عن 8 بايت"},
+		{New("password.too_short", "min", "8"), English, "must be at least 8 bytes long"},
+		{New("email.taken"), English, "a user with this email address already exists"},
+		{New("name.taken"), English, "is already taken"},
+		{New("bad_request", "reason", "invalid id parameter"), Arabic, "invalid id parameter"},
+		{New("no_such_code"), Arabic, "no_such_code"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.message.In(tt.lang); got != tt.want {
+			t.Errorf("%s in %s = %q; want %q", tt.message.Code, tt.lang, got, tt.want)
+		}
+	}
+}
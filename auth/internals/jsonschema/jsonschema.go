@@ -0,0 +1,227 @@
+// Package jsonschema validates JSON documents against a subset of JSON Schema draft
+// 2020-12: type, required, properties, additionalProperties, enum, pattern,
+// minLength, maxLength, minimum, maximum, minItems, maxItems, items, $defs and $ref.
+// The other keywords, such as title and description, are accepted and ignored.
+//
+// Schemas are loaded together into a Set and may only refer to each other, or to
+// themselves, a $ref is never fetched.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Schema is a compiled schema, or one of its subschemas.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Defs                 map[string]*Schema `json:"$defs"`
+	Type                 types              `json:"type"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+	Enum                 []interface{}      `json:"enum"`
+	Pattern              string             `json:"pattern"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *json.Number       `json:"minimum"`
+	Maximum              *json.Number       `json:"maximum"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	Items                *Schema            `json:"items"`
+
+	// never is set for the false schema, which nothing is valid against. The true
+	// schema is the empty one.
+	never bool
+
+	pattern *regexp.Regexp
+	ref     *Schema
+}
+
+// UnmarshalJSON accepts the boolean schemas besides objects.
+func (s *Schema) UnmarshalJSON(b []byte) error {
+	var boolean bool
+	if err := json.Unmarshal(b, &boolean); err == nil {
+		*s = Schema{never: !boolean}
+		return nil
+	}
+
+	type plain Schema
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	return dec.Decode((*plain)(s))
+}
+
+// types is the type keyword, a single type or a list of them.
+type types []string
+
+func (t *types) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = types{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+// Set is a group of schemas which can refer to each other by name, the name of the
+// file they were loaded from, as in {"$ref": "address.json#/$defs/city"}.
+type Set struct {
+	schemas map[string]*Schema
+}
+
+// Load compiles every .json file in the dir directory of fsys.
+func Load(fsys fs.FS, dir string) (*Set, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	set := &Set{schemas: make(map[string]*Schema, len(files))}
+	for _, file := range files {
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		var s Schema
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("jsonschema: %s: %w", file, err)
+		}
+		set.schemas[path.Base(file)] = &s
+	}
+
+	for name, s := range set.schemas {
+		if err := set.compile(name, s, s); err != nil {
+			return nil, fmt.Errorf("jsonschema: %s: %w", name, err)
+		}
+	}
+
+	return set, nil
+}
+
+// Get returns the schema loaded from the file name, or nil.
+func (set *Set) Get(name string) *Schema {
+	return set.schemas[name]
+}
+
+// Names returns the names of the schemas of the set.
+func (set *Set) Names() []string {
+	names := make([]string, 0, len(set.schemas))
+	for name := range set.schemas {
+		names = append(names, name)
+	}
+	return names
+}
+
+// compile resolves the references and compiles the patterns of s, a subschema of the
+// root schema loaded from the file name.
+func (set *Set) compile(name string, root, s *Schema) error {
+	if s == nil {
+		return nil
+	}
+
+	if s.Ref != "" {
+		target, err := set.resolve(name, root, s.Ref)
+		if err != nil {
+			return err
+		}
+		s.ref = target
+	}
+
+	if s.Pattern != "" {
+		rx, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = rx
+	}
+
+	for _, t := range s.Type {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("unknown type %q", t)
+		}
+	}
+
+	children := []*Schema{s.AdditionalProperties, s.Items}
+	for _, child := range s.Defs {
+		children = append(children, child)
+	}
+	for _, child := range s.Properties {
+		children = append(children, child)
+	}
+	for _, child := range children {
+		if err := set.compile(name, root, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the schema ref refers to, from the schema loaded from the file name.
+func (set *Set) resolve(name string, root *Schema, ref string) (*Schema, error) {
+	file, pointer := ref, ""
+	if i := strings.Index(ref, "#"); i >= 0 {
+		file, pointer = ref[:i], ref[i+1:]
+	}
+
+	if file != "" {
+		root = set.schemas[path.Base(file)]
+		if root == nil || path.Base(file) != file {
+			return nil, fmt.Errorf("$ref %q: only the schemas of the set can be referred to", ref)
+		}
+	}
+
+	target := root
+	if pointer == "" {
+		return target, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("$ref %q: not a JSON pointer", ref)
+	}
+
+	segments := strings.Split(pointer[1:], "/")
+	for i := 0; i < len(segments) && target != nil; i++ {
+		keyword := unescape(segments[i])
+
+		switch keyword {
+		case "items":
+			target = target.Items
+			continue
+		case "additionalProperties":
+			target = target.AdditionalProperties
+			continue
+		}
+
+		if i+1 == len(segments) {
+			target = nil
+			break
+		}
+		i++
+		key := unescape(segments[i])
+
+		switch keyword {
+		case "$defs":
+			target = target.Defs[key]
+		case "properties":
+			target = target.Properties[key]
+		default:
+			target = nil
+		}
+	}
+
+	if target == nil {
+		return nil, fmt.Errorf("$ref %q: not found", ref)
+	}
+	return target, nil
+}
+
+func unescape(segment string) string {
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+}
@@ -0,0 +1,125 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func load(t *testing.T, files map[string]string) *Set {
+	t.Helper()
+
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys["schemas/"+name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	set, err := Load(fsys, "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func decode(t *testing.T, doc string) interface{} {
+	t.Helper()
+
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	set := load(t, map[string]string{
+		"common.json": `{"$defs": {"tag": {"type": "string", "minLength": 2, "maxLength": 4}}}`,
+		"item.json": `{
+			"type": "object",
+			"required": ["name", "count"],
+			"properties": {
+				"name": {"type": "string", "pattern": "^[a-z]+$"},
+				"count": {"type": "integer", "minimum": 1, "maximum": 10},
+				"price": {"type": ["number", "null"], "minimum": 0.5},
+				"kind": {"enum": ["a", "b", 3]},
+				"tags": {"type": "array", "maxItems": 2, "items": {"$ref": "common.json#/$defs/tag"}},
+				"owner": {"$ref": "#/$defs/owner"}
+			},
+			"additionalProperties": false,
+			"$defs": {
+				"owner": {"type": "object", "properties": {"id": {"type": "integer"}}, "additionalProperties": {"type": "string"}}
+			}
+		}`,
+	})
+	schema := set.Get("item.json")
+
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"valid", `{"name": "abc", "count": 3, "price": null, "kind": 3.0, "tags": ["ab", "żółw"], "owner": {"id": 1, "x": "y"}}`, nil},
+		{"not an object", `[]`, []string{": wrong_type map[type:object]"}},
+		{"missing", `{}`, []string{"/count: required map[]", "/name: required map[]"}},
+		{"unknown", `{"name": "a", "count": 1, "extra": 1}`, []string{"/extra: unknown_field map[]"}},
+		{"wrong type", `{"name": 1, "count": 1.5}`, []string{"/count: wrong_type map[type:integer]", "/name: wrong_type map[type:string]"}},
+		{"pattern", `{"name": "ABC", "count": 1}`, []string{"/name: no_match map[pattern:^[a-z]+$]"}},
+		{"bounds", `{"name": "a", "count": 11, "price": 0.25}`, []string{"/count: too_large map[max:10]", "/price: too_small map[min:0.5]"}},
+		{"enum", `{"name": "a", "count": 1, "kind": "c"}`, []string{"/kind: not_allowed map[values:a, b, 3]"}},
+		{
+			"items",
+			`{"name": "a", "count": 1, "tags": ["a", "abcde", "ab"]}`,
+			[]string{"/tags: too_many map[max:2]", "/tags/0: shorter_than map[min:2]", "/tags/1: longer_than map[max:4]"},
+		},
+		{"nested", `{"name": "a", "count": 1, "owner": {"id": "1", "a/b": 2}}`, []string{"/owner/a~1b: wrong_type map[type:string]", "/owner/id: wrong_type map[type:integer]"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range schema.Validate(decode(t, tt.doc)) {
+				got = append(got, e.Error())
+			}
+
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got errors\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{"remote ref", `{"$ref": "https://example.com/schema.json"}`, "only the schemas of the set"},
+		{"missing ref", `{"$ref": "#/$defs/nothing"}`, "not found"},
+		{"missing file", `{"$ref": "other.json"}`, "only the schemas of the set"},
+		{"bad pattern", `{"pattern": "("}`, "pattern"},
+		{"bad type", `{"type": "float"}`, "unknown type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"schemas/s.json": &fstest.MapFile{Data: []byte(tt.schema)}}
+			if _, err := Load(fsys, "schemas"); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v; want one about %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBooleanSchemas(t *testing.T) {
+	set := load(t, map[string]string{
+		"s.json": `{"properties": {"never": false, "always": true}}`,
+	})
+
+	errs := set.Get("s.json").Validate(decode(t, `{"never": 1, "always": 2}`))
+	if len(errs) != 1 || errs[0].Pointer() != "/never" || errs[0].Code != "invalid" {
+		t.Errorf("got %v; want /never invalid", errs)
+	}
+}
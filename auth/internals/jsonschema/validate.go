@@ -0,0 +1,232 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error is a violation of a schema. Path locates the value in the document, its
+// elements are the keys of objects (strings) and the indexes of arrays (ints). Code
+// says what is wrong, and Params are the values of the keyword which was violated:
+//
+//	required       the property is missing
+//	unknown_field  the property isn't allowed by additionalProperties
+//	wrong_type     {type} the value isn't of the type, or one of the types
+//	not_allowed    {values} the value isn't in enum
+//	no_match       {pattern} the string doesn't match pattern
+//	shorter_than   {min} the string has fewer than minLength characters
+//	longer_than    {max} the string has more than maxLength characters
+//	too_small      {min} the number is less than minimum
+//	too_large      {max} the number is greater than maximum
+//	too_few        {min} the array has fewer than minItems items
+//	too_many       {max} the array has more than maxItems items
+//	invalid        the value is against the false schema
+type Error struct {
+	Path   []interface{}
+	Code   string
+	Params map[string]string
+}
+
+// Pointer returns the JSON pointer (RFC 6901) of the value, such as "/tags/0".
+func (e Error) Pointer() string {
+	var b strings.Builder
+	for _, segment := range e.Path {
+		b.WriteString("/")
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(fmt.Sprint(segment)))
+	}
+	return b.String()
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%s: %s %v", e.Pointer(), e.Code, e.Params)
+}
+
+// Validate checks a document, decoded with a json.Decoder whose UseNumber method was
+// called, against the schema. It returns every violation, ordered by path.
+func (s *Schema) Validate(doc interface{}) []Error {
+	var errs []Error
+	s.validate(doc, nil, &errs)
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Pointer() < errs[j].Pointer()
+	})
+	return errs
+}
+
+func (s *Schema) validate(value interface{}, path []interface{}, errs *[]Error) {
+	fail := func(code string, params ...string) {
+		e := Error{Path: append([]interface{}(nil), path...), Code: code}
+		if len(params) > 0 {
+			e.Params = make(map[string]string, len(params)/2)
+			for i := 0; i < len(params); i += 2 {
+				e.Params[params[i]] = params[i+1]
+			}
+		}
+		*errs = append(*errs, e)
+	}
+
+	if s.never {
+		fail("invalid")
+		return
+	}
+	if s.ref != nil {
+		n := len(*errs)
+		s.ref.validate(value, path, errs)
+		if len(*errs) > n {
+			return
+		}
+	}
+
+	if len(s.Type) > 0 && !hasType(value, s.Type) {
+		fail("wrong_type", "type", strings.Join(s.Type, ", "))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		values := make([]string, len(s.Enum))
+		for i, allowed := range s.Enum {
+			values[i] = fmt.Sprint(allowed)
+			if equal(value, allowed) {
+				found = true
+			}
+		}
+		if !found {
+			fail("not_allowed", "values", strings.Join(values, ", "))
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("shorter_than", "min", strconv.Itoa(*s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("longer_than", "max", strconv.Itoa(*s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			fail("no_match", "pattern", s.Pattern)
+		}
+
+	case json.Number:
+		if s.Minimum != nil && compare(value, *s.Minimum) < 0 {
+			fail("too_small", "min", s.Minimum.String())
+		}
+		if s.Maximum != nil && compare(value, *s.Maximum) > 0 {
+			fail("too_large", "max", s.Maximum.String())
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			fail("too_few", "min", strconv.Itoa(*s.MinItems))
+		}
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			fail("too_many", "max", strconv.Itoa(*s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range value {
+				s.Items.validate(item, appendPath(path, i), errs)
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				*errs = append(*errs, Error{Path: appendPath(path, name), Code: "required"})
+			}
+		}
+
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if property, ok := s.Properties[key]; ok {
+				property.validate(value[key], appendPath(path, key), errs)
+				continue
+			}
+			if s.AdditionalProperties == nil {
+				continue
+			}
+			if s.AdditionalProperties.never {
+				*errs = append(*errs, Error{Path: appendPath(path, key), Code: "unknown_field"})
+				continue
+			}
+			s.AdditionalProperties.validate(value[key], appendPath(path, key), errs)
+		}
+	}
+}
+
+// appendPath returns a copy of path with the segment appended, so that the paths of
+// the errors never share their arrays.
+func appendPath(path []interface{}, segment interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(path)+1), path...), segment)
+}
+
+// hasType reports whether a value is of one of the types. Integers are the numbers
+// without a fractional part, so 1.0 is one.
+func hasType(value interface{}, types []string) bool {
+	for _, t := range types {
+		switch value := value.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if t == "integer" {
+				if r, ok := new(big.Rat).SetString(value.String()); ok && r.IsInt() {
+					return true
+				}
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compare compares two numbers exactly, whatever their size.
+func compare(a, b json.Number) int {
+	x, okX := new(big.Rat).SetString(a.String())
+	y, okY := new(big.Rat).SetString(b.String())
+	if !okX || !okY {
+		return 0
+	}
+	return x.Cmp(y)
+}
+
+// equal compares two JSON values, numbers by their value.
+func equal(a, b interface{}) bool {
+	x, okX := a.(json.Number)
+	y, okY := b.(json.Number)
+	if okX && okY {
+		return compare(x, y) == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
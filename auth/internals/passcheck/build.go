@@ -0,0 +1,73 @@
+package passcheck
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BuildCorpus converts a list of SHA-1 hashes into a corpus file. Each input line is a
+// hex encoded hash, optionally followed by ":<count>" as in the Have I Been Pwned
+// downloads, and the lines must be sorted by hash. The input is streamed, so the
+// full list doesn't have to fit in memory. It returns the number of records written,
+// which is smaller than the number of lines when truncated hashes collide.
+func BuildCorpus(r io.Reader, w io.Writer, prefix int) (int, error) {
+	if prefix < 4 || prefix > 20 {
+		return 0, fmt.Errorf("passcheck: prefix length must be between 4 and 20 bytes")
+	}
+
+	bw := bufio.NewWriter(w)
+
+	_, err := bw.Write(append(append([]byte{}, corpusMagic...), byte(prefix)))
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	var last []byte
+	written := 0
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if i := strings.IndexByte(text, ':'); i >= 0 {
+			text = text[:i]
+		}
+
+		sum, err := hex.DecodeString(text)
+		if err != nil || len(sum) != 20 {
+			return written, fmt.Errorf("passcheck: line %d: not a SHA-1 hash", line)
+		}
+
+		record := sum[:prefix]
+
+		switch c := bytes.Compare(record, last); {
+		case last != nil && c < 0:
+			return written, fmt.Errorf("passcheck: line %d: hashes are not sorted", line)
+		case last != nil && c == 0:
+			continue
+		}
+
+		_, err = bw.Write(record)
+		if err != nil {
+			return written, err
+		}
+
+		last = record
+		written++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return written, err
+	}
+
+	return written, bw.Flush()
+}
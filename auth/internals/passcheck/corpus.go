@@ -0,0 +1,196 @@
+// Package passcheck rejects passwords which are known to be breached, or which are
+// too easy to guess.
+package passcheck
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The breached password corpus is a binary file made of a small header followed by the
+SHA-1 hashes of the breached passwords, truncated to the same prefix length and sorted:
+
+	"BPC1" | prefix length (1 byte) | prefix | prefix | ...
+
+Since the records are sorted and have a fixed size, a lookup is a binary search which
+touches ~log2(n) pages of the file, so the file is memory-mapped (where the OS allows
+it) instead of being read into memory. Truncating the hashes keeps the file small, an
+8 byte prefix gives a false positive rate of about n/2^64.
+
+The file is built from the ordered-by-hash text download of Have I Been Pwned with
+the build-breach-corpus command, and it can be replaced while the server runs: call
+ReloadIfChanged periodically and a new file is picked up when its modification time
+changes. Replace the file by renaming a new one over it, never by rewriting it in
+place, the old version may still be mapped.
+*/
+
+var corpusMagic = []byte("BPC1")
+
+var ErrInvalidCorpus = errors.New("passcheck: invalid breached password corpus")
+
+// Corpus is a breached password corpus. It is safe for concurrent use.
+type Corpus struct {
+	path string
+
+	mu      sync.RWMutex
+	data    []byte // the records, without the header
+	prefix  int
+	modTime time.Time
+	release func() error
+}
+
+// OpenCorpus opens the corpus at path, memory-mapping it when possible.
+func OpenCorpus(path string) (*Corpus, error) {
+	c := &Corpus{path: path}
+
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// LoadCorpus reads the whole corpus at path into memory. This is simpler than
+// OpenCorpus, and fine for the smaller corpora.
+func LoadCorpus(path string) (*Corpus, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, prefix, err := parseCorpus(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Corpus{path: path, data: data, prefix: prefix, modTime: info.ModTime(), release: func() error { return nil }}, nil
+}
+
+func (c *Corpus) load() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	file, release, err := mapFile(f, info.Size())
+	if err != nil {
+		return err
+	}
+
+	data, prefix, err := parseCorpus(file)
+	if err != nil {
+		release()
+		return err
+	}
+
+	c.mu.Lock()
+	old := c.release
+	c.data, c.prefix, c.modTime, c.release = data, prefix, info.ModTime(), release
+	c.mu.Unlock()
+
+	if old != nil {
+		return old()
+	}
+	return nil
+}
+
+func parseCorpus(file []byte) ([]byte, int, error) {
+	if len(file) < len(corpusMagic)+1 || !bytes.Equal(file[:len(corpusMagic)], corpusMagic) {
+		return nil, 0, ErrInvalidCorpus
+	}
+
+	prefix := int(file[len(corpusMagic)])
+	data := file[len(corpusMagic)+1:]
+
+	if prefix < 4 || prefix > sha1.Size || len(data)%prefix != 0 {
+		return nil, 0, ErrInvalidCorpus
+	}
+
+	return data, prefix, nil
+}
+
+// ReloadIfChanged reopens the corpus file if it has been modified since it was last
+// loaded. It reports whether it did.
+func (c *Corpus) ReloadIfChanged() (bool, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	changed := !info.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	return true, c.load()
+}
+
+// Len returns the number of hashes in the corpus.
+func (c *Corpus) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.data) / c.prefix
+}
+
+// Contains reports whether password is in the corpus.
+func (c *Corpus) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key := sum[:c.prefix]
+	n := len(c.data) / c.prefix
+
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(c.record(i), key) >= 0
+	})
+
+	return i < n && bytes.Equal(c.record(i), key)
+}
+
+func (c *Corpus) record(i int) []byte {
+	return c.data[i*c.prefix : (i+1)*c.prefix]
+}
+
+// Close releases the memory mapping of the corpus.
+func (c *Corpus) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data = nil
+	if c.release == nil {
+		return nil
+	}
+
+	err := c.release()
+	c.release = nil
+	return err
+}
+
+func (c *Corpus) String() string {
+	return fmt.Sprintf("%s (%d hashes)", c.path, c.Len())
+}
@@ -0,0 +1,142 @@
+package passcheck
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCorpus builds a corpus of the passwords at path, with the counts of the Have I
+// Been Pwned downloads after the hashes.
+func writeCorpus(t *testing.T, path string, prefix int, passwords ...string) {
+	t.Helper()
+
+	var lines []string
+	for _, p := range passwords {
+		sum := sha1.Sum([]byte(p))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":42")
+	}
+	sort.Strings(lines)
+
+	var b bytes.Buffer
+	if _, err := BuildCorpus(strings.NewReader(strings.Join(lines, "\r\n")), &b, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorpusContains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.bpc")
+	writeCorpus(t, path, 8, "123456", "password", "iloveyou", "correct horse battery staple")
+
+	open := map[string]func(string) (*Corpus, error){
+		"OpenCorpus": OpenCorpus,
+		"LoadCorpus": LoadCorpus,
+	}
+
+	for name, open := range open {
+		t.Run(name, func(t *testing.T) {
+			c, err := open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if c.Len() != 4 {
+				t.Errorf("Len() = %d; want 4", c.Len())
+			}
+
+			tests := []struct {
+				password string
+				want     bool
+			}{
+				{"123456", true},
+				{"password", true},
+				{"correct horse battery staple", true},
+				{"Password", false},
+				{"", false},
+				{"kT9#vQ2!mW7$xB4&", false},
+			}
+			for _, tt := range tests {
+				if got := c.Contains(tt.password); got != tt.want {
+					t.Errorf("Contains(%q) = %t; want %t", tt.password, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCorpusReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "breached.bpc")
+	writeCorpus(t, path, 8, "password")
+
+	c, err := OpenCorpus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if reloaded, err := c.ReloadIfChanged(); reloaded || err != nil {
+		t.Fatalf("ReloadIfChanged() = %t, %v for an unchanged file", reloaded, err)
+	}
+
+	// Replace the file by renaming a new one over it, as it may still be mapped.
+	next := filepath.Join(dir, "next.bpc")
+	writeCorpus(t, next, 8, "iloveyou", "sunshine")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(next, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if reloaded, err := c.ReloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("ReloadIfChanged() = %t, %v for a replaced file", reloaded, err)
+	}
+	if c.Len() != 2 || c.Contains("password") || !c.Contains("sunshine") {
+		t.Errorf("the corpus wasn't replaced: %s", c)
+	}
+}
+
+func TestBuildCorpusErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		prefix int
+	}{
+		{"prefix too short", "", 3},
+		{"prefix too long", "", 21},
+		{"not a hash", "password\n", 8},
+		{"not sorted", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF\n0000000000000000000000000000000000000000\n", 8},
+	}
+
+	for _, tt := range tests {
+		if _, err := BuildCorpus(strings.NewReader(tt.input), new(bytes.Buffer), tt.prefix); err == nil {
+			t.Errorf("%s: BuildCorpus() error = nil", tt.name)
+		}
+	}
+}
+
+func TestInvalidCorpus(t *testing.T) {
+	for _, file := range []string{"", "BPC1", "XXXX\x08", "BPC1\x08" + "1234567"} {
+		path := filepath.Join(t.TempDir(), "breached.bpc")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadCorpus(path); !errors.Is(err, ErrInvalidCorpus) {
+			t.Errorf("LoadCorpus(%q) error = %v; want %v", file, err, ErrInvalidCorpus)
+		}
+	}
+}
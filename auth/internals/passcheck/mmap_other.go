@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package passcheck
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the whole file into memory on the platforms where we don't mmap.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	data := make([]byte, size)
+
+	_, err := io.ReadFull(f, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,290 @@
+package passcheck
+
+import (
+	"bufio"
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+/*
+Strength is a (much) simplified version of the approach taken by zxcvbn: instead of
+counting character classes, we look for the parts of a password an attacker would
+try first, and only count the rest as random characters.
+
+-dictionary words, after undoing common substitutions (p@ssw0rd is password)
+-runs along a keyboard row or the alphabet (qwerty, asdf, 1234, abcd), forwards or backwards
+-a character repeated (aaaa, 1111)
+-the user's own name and email address
+
+Each part found costs only a few bits of guessing, the remaining characters count as
+log2 of the size of their character class. The total is turned into a score from 0
+(trivial) to 4 (very strong).
+*/
+
+// Reasons a password is considered weak. They are stable codes, meant to be sent to
+// the client along with the validation error.
+const (
+	ReasonBreached        = "breached"
+	ReasonDictionaryWord  = "dictionary_word"
+	ReasonKeyboardPattern = "keyboard_pattern"
+	ReasonRepeated        = "repeated_characters"
+	ReasonPersonalInfo    = "personal_information"
+	ReasonTooSimple       = "too_simple"
+)
+
+//go:embed words.txt
+var wordsFile string
+
+var dictionary = loadDictionary(wordsFile)
+
+func loadDictionary(file string) map[string]struct{} {
+	words := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(strings.NewReader(file))
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if len(word) >= 4 && !strings.HasPrefix(word, "#") {
+			words[word] = struct{}{}
+		}
+	}
+
+	return words
+}
+
+var sequences = []string{
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+	"1234567890",
+	"abcdefghijklmnopqrstuvwxyz",
+	"qazwsxedcrfvtgbyhnujmikolp", // the columns of a qwerty keyboard
+}
+
+var substitutions = strings.NewReplacer(
+	"0", "o",
+	"1", "i",
+	"3", "e",
+	"4", "a",
+	"5", "s",
+	"7", "t",
+	"@", "a",
+	"$", "s",
+	"!", "i",
+)
+
+// Strength is the result of a strength check.
+type Strength struct {
+	Score   int      // 0 to 4
+	Bits    float64  // estimated guessing entropy
+	Reasons []string // the weaknesses which were found
+}
+
+// CheckStrength estimates how hard the password is to guess. userInputs are strings
+// an attacker targeting this user would know, such as their name and email address.
+func CheckStrength(password string, userInputs ...string) Strength {
+	lower := strings.ToLower(password)
+	normalized := substitutions.Replace(lower)
+
+	// covered[i] is true for the characters which are part of a weak pattern.
+	covered := make([]bool, len(lower))
+	var bits float64
+	var reasons []string
+
+	addReason := func(reason string) {
+		for _, r := range reasons {
+			if r == reason {
+				return
+			}
+		}
+		reasons = append(reasons, reason)
+	}
+
+	// Personal information is checked first, it is the first thing a targeted attack
+	// would try.
+	for _, input := range personalTokens(userInputs) {
+		for _, i := range indexAll(normalized, input) {
+			cover(covered, i, len(input))
+			bits += 2
+			addReason(ReasonPersonalInfo)
+		}
+	}
+
+	for word := range dictionary {
+		for _, i := range indexAll(normalized, word) {
+			if cover(covered, i, len(word)) {
+				bits += math.Log2(float64(len(dictionary)))
+				addReason(ReasonDictionaryWord)
+			}
+		}
+	}
+
+	for _, run := range sequenceRuns(lower) {
+		if cover(covered, run[0], run[1]) {
+			bits += math.Log2(float64(len(sequences) * 2 * 26))
+			addReason(ReasonKeyboardPattern)
+		}
+	}
+
+	for _, run := range repeatedRuns(lower) {
+		if cover(covered, run[0], run[1]) {
+			bits += math.Log2(float64(run[1]) * 95)
+			addReason(ReasonRepeated)
+		}
+	}
+
+	// The offsets of covered are those of lower, which may differ from those of the
+	// password: lowering a character can change its length in UTF-8.
+	for i, c := range lower {
+		if !covered[i] {
+			bits += math.Log2(float64(classSize(c)))
+		}
+	}
+
+	s := Strength{Bits: bits, Reasons: reasons}
+
+	switch {
+	case bits < 28:
+		s.Score = 0
+	case bits < 36:
+		s.Score = 1
+	case bits < 50:
+		s.Score = 2
+	case bits < 64:
+		s.Score = 3
+	default:
+		s.Score = 4
+	}
+
+	if s.Score < 2 && len(s.Reasons) == 0 {
+		s.Reasons = []string{ReasonTooSimple}
+	}
+
+	return s
+}
+
+// personalTokens splits the user inputs into the parts worth looking for: the words
+// of a name, and the local part and domain name of an email address.
+func personalTokens(userInputs []string) []string {
+	var tokens []string
+
+	for _, input := range userInputs {
+		fields := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, f := range fields {
+			if len(f) >= 3 && f != "com" && f != "net" && f != "org" {
+				tokens = append(tokens, f)
+			}
+		}
+	}
+
+	return tokens
+}
+
+// cover marks s[i:i+n] as covered, and reports whether at least half of it wasn't
+// covered yet (so overlapping patterns aren't counted twice).
+func cover(covered []bool, i, n int) bool {
+	fresh := 0
+	for j := i; j < i+n && j < len(covered); j++ {
+		if !covered[j] {
+			fresh++
+			covered[j] = true
+		}
+	}
+	return fresh*2 >= n
+}
+
+func indexAll(s, substr string) []int {
+	var indexes []int
+	for offset := 0; ; {
+		i := strings.Index(s[offset:], substr)
+		if i < 0 {
+			return indexes
+		}
+		indexes = append(indexes, offset+i)
+		offset += i + len(substr)
+	}
+}
+
+// sequenceRuns returns the [start, length] of every run of 4 or more characters which
+// follow each other in one of the sequences, forwards or backwards.
+func sequenceRuns(s string) [][2]int {
+	var runs [][2]int
+
+	for start := 0; start < len(s); {
+		end := start + 1
+		direction := 0
+
+		for end < len(s) {
+			d := step(s[end-1], s[end])
+			if d == 0 || (direction != 0 && d != direction) {
+				break
+			}
+			direction = d
+			end++
+		}
+
+		if end-start >= 4 {
+			runs = append(runs, [2]int{start, end - start})
+			start = end
+		} else {
+			start++
+		}
+	}
+
+	return runs
+}
+
+// step returns 1 if b follows a in one of the sequences, -1 if it precedes it, and 0
+// otherwise.
+func step(a, b byte) int {
+	for _, seq := range sequences {
+		i := strings.IndexByte(seq, a)
+		if i < 0 {
+			continue
+		}
+		if i+1 < len(seq) && seq[i+1] == b {
+			return 1
+		}
+		if i > 0 && seq[i-1] == b {
+			return -1
+		}
+	}
+	return 0
+}
+
+// repeatedRuns returns the [start, length] of every run of 3 or more identical
+// characters.
+func repeatedRuns(s string) [][2]int {
+	var runs [][2]int
+
+	for start := 0; start < len(s); {
+		end := start + 1
+		for end < len(s) && s[end] == s[start] {
+			end++
+		}
+		if end-start >= 3 {
+			runs = append(runs, [2]int{start, end - start})
+		}
+		start = end
+	}
+
+	return runs
+}
+
+func classSize(c rune) int {
+	switch {
+	case unicode.IsDigit(c):
+		return 10
+	case unicode.IsLower(c):
+		return 26
+	case unicode.IsUpper(c):
+		return 26
+	case c < unicode.MaxASCII:
+		return 33
+	default:
+		return 100
+	}
+}
@@ -0,0 +1,49 @@
+package passcheck
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCheckStrength(t *testing.T) {
+	tests := []struct {
+		password   string
+		userInputs []string
+		score      int
+		reasons    []string
+	}{
+		{"password", nil, 0, []string{ReasonDictionaryWord}},
+		{"P@ssw0rd", nil, 0, []string{ReasonDictionaryWord}},
+		{"qwertyuiop", nil, 0, []string{ReasonKeyboardPattern}},
+		{"9876543210", nil, 0, []string{ReasonKeyboardPattern}},
+		{"zzzzzzzzzzzz", nil, 0, []string{ReasonRepeated}},
+		{"alicesmith", []string{"Alice Smith", "alice@example.com"}, 0, []string{ReasonPersonalInfo}},
+		{"abc", nil, 0, []string{ReasonTooSimple}},
+		{"kT9#", nil, 0, []string{ReasonTooSimple}},
+		{"kT9#vQ2", nil, 1, []string{ReasonTooSimple}},
+		{"kT9#vQ2!m", nil, 2, nil},
+		{"kT9#vQ2!mW7$", nil, 3, nil},
+		{"kT9#vQ2!mW7$xB4&", nil, 4, nil},
+		{"dragon kT9#vQ2!mW7$", nil, 4, []string{ReasonDictionaryWord}},
+	}
+
+	for _, tt := range tests {
+		s := CheckStrength(tt.password, tt.userInputs...)
+		if s.Score != tt.score || !reflect.DeepEqual(s.Reasons, tt.reasons) {
+			t.Errorf("CheckStrength(%q) = %d %v (%.1f bits); want %d %v", tt.password, s.Score, s.Reasons, s.Bits, tt.score, tt.reasons)
+		}
+	}
+}
+
+// The characters which aren't part of a pattern are counted at their offset in the
+// lowered password, which isn't the one in the password when lowering changes the
+// length of a character: "Ⱥ" takes two bytes but "ⱥ" three.
+func TestCheckStrengthOffsets(t *testing.T) {
+	got := CheckStrength("ȺȺqwerty").Bits
+	want := CheckStrength("qwerty").Bits + 2*math.Log2(26)
+
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %.2f bits; want %.2f, the keyboard pattern and two letters", got, want)
+	}
+}
@@ -0,0 +1,59 @@
+package scim
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+)
+
+// parseFilter parses the filter query parameter of GET /Users. Only a single
+// comparison of the email address is supported, which covers what identity providers
+// send in practice:
+//
+//	userName eq "bjensen@example.com"
+//	emails.value co "example.com"
+//	emails sw "bjensen"
+//
+// Attribute names and operators are case-insensitive, as RFC 7644 requires.
+func parseFilter(filter string) (data.UserFilter, error) {
+	var f data.UserFilter
+
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return f, nil
+	}
+
+	parts := strings.SplitN(filter, " ", 3)
+	if len(parts) != 3 {
+		return f, errors.New(`the filter must be of the form <attribute> <operator> "<value>"`)
+	}
+
+	attr, op := strings.ToLower(parts[0]), strings.ToLower(parts[1])
+
+	value, err := strconv.Unquote(strings.TrimSpace(parts[2]))
+	if err != nil {
+		return f, errors.New("the filter value must be a quoted string")
+	}
+
+	switch attr {
+	case "username", "emails", "emails.value":
+	default:
+		return f, fmt.Errorf("filtering on %q is not supported", parts[0])
+	}
+
+	switch op {
+	case "eq":
+		f.Email = value
+	case "co":
+		f.EmailContains = value
+	case "sw":
+		f.EmailPrefix = value
+	default:
+		return f, fmt.Errorf("the %q operator is not supported", parts[1])
+	}
+
+	return f, nil
+}
@@ -0,0 +1,229 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+)
+
+// patchRequest is the body of PATCH /Users/:id (RFC 7644 section 3.5.2).
+type patchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []patchOperation `json:"Operations"`
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// patchError is a problem with the patch request, reported as a 400 with a scimType.
+type patchError struct {
+	scimType string
+	detail   string
+}
+
+func (e *patchError) Error() string {
+	return e.detail
+}
+
+func invalidPath(path string) error {
+	return &patchError{"invalidPath", fmt.Sprintf("the path %q is not supported", path)}
+}
+
+func invalidValue(path string, want string) error {
+	return &patchError{"invalidValue", fmt.Sprintf("the value of %q must be %s", path, want)}
+}
+
+// applyTo applies the operations to the user in order. A new password is returned
+// rather than set, so that it is validated and hashed only once.
+//
+// Identity providers disagree on the shape of the operations: Okta sends a replace
+// without a path whose value holds the attributes, Azure AD sends one operation per
+// path, capitalizes the op and sends booleans as "True" or "False". All of these are
+// accepted.
+func (p *patchRequest) applyTo(user *data.User) (string, error) {
+	if !contains(p.Schemas, PatchSchema) {
+		return "", &patchError{"invalidSyntax", fmt.Sprintf("the schemas must include %q", PatchSchema)}
+	}
+	if len(p.Operations) == 0 {
+		return "", &patchError{"invalidSyntax", "the request must contain at least one operation"}
+	}
+
+	var password string
+
+	for _, op := range p.Operations {
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+		case "remove":
+			// Every attribute we store is required.
+			return "", &patchError{"mutability", fmt.Sprintf("the attribute %q can't be removed", op.Path)}
+		default:
+			return "", &patchError{"invalidSyntax", fmt.Sprintf("unknown operation %q", op.Op)}
+		}
+
+		if op.Path != "" {
+			if err := applyPath(user, op.Path, op.Value, &password); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		var attributes map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return "", &patchError{"invalidValue", "an operation without a path must have an object value"}
+		}
+
+		// Apply the attributes in a fixed order, so that the outcome doesn't depend
+		// on the map iteration order when an object sets both userName and emails.
+		for _, path := range sortedKeys(attributes) {
+			if err := applyPath(user, path, attributes[path], &password); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return password, nil
+}
+
+// applyPath sets a single attribute.
+func applyPath(user *data.User, path string, value json.RawMessage, password *string) error {
+	switch strings.ToLower(path) {
+	case "active":
+		active, err := readBool(value)
+		if err != nil {
+			return invalidValue(path, "a boolean")
+		}
+		user.Activated = active
+
+	case "username", "emails.value", `emails[type eq "work"].value`, `emails[primary eq true].value`:
+		var email string
+		if err := json.Unmarshal(value, &email); err != nil {
+			return invalidValue(path, "a string")
+		}
+		user.Email = email
+
+	case "emails":
+		var emails []Email
+		if err := json.Unmarshal(value, &emails); err != nil {
+			return invalidValue(path, "an array of emails")
+		}
+		u := User{Emails: emails}
+		if email := u.primaryEmail(); email != "" {
+			user.Email = email
+		}
+
+	case "displayname", "name.formatted":
+		var name string
+		if err := json.Unmarshal(value, &name); err != nil {
+			return invalidValue(path, "a string")
+		}
+		user.Name = name
+
+	case "name":
+		var name Name
+		if err := json.Unmarshal(value, &name); err != nil {
+			return invalidValue(path, "an object")
+		}
+		switch {
+		case name.Formatted != "":
+			user.Name = name.Formatted
+		case name.GivenName != "" || name.FamilyName != "":
+			user.Name = strings.TrimSpace(name.GivenName + " " + name.FamilyName)
+		}
+
+	case "name.givenname", "name.familyname":
+		// We only store the full name, so treat its first word as the given name and
+		// the rest as the family name.
+		var part string
+		if err := json.Unmarshal(value, &part); err != nil {
+			return invalidValue(path, "a string")
+		}
+		given, family := user.Name, ""
+		if i := strings.Index(user.Name, " "); i >= 0 {
+			given, family = user.Name[:i], user.Name[i+1:]
+		}
+		if strings.ToLower(path) == "name.givenname" {
+			given = part
+		} else {
+			family = part
+		}
+		user.Name = strings.TrimSpace(given + " " + family)
+
+	case "password":
+		if err := json.Unmarshal(value, password); err != nil {
+			return invalidValue(path, "a string")
+		}
+
+	case "externalid", "schemas":
+		// Not stored.
+
+	default:
+		return invalidPath(path)
+	}
+
+	return nil
+}
+
+// readBool reads a JSON boolean, or the strings "true" and "false" in any case.
+func readBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(s) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean %q", s)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys in the order they are applied: emails before userName
+// and name before displayName, so that the attribute the user is mapped from wins.
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	rank := func(key string) string {
+		switch key = strings.ToLower(key); key {
+		case "emails":
+			return "0"
+		case "username":
+			return "1"
+		case "displayname":
+			return "3"
+		default:
+			return "2" + key
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return rank(keys[i]) < rank(keys[j])
+	})
+
+	return keys
+}
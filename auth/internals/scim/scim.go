@@ -0,0 +1,618 @@
+// Package scim implements the SCIM 2.0 (RFC 7643 and RFC 7644) user provisioning
+// endpoints, which identity providers such as Okta or Azure AD use to push their users
+// to the service.
+//
+// Only the User resource is supported. It is mapped onto data.User: userName and the
+// primary email are the email address, displayName (or name.formatted) is the name and
+// active is Activated. A user who is deactivated is signed out, their authentication
+// tokens are deleted.
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	UserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	ListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	ErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	PatchSchema  = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	ContentType = "application/scim+json"
+)
+
+// The events passed to Handler.OnChange.
+const (
+	EventCreated  = "created"
+	EventReplaced = "replaced"
+	EventPatched  = "patched"
+	EventDeleted  = "deleted"
+)
+
+const maxResults = 100
+
+// UserStore is the part of data.UserModel used by the handler.
+type UserStore interface {
+	Insert(ctx context.Context, user *data.User) error
+	Get(ctx context.Context, id int64) (*data.User, error)
+	Update(ctx context.Context, user *data.User) error
+	SoftDelete(ctx context.Context, user *data.User) error
+	GetAll(ctx context.Context, filter data.UserFilter, offset, limit int) ([]*data.User, int, error)
+}
+
+// TokenStore is the part of data.TokenModel used by the handler, to sign out the users
+// who are deactivated.
+type TokenStore interface {
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+}
+
+// ClientStore looks up the provisioning client a bearer secret belongs to.
+type ClientStore interface {
+	GetForSecret(secret string) (*data.SCIMClient, error)
+}
+
+// Handler serves the endpoints under /scim/v2.
+type Handler struct {
+	users   UserStore
+	tokens  TokenStore
+	clients ClientStore
+	router  *httprouter.Router
+
+	// OnChange, when set, is called after a user has been changed by a provisioning
+	// client, with one of the Event constants.
+	OnChange func(r *http.Request, client *data.SCIMClient, event string, user *data.User)
+
+	// ErrorLog, when set, is called with the unexpected errors before responding with
+	// a 500.
+	ErrorLog func(r *http.Request, err error)
+}
+
+func NewHandler(users UserStore, tokens TokenStore, clients ClientStore) *Handler {
+	h := &Handler{users: users, tokens: tokens, clients: clients}
+
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "", "the requested resource could not be found")
+	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, "", fmt.Sprintf("the %s method is not supported for this resource", r.Method))
+	})
+
+	router.HandlerFunc(http.MethodGet, "/scim/v2/ServiceProviderConfig", h.serviceProviderConfig)
+	router.HandlerFunc(http.MethodGet, "/scim/v2/Users", h.listUsers)
+	router.HandlerFunc(http.MethodPost, "/scim/v2/Users", h.createUser)
+	router.HandlerFunc(http.MethodGet, "/scim/v2/Users/:id", h.getUser)
+	router.HandlerFunc(http.MethodPut, "/scim/v2/Users/:id", h.replaceUser)
+	router.HandlerFunc(http.MethodPatch, "/scim/v2/Users/:id", h.patchUser)
+	router.HandlerFunc(http.MethodDelete, "/scim/v2/Users/:id", h.deleteUser)
+
+	h.router = router
+	return h
+}
+
+type contextKey string
+
+const clientContextKey = contextKey("scim_client")
+
+// ServeHTTP authenticates the provisioning client from its bearer secret, and routes
+// the request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	secret := ""
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) == 2 && headerParts[0] == "Bearer" {
+		secret = headerParts[1]
+	}
+
+	if secret == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "", "you must be authenticated to access this resource")
+		return
+	}
+
+	client, err := h.clients.GetForSecret(secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "", "invalid bearer secret")
+		default:
+			h.serverError(w, r, err)
+		}
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), clientContextKey, client))
+	h.router.ServeHTTP(w, r)
+}
+
+// User is the SCIM representation of a user. Password is only ever read, never sent.
+type User struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	UserName    string   `json:"userName"`
+	Name        *Name    `json:"name,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Emails      []Email  `json:"emails,omitempty"`
+	Active      *bool    `json:"active,omitempty"`
+	Password    string   `json:"password,omitempty"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	Location     string    `json:"location"`
+	Version      string    `json:"version"`
+}
+
+type listResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []User   `json:"Resources"`
+}
+
+// fromUser returns the SCIM representation of a user.
+func fromUser(r *http.Request, user *data.User) User {
+	active := user.Activated
+
+	return User{
+		Schemas:     []string{UserSchema},
+		ID:          strconv.FormatInt(user.ID, 10),
+		UserName:    user.Email,
+		Name:        &Name{Formatted: user.Name},
+		DisplayName: user.Name,
+		Emails:      []Email{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &Meta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			Location:     location(r, user.ID),
+			Version:      etag(user.Version),
+		},
+	}
+}
+
+// applyTo copies the attributes of the SCIM user onto a data.User. An absent active
+// attribute leaves Activated unchanged.
+func (u *User) applyTo(user *data.User) {
+	user.Email = u.UserName
+	if user.Email == "" {
+		user.Email = u.primaryEmail()
+	}
+
+	switch {
+	case u.DisplayName != "":
+		user.Name = u.DisplayName
+	case u.Name != nil && u.Name.Formatted != "":
+		user.Name = u.Name.Formatted
+	case u.Name != nil && (u.Name.GivenName != "" || u.Name.FamilyName != ""):
+		user.Name = strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+	default:
+		user.Name = user.Email
+	}
+
+	if u.Active != nil {
+		user.Activated = *u.Active
+	}
+}
+
+func (u *User) primaryEmail() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+func location(r *http.Request, id int64) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/scim/v2/Users/%d", scheme, r.Host, id)
+}
+
+func etag(version int) string {
+	return fmt.Sprintf("W/%q", strconv.Itoa(version))
+}
+
+func (h *Handler) serviceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	type supported struct {
+		Supported bool `json:"supported"`
+	}
+
+	config := map[string]interface{}{
+		"schemas":        []string{ConfigSchema},
+		"patch":          supported{true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": maxResults},
+		"changePassword": supported{true},
+		"sort":           supported{false},
+		"etag":           supported{true},
+		"authenticationSchemes": []map[string]string{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer secret",
+			"description": "A secret issued to each provisioning client",
+		}},
+	}
+
+	writeJSON(w, http.StatusOK, config, nil)
+}
+
+// listUsers implements GET /Users, with the filter, startIndex and count parameters.
+func (h *Handler) listUsers(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	filter, err := parseFilter(qs.Get("filter"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+		return
+	}
+
+	startIndex, err := readPositiveInt(qs.Get("startIndex"), 1)
+	if err != nil || startIndex < 1 {
+		// RFC 7644 says a startIndex below 1 is interpreted as 1.
+		startIndex = 1
+	}
+
+	count, err := readPositiveInt(qs.Get("count"), maxResults)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidValue", "count must be a positive integer")
+		return
+	}
+	if count > maxResults {
+		count = maxResults
+	}
+
+	resp := listResponse{
+		Schemas:    []string{ListSchema},
+		StartIndex: startIndex,
+		Resources:  []User{},
+	}
+
+	// A count of 0 asks for the number of results only. GetAll is still used to count
+	// them, with the smallest page.
+	limit := count
+	if limit == 0 {
+		limit = 1
+	}
+
+	users, total, err := h.users.GetAll(r.Context(), filter, startIndex-1, limit)
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	resp.TotalResults = total
+
+	if count > 0 {
+		for _, user := range users {
+			resp.Resources = append(resp.Resources, fromUser(r, user))
+		}
+	}
+	resp.ItemsPerPage = len(resp.Resources)
+
+	writeJSON(w, http.StatusOK, resp, nil)
+}
+
+func readPositiveInt(s string, defaultValue int) (int, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New("must be a positive integer")
+	}
+	return n, nil
+}
+
+// createUser implements POST /Users. Users created without a password get a random
+// one, they are expected to sign in through the identity provider.
+func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
+	var input User
+	if !h.readJSON(w, r, &input) {
+		return
+	}
+
+	user := &data.User{Activated: true}
+	input.applyTo(user)
+
+	if !h.setPassword(w, user, input.Password) {
+		return
+	}
+
+	if !h.validate(w, user) {
+		return
+	}
+
+	err := h.users.Insert(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			writeError(w, http.StatusConflict, "uniqueness", "a user with this userName already exists")
+		default:
+			h.serverError(w, r, err)
+		}
+		return
+	}
+
+	h.changed(r, EventCreated, user)
+
+	headers := make(http.Header)
+	headers.Set("Location", location(r, user.ID))
+	writeJSON(w, http.StatusCreated, fromUser(r, user), headers)
+}
+
+func (h *Handler) getUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, fromUser(r, user), nil)
+}
+
+// replaceUser implements PUT /Users/:id, which replaces every attribute of the user.
+func (h *Handler) replaceUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input User
+	if !h.readJSON(w, r, &input) {
+		return
+	}
+
+	input.applyTo(user)
+
+	if input.Password != "" && !h.setPassword(w, user, input.Password) {
+		return
+	}
+
+	h.update(w, r, EventReplaced, user)
+}
+
+// patchUser implements PATCH /Users/:id, see patch.go for the supported operations.
+func (h *Handler) patchUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input patchRequest
+	if !h.readJSON(w, r, &input) {
+		return
+	}
+
+	password, err := input.applyTo(user)
+	if err != nil {
+		var pe *patchError
+		if errors.As(err, &pe) {
+			writeError(w, http.StatusBadRequest, pe.scimType, pe.detail)
+			return
+		}
+		h.serverError(w, r, err)
+		return
+	}
+
+	if password != "" && !h.setPassword(w, user, password) {
+		return
+	}
+
+	h.update(w, r, EventPatched, user)
+}
+
+func (h *Handler) update(w http.ResponseWriter, r *http.Request, event string, user *data.User) {
+	if !h.validate(w, user) {
+		return
+	}
+
+	err := h.users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			writeError(w, http.StatusConflict, "uniqueness", "a user with this userName already exists")
+		case errors.Is(err, data.ErrEditConflict):
+			writeError(w, http.StatusPreconditionFailed, "", "the user was changed by another request, fetch it and try again")
+		default:
+			h.serverError(w, r, err)
+		}
+		return
+	}
+
+	// Deactivating a user in the identity provider is how they are deprovisioned, so
+	// the tokens they already hold must stop working too.
+	if !user.Activated {
+		err = h.tokens.DeleteAllForUser(r.Context(), data.ScopeAuthentication, user.ID)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+	}
+
+	h.changed(r, event, user)
+
+	writeJSON(w, http.StatusOK, fromUser(r, user), nil)
+}
+
+// deleteUser implements DELETE /Users/:id. The user is soft-deleted, like a deletion
+// requested by the user themselves, and purged after the grace period.
+func (h *Handler) deleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.users.SoftDelete(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			writeError(w, http.StatusPreconditionFailed, "", "the user was changed by another request, fetch it and try again")
+		default:
+			h.serverError(w, r, err)
+		}
+		return
+	}
+
+	h.changed(r, EventDeleted, user)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readUser loads the user named by the :id parameter, and checks the If-Match header
+// against its version when there is one.
+func (h *Handler) readUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		writeError(w, http.StatusNotFound, "", "the requested resource could not be found")
+		return nil, false
+	}
+
+	user, err := h.users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			writeError(w, http.StatusNotFound, "", "the requested resource could not be found")
+		default:
+			h.serverError(w, r, err)
+		}
+		return nil, false
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != etag(user.Version) {
+		writeError(w, http.StatusPreconditionFailed, "", "the user was changed since it was read, fetch it and try again")
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (h *Handler) setPassword(w http.ResponseWriter, user *data.User, password string) bool {
+	var err error
+	if password == "" {
+		err = user.Password.SetRandom()
+	} else {
+		v := validator.New()
+		if data.ValidatePasswordPlaintext(v, password, user.Name, user.Email); !v.Valid() {
+			writeError(w, http.StatusBadRequest, "invalidValue", "password "+v.Errors["password"].Error())
+			return false
+		}
+		err = user.Password.Set(password)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", "the server encountered a problem and could not process your request")
+		return false
+	}
+	return true
+}
+
+func (h *Handler) validate(w http.ResponseWriter, user *data.User) bool {
+	v := validator.New()
+	if data.ValidateUser(v, user); v.Valid() {
+		return true
+	}
+
+	// Report the errors with the SCIM attribute names.
+	names := map[string]string{"email": "userName", "name": "displayName"}
+
+	var details []string
+	for key, message := range v.Errors {
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		details = append(details, key+" "+message.Error())
+	}
+
+	sort.Strings(details)
+	writeError(w, http.StatusBadRequest, "invalidValue", strings.Join(details, ", "))
+	return false
+}
+
+func (h *Handler) changed(r *http.Request, event string, user *data.User) {
+	if h.OnChange != nil {
+		client, _ := r.Context().Value(clientContextKey).(*data.SCIMClient)
+		h.OnChange(r, client, event, user)
+	}
+}
+
+func (h *Handler) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := json.NewDecoder(r.Body).Decode(dst)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "the body must be a valid JSON object: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func (h *Handler) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	if h.ErrorLog != nil {
+		h.ErrorLog(r, err)
+	}
+	writeError(w, http.StatusInternalServerError, "", "the server encountered a problem and could not process your request")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}, headers http.Header) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// writeError sends a SCIM error response. scimType is only set for the 400 and 409
+// errors which RFC 7644 gives a type.
+func writeError(w http.ResponseWriter, status int, scimType, detail string) {
+	writeJSON(w, status, struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}{
+		Schemas:  []string{ErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	}, nil)
+}
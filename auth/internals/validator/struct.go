@@ -0,0 +1,374 @@
+package validator
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/islamghany/go-workshop/auth/internals/i18n"
+)
+
+// RuleFunc checks a field against a rule. param is what follows the "=" in the tag,
+// or "" when there is nothing. When the check fails it returns the error code, which
+// is prefixed with the field's key, and the parameters of its message; the code needs
+// a text in the i18n catalog. It returns "" when the check passes. Pointers are
+// dereferenced before a rule is called, and rules are never called on zero values, see
+// Struct.
+type RuleFunc func(field reflect.Value, param string) (code string, params i18n.Params)
+
+var (
+	rulesMu sync.RWMutex
+	rules   = map[string]RuleFunc{
+		"min":   minRule,
+		"max":   maxRule,
+		"len":   lenRule,
+		"email": emailRule,
+		"oneof": oneOfRule,
+		"url":   urlRule,
+		"uuid":  uuidRule,
+	}
+)
+
+// RegisterRule makes a rule available to validate tags under name, replacing any rule
+// already registered with that name. required and dive can't be replaced.
+func RegisterRule(name string, fn RuleFunc) {
+	if name == "required" || name == "dive" {
+		panic("validator: can't replace the " + name + " rule")
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules[name] = fn
+}
+
+func lookupRule(name string) RuleFunc {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	fn, ok := rules[name]
+	if !ok {
+		panic(fmt.Sprintf("validator: unknown rule %q", name))
+	}
+	return fn
+}
+
+// Struct checks the exported fields of x, a struct or a pointer to one, against their
+// validate tags and adds an error to v for every field which fails, for example
+//
+//	Name  string `json:"name" validate:"required,max=500"`
+//	Role  string `json:"role" validate:"oneof=owner admin member"`
+//	Tags []string `json:"tags" validate:"max=10,dive,required,max=20"`
+//
+// Errors are keyed by the json names of the fields. The fields of nested structs are
+// joined with dots and the elements of slices, arrays and maps get their index or key
+// in brackets, as in "addresses[0].city", and Details has them under JSON pointers
+// such as "/addresses/0/city". A field gets an error for every rule it fails, so
+// Errors has the first one.
+//
+// A field holding its zero value (an empty slice or map counts as zero, a pointer to a
+// zero value doesn't) is only checked by required, the other rules only apply to the
+// values which were given. Nested structs, and the structs held in slices, arrays and
+// maps, are always validated. The rules after dive apply to every element of the field
+// rather than to the field itself.
+func Struct(v *Validator, x interface{}) {
+	val := reflect.ValueOf(x)
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return
+		}
+		val = val.Elem()
+	}
+
+	if val.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("validator: Struct called with a %s", val.Type()))
+	}
+
+	validateStruct(v, val)
+}
+
+type rule struct {
+	name  string
+	param string
+}
+
+func parseTag(tag string) []rule {
+	if tag == "" {
+		return nil
+	}
+
+	var parsed []rule
+	for _, part := range strings.Split(tag, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		r := rule{name: strings.TrimSpace(kv[0])}
+		if len(kv) == 2 {
+			r.param = strings.TrimSpace(kv[1])
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed
+}
+
+// fieldName returns the name used for a field in the errors: its json name, or its Go
+// name when it has none.
+func fieldName(f reflect.StructField) string {
+	if tag := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]; tag != "" && tag != "-" {
+		return tag
+	}
+	return f.Name
+}
+
+// validateStruct validates the fields of val, v is scoped to the struct.
+func validateStruct(v *Validator, val reflect.Value) {
+	t := val.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		// The fields of an embedded struct are encoded as if they were the outer
+		// struct's, so they are keyed that way too.
+		if f.Anonymous && f.Tag.Get("json") == "" {
+			if field := indirect(val.Field(i)); field.Kind() == reflect.Struct {
+				validateStruct(v, field)
+				continue
+			}
+		}
+
+		validateField(v.Field(fieldName(f)), val.Field(i), parseTag(f.Tag.Get("validate")))
+	}
+}
+
+// validateField checks a field against its rules, v is scoped to the field.
+func validateField(v *Validator, field reflect.Value, rules []rule) {
+	for i, r := range rules {
+		if r.name == "dive" {
+			if apply(v, field, rules[:i]) {
+				dive(v, field, rules[i+1:])
+			}
+			return
+		}
+	}
+
+	if apply(v, field, rules) {
+		descend(v, field)
+	}
+}
+
+// apply checks the field against the rules and reports whether it passed them all.
+func apply(v *Validator, field reflect.Value, rules []rule) bool {
+	zero := isZero(field)
+	passed := true
+
+	for _, r := range rules {
+		if r.name == "required" {
+			if zero {
+				v.AddError("", "required")
+				return false
+			}
+			continue
+		}
+
+		if zero {
+			continue
+		}
+
+		if code, params := lookupRule(r.name)(indirect(field), r.param); code != "" {
+			v.addError("", code, params)
+			passed = false
+		}
+	}
+
+	return passed
+}
+
+// dive applies the rules to every element of the field.
+func dive(v *Validator, field reflect.Value, rules []rule) {
+	field = indirect(field)
+
+	switch field.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < field.Len(); i++ {
+			validateField(v.Index(i), field.Index(i), rules)
+		}
+	case reflect.Map:
+		for _, k := range sortedMapKeys(field) {
+			validateField(v.MapKey(fmt.Sprint(k.Interface())), field.MapIndex(k), rules)
+		}
+	case reflect.Invalid:
+	default:
+		panic(fmt.Sprintf("validator: can't dive into %s %s", v.key, field.Type()))
+	}
+}
+
+// descend validates the structs held by the field.
+func descend(v *Validator, field reflect.Value) {
+	field = indirect(field)
+
+	switch field.Kind() {
+	case reflect.Struct:
+		validateStruct(v, field)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < field.Len(); i++ {
+			if indirect(field.Index(i)).Kind() == reflect.Struct {
+				descend(v.Index(i), field.Index(i))
+			}
+		}
+	case reflect.Map:
+		for _, k := range sortedMapKeys(field) {
+			if indirect(field.MapIndex(k)).Kind() == reflect.Struct {
+				descend(v.MapKey(fmt.Sprint(k.Interface())), field.MapIndex(k))
+			}
+		}
+	}
+}
+
+func sortedMapKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+	})
+	return keys
+}
+
+// indirect follows pointers and interfaces, it returns the zero Value for nil.
+func indirect(val reflect.Value) reflect.Value {
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return reflect.Value{}
+		}
+		val = val.Elem()
+	}
+	return val
+}
+
+func isZero(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Ptr, reflect.Interface:
+		return val.IsNil()
+	case reflect.Slice, reflect.Map:
+		return val.Len() == 0
+	default:
+		return val.IsZero()
+	}
+}
+
+func intParam(rule, param string) int {
+	n, err := strconv.Atoi(param)
+	if err != nil {
+		panic(fmt.Sprintf("validator: invalid %s parameter %q", rule, param))
+	}
+	return n
+}
+
+func floatParam(rule, param string) float64 {
+	f, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validator: invalid %s parameter %q", rule, param))
+	}
+	return f
+}
+
+// number returns the value of a numeric field.
+func number(field reflect.Value) (float64, bool) {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(field.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(field.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return field.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// compareRule implements min, max and len, which compare the length of strings in
+// bytes, the number of elements of collections and the value of numbers. codes are
+// the error codes for each of these, and the parameter is passed to the message as
+// name for lengths and as value for numbers.
+func compareRule(name string, field reflect.Value, param string, fails func(got, want float64) bool, codes [3]string) (string, i18n.Params) {
+	switch field.Kind() {
+	case reflect.String:
+		if fails(float64(len(field.String())), float64(intParam(name, param))) {
+			return codes[0], i18n.Params{name: param}
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if fails(float64(field.Len()), float64(intParam(name, param))) {
+			return codes[1], i18n.Params{name: param}
+		}
+	default:
+		n, ok := number(field)
+		if !ok {
+			panic(fmt.Sprintf("validator: %s doesn't apply to %s", name, field.Type()))
+		}
+		if fails(n, floatParam(name, param)) {
+			if name == "len" {
+				return codes[2], i18n.Params{"value": param}
+			}
+			return codes[2], i18n.Params{name: param}
+		}
+	}
+	return "", nil
+}
+
+func minRule(field reflect.Value, param string) (string, i18n.Params) {
+	return compareRule("min", field, param, func(got, want float64) bool { return got < want },
+		[3]string{"too_short", "too_few", "too_small"})
+}
+
+func maxRule(field reflect.Value, param string) (string, i18n.Params) {
+	return compareRule("max", field, param, func(got, want float64) bool { return got > want },
+		[3]string{"too_long", "too_many", "too_large"})
+}
+
+func lenRule(field reflect.Value, param string) (string, i18n.Params) {
+	return compareRule("len", field, param, func(got, want float64) bool { return got != want },
+		[3]string{"wrong_length", "wrong_count", "not_exactly"})
+}
+
+func stringField(rule string, field reflect.Value) string {
+	if field.Kind() != reflect.String {
+		panic(fmt.Sprintf("validator: %s doesn't apply to %s", rule, field.Type()))
+	}
+	return field.String()
+}
+
+func emailRule(field reflect.Value, param string) (string, i18n.Params) {
+	if !Matches(stringField("email", field), EmailRX) {
+		return "invalid_email", nil
+	}
+	return "", nil
+}
+
+// oneOfRule checks the field against a space separated list of values.
+func oneOfRule(field reflect.Value, param string) (string, i18n.Params) {
+	values := strings.Fields(param)
+	if !In(fmt.Sprint(field.Interface()), values...) {
+		return "not_allowed", i18n.Params{"values": strings.Join(values, ", ")}
+	}
+	return "", nil
+}
+
+// urlRule accepts absolute URLs, with a scheme and a host.
+func urlRule(field reflect.Value, param string) (string, i18n.Params) {
+	u, err := url.Parse(stringField("url", field))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "invalid_url", nil
+	}
+	return "", nil
+}
+
+func uuidRule(field reflect.Value, param string) (string, i18n.Params) {
+	if !Matches(stringField("uuid", field), UUIDRX) {
+		return "invalid_uuid", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,260 @@
+package validator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/islamghany/go-workshop/auth/internals/i18n"
+)
+
+type address struct {
+	City    string `json:"city" validate:"required"`
+	Country string `json:"country" validate:"len=2"`
+}
+
+type Timestamps struct {
+	CreatedBy string `json:"created_by" validate:"required"`
+}
+
+type account struct {
+	Timestamps
+	Name      string             `json:"name" validate:"required,min=2,max=10"`
+	Email     string             `json:"email" validate:"required,email"`
+	Role      string             `json:"role" validate:"oneof=owner admin member"`
+	Code      string             `json:"code" validate:"len=5,oneof=alpha bravo"`
+	Website   string             `json:"website" validate:"url"`
+	ID        string             `json:"id" validate:"uuid"`
+	Age       int                `json:"age" validate:"max=150"`
+	Score     *float64           `json:"score" validate:"min=0.5"`
+	Tags      []string           `json:"tags" validate:"max=2,dive,required,max=5"`
+	Home      *address           `json:"home"`
+	Addresses []address          `json:"addresses"`
+	Labels    map[string]string  `json:"labels" validate:"dive,lowercase"`
+	Matrix    [][]int            `json:"matrix" validate:"dive,dive,min=1"`
+	Untagged  string             `validate:"required"`
+	Ignored   string             `json:"-" validate:"required"`
+	internal  string             `validate:"required"`
+	Extra     map[string]address `json:"extra"`
+}
+
+func init() {
+	RegisterRule("lowercase", func(field reflect.Value, param string) (string, i18n.Params) {
+		if field.String() != strings.ToLower(field.String()) {
+			return "not_lowercase", nil
+		}
+		return "", nil
+	})
+	i18n.Register(i18n.English, "not_lowercase", "must be lowercase")
+}
+
+func validAccount() *account {
+	return &account{
+		Timestamps: Timestamps{CreatedBy: "admin"},
+		Name:       "alice",
+		Email:      "alice@example.com",
+		Untagged:   "x",
+		Ignored:    "x",
+	}
+}
+
+func TestStruct(t *testing.T) {
+	zero := 0.0
+
+	tests := []struct {
+		name   string
+		modify func(a *account)
+		want   map[string]string
+	}{
+		{
+			name:   "valid",
+			modify: func(a *account) {},
+		},
+		{
+			name: "valid optional fields",
+			modify: func(a *account) {
+				a.Role = "admin"
+				a.Website = "https://example.com/path"
+				a.ID = "123e4567-e89b-12d3-a456-426614174000"
+				a.Age = 42
+				a.Tags = []string{"a", "b"}
+				a.Home = &address{City: "Cairo", Country: "EG"}
+				a.Labels = map[string]string{"env": "prod"}
+				a.Matrix = [][]int{{1, 2}, {3}}
+			},
+		},
+		{
+			name: "missing",
+			modify: func(a *account) {
+				*a = account{}
+			},
+			want: map[string]string{
+				"created_by": "created_by.required: must be provided",
+				"name":       "name.required: must be provided",
+				"email":      "email.required: must be provided",
+				"Untagged":   "Untagged.required: must be provided",
+				"Ignored":    "Ignored.required: must be provided",
+			},
+		},
+		{
+			name: "first failing rule wins",
+			modify: func(a *account) {
+				a.Name = "a"
+				a.Email = "not an email"
+			},
+			want: map[string]string{
+				"name":  "name.too_short: must be at least 2 bytes long",
+				"email": "email.invalid_email: must be a valid email address",
+			},
+		},
+		{
+			name: "strings",
+			modify: func(a *account) {
+				a.Name = "much too long"
+				a.Role = "root"
+				a.Website = "example.com"
+				a.ID = "123e4567"
+			},
+			want: map[string]string{
+				"name":    "name.too_long: must not be more than 10 bytes long",
+				"role":    "role.not_allowed: must be one of owner, admin, member",
+				"website": "website.invalid_url: must be a valid URL",
+				"id":      "id.invalid_uuid: must be a valid UUID",
+			},
+		},
+		{
+			name: "numbers",
+			modify: func(a *account) {
+				a.Age = 200
+				a.Score = &zero
+			},
+			want: map[string]string{
+				"age":   "age.too_large: must not be more than 150",
+				"score": "score.too_small: must be at least 0.5",
+			},
+		},
+		{
+			name: "collection length",
+			modify: func(a *account) {
+				a.Tags = []string{"a", "b", "c"}
+			},
+			want: map[string]string{
+				"tags": "tags.too_many: must not contain more than 2 items",
+			},
+		},
+		{
+			name: "dive",
+			modify: func(a *account) {
+				a.Tags = []string{"", "toolong"}
+				a.Labels = map[string]string{"b": "OK", "a": "fine"}
+				a.Matrix = [][]int{{1}, {2, -1}}
+			},
+			want: map[string]string{
+				"tags[0]":      "tags.required: must be provided",
+				"tags[1]":      "tags.too_long: must not be more than 5 bytes long",
+				"labels[b]":    "labels.not_lowercase: must be lowercase",
+				"matrix[1][1]": "matrix.too_small: must be at least 1",
+			},
+		},
+		{
+			name: "nested structs",
+			modify: func(a *account) {
+				a.Home = &address{Country: "EGY"}
+				a.Addresses = []address{{City: "Cairo", Country: "EG"}, {}}
+				a.Extra = map[string]address{"work": {Country: "E"}}
+			},
+			want: map[string]string{
+				"home.city":           "home.city.required: must be provided",
+				"home.country":        "home.country.wrong_length: must be exactly 2 bytes long",
+				"addresses[1].city":   "addresses.city.required: must be provided",
+				"extra[work].city":    "extra.city.required: must be provided",
+				"extra[work].country": "extra.country.wrong_length: must be exactly 2 bytes long",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := validAccount()
+			tt.modify(a)
+
+			v := New()
+			Struct(v, a)
+
+			want := tt.want
+			if want == nil {
+				want = map[string]string{}
+			}
+			got := make(map[string]string, len(v.Errors))
+			for key, message := range v.Errors {
+				got[key] = message.Code + ": " + message.Error()
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got errors %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestStructDetails(t *testing.T) {
+	a := validAccount()
+	a.Code = "abc"
+	a.Tags = []string{"", "toolong", "x"}
+	a.Addresses = []address{{}, {City: "Cairo", Country: "EGY"}}
+
+	v := New()
+	Struct(v, a)
+
+	want := map[string][]string{
+		"/code":                {"code.wrong_length", "code.not_allowed"},
+		"/tags":                {"tags.too_many"},
+		"/addresses/0/city":    {"addresses.city.required"},
+		"/addresses/1/country": {"addresses.country.wrong_length"},
+	}
+
+	got := make(map[string][]string, len(v.Details))
+	for pointer, messages := range v.Details {
+		for _, message := range messages {
+			got[pointer] = append(got[pointer], message.Code)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got details %v; want %v", got, want)
+	}
+
+	if got := v.Errors["code"].Code; got != "code.wrong_length" {
+		t.Errorf("got code error %q; want the first one", got)
+	}
+	if got := v.Key("/addresses/1/country"); got != "addresses[1].country" {
+		t.Errorf("got key %q; want addresses[1].country", got)
+	}
+}
+
+func TestStructPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		x    interface{}
+	}{
+		{"not a struct", "alice"},
+		{"unknown rule", &struct {
+			Name string `validate:"shiny"`
+		}{"alice"}},
+		{"bad parameter", &struct {
+			Name string `validate:"max=ten"`
+		}{"alice"}},
+		{"rule on the wrong type", &struct {
+			Count int `validate:"email"`
+		}{1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Struct didn't panic")
+				}
+			}()
+			Struct(New(), tt.x)
+		})
+	}
+}
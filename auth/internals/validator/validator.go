@@ -1,38 +1,218 @@
 package validator
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
+
+	"github.com/islamghany/go-workshop/auth/internals/i18n"
 )
 
 var (
+	UUIDRX  = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
+// Validator holds the errors found in a request. Errors holds the first error of
+// every key, as in "addresses[2].city", and Details every error in the order they
+// were added, under the JSON pointer (RFC 6901) of the field, as in
+// "/addresses/2/city". The errors are messages from the i18n catalog, whose code is
+// the key followed by what went wrong, as in "email.required", so they can be sent in
+// the language of the client. Reasons optionally holds stable codes explaining an
+// error in more detail, for example why a password was rejected.
+//
+// The validators returned by Field, Index and MapKey are scoped to a nested field
+// and share their errors with the validator they come from.
 type Validator struct {
-	Errors map[string]string
+	Errors  map[string]i18n.Message
+	Details map[string][]i18n.Message
+	Reasons map[string][]string
+
+	// key and pointer locate the field the validator is scoped to, they are empty
+	// for the validator returned by New.
+	key, pointer string
+	keys         map[string]string
 }
 
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{
+		Errors:  make(map[string]i18n.Message),
+		Details: make(map[string][]i18n.Message),
+		Reasons: make(map[string][]string),
+		keys:    make(map[string]string),
+	}
 }
 
+// Valid reports whether no error has been added, by v or by any validator scoped
+// within v.
 func (v *Validator) Valid() bool {
-	return len(v.Errors) == 0
+	if v.pointer == "" {
+		return len(v.Errors) == 0
+	}
+
+	for pointer := range v.Details {
+		if pointer == v.pointer || strings.HasPrefix(pointer, v.pointer+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// Field returns a validator for the field name of the object v is scoped to.
+func (v *Validator) Field(name string) *Validator {
+	key := name
+	if v.key != "" {
+		key = v.key + "." + name
+	}
+	return v.scope(key, v.pointer+"/"+escapePointer(name))
+}
+
+// Index returns a validator for the element i of the array v is scoped to.
+func (v *Validator) Index(i int) *Validator {
+	return v.scope(fmt.Sprintf("%s[%d]", v.key, i), fmt.Sprintf("%s/%d", v.pointer, i))
 }
 
-func (v *Validator) AddError(key, message string) {
+// MapKey returns a validator for the value under k in the map v is scoped to.
+func (v *Validator) MapKey(k string) *Validator {
+	return v.scope(v.key+"["+k+"]", v.pointer+"/"+escapePointer(k))
+}
+
+func (v *Validator) scope(key, pointer string) *Validator {
+	scoped := *v
+	scoped.key, scoped.pointer = key, pointer
+	return &scoped
+}
+
+// AddError records the error code for a key, with the parameters of its message given
+// as name and value pairs, e.g. v.AddError("password", "too_short", "min", "8"). The
+// key is relative to the field v is scoped to, it may itself be nested as in
+// "home.city" or "tags[2]", and "" is the field itself. A key keeps every error it
+// is given, except that the same code is only recorded once.
+func (v *Validator) AddError(key, code string, params ...string) {
+	v.addError(key, code, i18n.New(code, params...).Params)
+}
+
+func (v *Validator) addError(key, code string, params i18n.Params) {
+	key, pointer := v.locate(key)
+	message := i18n.Message{Code: errorCode(key, code), Params: params}
+
+	for _, existing := range v.Details[pointer] {
+		if existing.Code == message.Code {
+			return
+		}
+	}
+	v.Details[pointer] = append(v.Details[pointer], message)
+	v.keys[pointer] = key
+
 	if _, exists := v.Errors[key]; !exists {
 		v.Errors[key] = message
 	}
 }
 
-// Check adds an error message to the map only if a validation check is not 'ok'.
-func (v *Validator) Check(ok bool, key, message string) {
+// AddReasons records the reasons behind the error for a key.
+func (v *Validator) AddReasons(key string, reasons ...string) {
+	key, _ = v.locate(key)
+	v.Reasons[key] = append(v.Reasons[key], reasons...)
+}
+
+// Check adds an error code to the map only if a validation check is not 'ok'.
+func (v *Validator) Check(ok bool, key, code string, params ...string) {
 	if !ok {
-		v.AddError(key, message)
+		v.AddError(key, code, params...)
 	}
 }
 
+// Key returns the key in Errors of the field at pointer, a path found in Details.
+func (v *Validator) Key(pointer string) string {
+	return v.keys[pointer]
+}
+
+// locate returns the key and the JSON pointer of a key relative to v.
+func (v *Validator) locate(key string) (string, string) {
+	pointer := v.pointer + keyPointer(key)
+
+	switch {
+	case key == "":
+		key = v.key
+	case v.key != "" && key[0] == '[':
+		key = v.key + key
+	case v.key != "":
+		key = v.key + "." + key
+	}
+	return key, pointer
+}
+
+// keyPointer converts a key such as "addresses[2].city" to a JSON pointer such as
+// "/addresses/2/city".
+func keyPointer(key string) string {
+	var b strings.Builder
+	var segment strings.Builder
+	depth := 0
+
+	flush := func() {
+		b.WriteString("/")
+		b.WriteString(escapePointer(segment.String()))
+		segment.Reset()
+	}
+
+	for i, r := range key {
+		switch {
+		case r == '[' && depth == 0:
+			if i > 0 && key[i-1] != ']' {
+				flush()
+			}
+			depth++
+		case r == ']' && depth == 1:
+			flush()
+			depth--
+		case r == '.' && depth == 0:
+			if i > 0 && key[i-1] != ']' {
+				flush()
+			}
+		default:
+			if r == '[' {
+				depth++
+			} else if r == ']' {
+				depth--
+			}
+			segment.WriteRune(r)
+		}
+	}
+	if segment.Len() > 0 {
+		flush()
+	}
+
+	return b.String()
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escapePointer(segment string) string {
+	return pointerEscaper.Replace(segment)
+}
+
+// errorCode prefixes code with the key, leaving out the indexes of the elements of
+// slices and maps so that "tags[2]" and "tags[0]" share their codes.
+func errorCode(key, code string) string {
+	var b strings.Builder
+	depth := 0
+
+	for _, r := range key {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+
+	b.WriteString(".")
+	b.WriteString(code)
+	return b.String()
+}
+
 // In returns true if a specific value in a list of strings.
 func In(value string, list ...string) bool {
 	for i := range list {
@@ -0,0 +1,86 @@
+package validator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyPointer(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"", ""},
+		{"email", "/email"},
+		{"home.city", "/home/city"},
+		{"tags[2]", "/tags/2"},
+		{"matrix[1][0]", "/matrix/1/0"},
+		{"extra[work].city", "/extra/work/city"},
+		{"labels[a/b~c]", "/labels/a~1b~0c"},
+		{"[3]", "/3"},
+	}
+
+	for _, tt := range tests {
+		if got := keyPointer(tt.key); got != tt.want {
+			t.Errorf("keyPointer(%q) = %q; want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestScopedValidators(t *testing.T) {
+	v := New()
+	v.AddError("password", "too_short", "min", "8")
+	v.AddError("password", "breached")
+	v.AddError("password", "breached")
+
+	genres := v.Field("genres")
+	genres.Index(2).AddError("", "too_long", "max", "20")
+
+	home := v.Field("home")
+	if !home.Valid() {
+		t.Error("home is invalid before any of its errors were added")
+	}
+	home.AddError("city", "required")
+	home.Field("address").Index(0).AddError("line", "required")
+	v.Field("labels").MapKey("a/b").Check(false, "", "empty")
+
+	if v.Valid() || home.Valid() || !v.Field("name").Valid() {
+		t.Error("got the wrong validity for the scopes")
+	}
+
+	wantErrors := map[string]string{
+		"password":             "password.too_short",
+		"genres[2]":            "genres.too_long",
+		"home.city":            "home.city.required",
+		"home.address[0].line": "home.address.line.required",
+		"labels[a/b]":          "labels.empty",
+	}
+	gotErrors := make(map[string]string, len(v.Errors))
+	for key, message := range v.Errors {
+		gotErrors[key] = message.Code
+	}
+	if !reflect.DeepEqual(gotErrors, wantErrors) {
+		t.Errorf("got errors %v; want %v", gotErrors, wantErrors)
+	}
+
+	wantDetails := map[string][]string{
+		"/password":            {"password.too_short", "password.breached"},
+		"/genres/2":            {"genres.too_long"},
+		"/home/city":           {"home.city.required"},
+		"/home/address/0/line": {"home.address.line.required"},
+		"/labels/a~1b":         {"labels.empty"},
+	}
+	gotDetails := make(map[string][]string, len(v.Details))
+	for pointer, messages := range v.Details {
+		for _, message := range messages {
+			gotDetails[pointer] = append(gotDetails[pointer], message.Code)
+		}
+	}
+	if !reflect.DeepEqual(gotDetails, wantDetails) {
+		t.Errorf("got details %v; want %v", gotDetails, wantDetails)
+	}
+
+	if got := v.Details["/genres/2"][0].Params["max"]; got != "20" {
+		t.Errorf("got max param %q; want 20", got)
+	}
+}
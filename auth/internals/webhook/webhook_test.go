@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendSignsPayload(t *testing.T) {
+	const secret = "s3cret"
+	body := []byte(`{"event":"user.registered","data":{"id":1}}`)
+
+	var verifyErr error
+	var received []byte
+	var header string
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		header = r.Header.Get(SignatureHeader)
+		verifyErr = Verify(secret, header, received, 5*time.Minute)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	sentAt := time.Now().Add(-time.Minute)
+	status, err := Send(context.Background(), receiver.Client(), receiver.URL, secret, sentAt, body)
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if status != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", status, http.StatusNoContent)
+	}
+	if string(received) != string(body) {
+		t.Errorf("receiver got body %q, want %q", received, body)
+	}
+	if verifyErr != nil {
+		t.Errorf("receiver couldn't verify the signature: %v", verifyErr)
+	}
+	if want := fmt.Sprintf("t=%d,", sentAt.Unix()); !strings.HasPrefix(header, want) {
+		t.Errorf("signature = %q, want it signed at %s", header, want)
+	}
+}
+
+func TestSendReportsFailedResponses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	status, err := Send(context.Background(), receiver.Client(), receiver.URL, "secret", time.Now(), []byte(`{}`))
+	if err == nil {
+		t.Fatal("Send() error = nil, want an error for a 503 response")
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		header string
+		want   error
+	}{
+		{"valid", Sign("secret", now, body), nil},
+		{"wrong secret", Sign("other", now, body), ErrInvalidSignature},
+		{"replayed", Sign("secret", now.Add(-time.Hour), body), ErrExpiredSignature},
+		{"malformed", "v1=zz", ErrInvalidSignature},
+		{"missing timestamp", "v1=00", ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify("secret", tt.header, body, 5*time.Minute)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{20, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
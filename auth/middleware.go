@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+)
+
+// requestIDRX matches the request IDs we accept from clients or proxies, anything else
+// is replaced so that it can't be used to inject content into the logs.
+var requestIDRX = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// requestID makes sure every request has an ID which is echoed back in the
+// X-Request-ID response header and recorded with the audit events.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			randomBytes := make([]byte, 16)
+			if _, err := rand.Read(randomBytes); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestID(r, id)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response will vary depending on the value of the Authorization header, so
+		// let any caches know about it.
+		w.Header().Add("Vary", "Authorization")
+
+		// If there is no Authorization header, add the AnonymousUser to the request
+		// context and move on to the next handler.
+		authorizationHeader := r.Header.Get("Authorization")
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Otherwise we expect the header to be in the format "Bearer <token>".
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		token := headerParts[1]
+
+		v := validator.New()
+		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		user, t, err := app.models.Users.GetForScopedToken(r.Context(), data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, t)
+
+		if t.IsImpersonation() {
+			app.serveImpersonated(next, w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveImpersonated serves a request made by an admin with an impersonation token. The
+// X-Impersonated-By header lets the frontend show a banner, and every request is
+// written to the audit log along with its response status.
+func (app *application) serveImpersonated(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	impersonatorID := app.contextGetImpersonatorID(r)
+
+	w.Header().Set("X-Impersonated-By", strconv.FormatInt(impersonatorID, 10))
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(sw, r)
+
+	app.audit(r, data.EventImpersonatedRequest, impersonatorID, user.ID, map[string]string{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"status": strconv.Itoa(sw.status),
+	})
+}
+
+// statusWriter records the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// denyImpersonation blocks the sensitive actions, such as deleting the account, for
+// requests made with an impersonation token. Actions which are only sensitive for
+// some inputs (changing the password or email) are checked by their handlers.
+func (app *application) denyImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetImpersonatorID(r) != 0 {
+			app.impersonationNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireUser checks that a user is not anonymous, whatever their token is scoped to.
+func (app *application) requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuthenticatedUser checks that a user is not anonymous and is activated, and
+// that their token isn't scoped to an organization: such a token is given to act within
+// the organization, so it is only accepted by the routes of requireOrgPermission. Users
+// are deactivated when their identity provider disables them, which must keep them out
+// even if they still hold a token.
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetTokenOrgID(r) != 0 {
+			app.orgScopedTokenResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireUser(app.requireActivation(fn))
+}
+
+// requireActivation checks that the user is activated, it must run after requireUser.
+func (app *application) requireActivation(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requirePermission checks that the activated user has been granted a permission code.
+// Admin permissions are never available through an impersonation token, even when the
+// impersonated user has them, nor through a token scoped to an organization.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetImpersonatorID(r) != 0 {
+			app.impersonationNotAllowedResponse(w, r)
+			return
+		}
+
+		user := app.contextGetUser(r)
+
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// resolveOrganization works out which organization the request is made in. It is
+// named by its slug in the X-Organization header or, when a base domain is
+// configured, by the subdomain (acme.auth.example.com). A token scoped to an
+// organization can only be used within that organization, and implies it when the
+// request doesn't name one. It must run after authenticate.
+func (app *application) resolveOrganization(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "X-Organization")
+
+		user := app.contextGetUser(r)
+		tokenOrgID := app.contextGetTokenOrgID(r)
+
+		var org *data.Organization
+		var err error
+
+		slug := app.organizationSlug(r)
+		switch {
+		case slug != "":
+			org, err = app.models.Organizations.GetBySlug(slug)
+		case tokenOrgID != 0:
+			org, err = app.models.Organizations.Get(tokenOrgID)
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if tokenOrgID != 0 && tokenOrgID != org.ID {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		var membership *data.Membership
+		if !user.IsAnonymous() {
+			membership, err = app.models.Organizations.GetMembership(org.ID, user.ID)
+			if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		r = app.contextSetOrganization(r, org, membership)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// organizationSlug returns the organization named by the request, or "".
+func (app *application) organizationSlug(r *http.Request) string {
+	if slug := r.Header.Get("X-Organization"); slug != "" {
+		return strings.ToLower(slug)
+	}
+
+	base := app.config.orgBaseDomain
+	if base == "" {
+		return ""
+	}
+
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if !strings.HasSuffix(host, "."+base) {
+		return ""
+	}
+
+	sub := strings.TrimSuffix(host, "."+base)
+	if strings.Contains(sub, ".") {
+		return ""
+	}
+
+	return sub
+}
+
+// requireOrgPermission checks that the request is made in an organization, and that
+// the role of the activated user within it comes with the permission code. These are
+// the routes which accept a token scoped to the organization, resolveOrganization
+// having checked that it is the one the request is made in.
+func (app *application) requireOrgPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetOrganization(r) == nil {
+			app.organizationRequiredResponse(w, r)
+			return
+		}
+
+		membership := app.contextGetMembership(r)
+		if membership == nil || !membership.Permissions().Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireUser(app.requireActivation(fn))
+}
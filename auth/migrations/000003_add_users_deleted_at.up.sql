@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+-- the purge job looks up accounts whose grace period is over, so index the column
+-- for the (few) rows which are actually soft-deleted.
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,18 @@
+-- permissions are codes such as "audit:read", and the users_permissions joining table
+-- records which user has been granted which code (a many-to-many relationship).
+CREATE TABLE IF NOT EXISTS permissions (
+    id bigserial PRIMARY KEY,
+    code text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+    ('audit:read'),
+    ('permissions:write')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,38 @@
+-- audit_events is an append-only log of security relevant actions. actor_id and
+-- target_id are deliberately not foreign keys, the events must outlive the users
+-- they talk about.
+
+-- every row carries hash = SHA-256(prev_hash || row), where prev_hash is the hash of
+-- the row before it. Removing or editing a row breaks the chain from that point on,
+-- which the verify-chain command detects.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL,
+    event text NOT NULL,
+    actor_id bigint,
+    target_id bigint,
+    ip text NOT NULL,
+    user_agent text NOT NULL,
+    request_id text NOT NULL,
+    metadata jsonb NOT NULL DEFAULT '{}',
+    prev_hash bytea,
+    hash bytea NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS audit_events_target_id_idx ON audit_events (target_id);
+
+-- reject any change to existing rows, the application only ever inserts.
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_no_update_delete
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
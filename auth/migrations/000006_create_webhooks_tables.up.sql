@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    event text NOT NULL,
+    url text NOT NULL,
+    secret text NOT NULL, -- used to sign the payloads, so it can't be hashed like the tokens
+    active bool NOT NULL DEFAULT true
+);
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_event_idx ON webhook_subscriptions (event) WHERE active;
+
+-- one row per event per subscription. status is 'pending' until the receiver answers
+-- with a 2xx, or until we give up after too many attempts ('failed').
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    subscription_id bigint NOT NULL REFERENCES webhook_subscriptions ON DELETE CASCADE,
+    event text NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    response_code integer,
+    last_error text
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- the delivery log, every attempt and how the receiver responded to it.
+CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+    id bigserial PRIMARY KEY,
+    delivery_id bigint NOT NULL REFERENCES webhook_deliveries ON DELETE CASCADE,
+    attempted_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    response_code integer,
+    error text,
+    duration_ms integer NOT NULL
+);
+
+INSERT INTO permissions (code)
+VALUES ('webhooks:write')
+ON CONFLICT DO NOTHING;
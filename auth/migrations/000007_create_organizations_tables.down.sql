@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code = 'orgs:write';
+ALTER TABLE tokens DROP COLUMN IF EXISTS org_id;
+DROP TABLE IF EXISTS invitations;
+DROP TABLE IF EXISTS memberships;
+DROP TABLE IF EXISTS organizations;
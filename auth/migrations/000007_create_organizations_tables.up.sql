@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS organizations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    slug citext UNIQUE NOT NULL, -- used in the X-Organization header and as the subdomain
+    version integer NOT NULL DEFAULT 1
+);
+
+-- role is one of owner, admin or member, the permissions of each role are defined in
+-- the application (data.RolePermissions).
+CREATE TABLE IF NOT EXISTS memberships (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    org_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+    role text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, org_id)
+);
+
+CREATE INDEX IF NOT EXISTS memberships_org_id_idx ON memberships (org_id);
+
+-- the invited person may not have an account yet, so invitations are addressed to an
+-- email and carry their own token instead of using the tokens table.
+CREATE TABLE IF NOT EXISTS invitations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    org_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+    email citext NOT NULL,
+    role text NOT NULL,
+    hash bytea UNIQUE NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL,
+    invited_by bigint REFERENCES users ON DELETE SET NULL,
+    accepted_at timestamp(0) with time zone
+);
+
+-- authentication tokens can be scoped to a single organization.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS org_id bigint REFERENCES organizations ON DELETE CASCADE;
+
+INSERT INTO permissions (code)
+VALUES ('orgs:write')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'users:impersonate';
+ALTER TABLE tokens DROP COLUMN IF EXISTS impersonator_id;
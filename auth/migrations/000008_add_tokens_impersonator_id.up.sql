@@ -0,0 +1,7 @@
+-- impersonator_id is set on the authentication tokens which an admin was issued to act
+-- as the user, it holds the ID of that admin.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS impersonator_id bigint REFERENCES users ON DELETE CASCADE;
+
+INSERT INTO permissions (code)
+VALUES ('users:impersonate')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,8 @@
+-- each identity provider pushing users over SCIM gets its own bearer secret, only its
+-- SHA-256 hash is stored.
+CREATE TABLE IF NOT EXISTS scim_clients (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text UNIQUE NOT NULL,
+    secret_hash bytea UNIQUE NOT NULL
+);
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'metrics:read';
+DROP INDEX IF EXISTS tokens_expiry_idx;
@@ -0,0 +1,7 @@
+-- the expired token sweeper looks tokens up by their expiry, this index keeps each
+-- batch from scanning the whole table.
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
+
+INSERT INTO permissions (code)
+VALUES ('metrics:read')
+ON CONFLICT DO NOTHING;
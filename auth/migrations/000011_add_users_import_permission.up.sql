@@ -0,0 +1,3 @@
+INSERT INTO permissions (code)
+VALUES ('users:import')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+INSERT INTO permissions (code)
+VALUES ('users:export')
+ON CONFLICT DO NOTHING;
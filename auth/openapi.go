@@ -0,0 +1,597 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/islamghany/go-workshop/jsonio"
+	"github.com/islamghany/go-workshop/negotiate"
+	"github.com/julienschmidt/httprouter"
+)
+
+/*
+OpenAPI
+
+-Every route is registered along with an operation describing it: the input struct its handler
+ decodes the body into, samples of the responses it writes, the errors it can answer with and
+ who may call it.
+-The OpenAPI 3.1 document is generated from these at the first request to GET /openapi.json.
+ The schemas come from the Go types by reflection, using their json tags and the validate tags
+ of the validator package, and the named structs become components.
+-The errors which follow from the access rules (401 and 403, 400 for a missing organization),
+ the 400 and 415 of an invalid body and the 406 of a response which can't be sent as the client
+ asks are added to the operations, along with the 500 every route can answer with, so only the
+ errors particular to a handler need to be listed.
+-Bodies and responses are documented in every format of the negotiate package but CSV, which
+ only fits some lists; the streamed responses are JSON arrays or NDJSON. The body of a route
+ which takes patches is documented as a JSON Merge Patch and a JSON Patch too.
+-GET /docs serves Swagger UI on the document. Its dist is vendored in docs/swagger-ui and
+ embedded in the binary, docs/swagger-initializer.js points it at /openapi.json.
+-A route registered without its operation is left out of the document, which fails
+ TestOpenAPIDocumentsEveryRoute.
+*/
+
+//go:embed docs
+var docsFS embed.FS
+
+// access is who may call a route, it matches the middleware wrapping the handler.
+type access int
+
+const (
+	public access = iota
+	authenticated
+	permitted
+	orgPermitted
+)
+
+// parameter is a query string or header parameter of an operation. Type is a JSON
+// schema type, string when empty.
+type parameter struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+}
+
+// jsonPatchSchema describes a JSON Patch (RFC 6902), a list of operations applied in
+// turn to the resource.
+var jsonPatchSchema = map[string]interface{}{
+	"type": "array",
+	"items": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"op", "path"},
+		"properties": map[string]interface{}{
+			"op":    map[string]interface{}{"enum": []string{"add", "remove", "replace", "move", "copy", "test"}},
+			"path":  map[string]interface{}{"type": "string", "description": "A JSON pointer."},
+			"from":  map[string]interface{}{"type": "string", "description": "A JSON pointer, for move and copy."},
+			"value": map[string]interface{}{"description": "For add, replace and test."},
+		},
+	},
+}
+
+// rawBody is the media type of a response whose body isn't JSON.
+type rawBody string
+
+// streamed is the sample of a response streamed as a JSON array or as NDJSON, a slice
+// of the items, such as []userRecord{}. Such responses aren't negotiated.
+type streamed struct {
+	items interface{}
+}
+
+// responses maps a status code to a sample of the response body, such as
+// envelope{"user": data.User{}}. The types of the sample values are documented, not
+// the values themselves. A nil sample is a response without a body.
+type responses map[int]interface{}
+
+type operation struct {
+	Summary     string
+	Description string
+	Access      access
+	Permission  string
+	Path        []parameter
+	Query       []parameter
+	Headers     []parameter
+	Body        interface{}
+	Patch       bool
+	Responses   responses
+	Errors      []int
+}
+
+type route struct {
+	method, path string
+	op           *operation
+}
+
+// Doc attaches the operation documenting the route.
+func (rt *route) Doc(op operation) {
+	rt.op = &op
+}
+
+// apiRouter is an httprouter.Router which remembers its routes, so that they can be
+// documented.
+type apiRouter struct {
+	*httprouter.Router
+	routes []*route
+
+	once    sync.Once
+	spec    []byte
+	specErr error
+}
+
+func newAPIRouter() *apiRouter {
+	return &apiRouter{Router: httprouter.New()}
+}
+
+func (ar *apiRouter) HandlerFunc(method, path string, handler http.HandlerFunc) *route {
+	ar.Router.HandlerFunc(method, path, handler)
+
+	rt := &route{method: method, path: path}
+	ar.routes = append(ar.routes, rt)
+	return rt
+}
+
+// openAPIHandler serves the OpenAPI document of the routes of ar.
+func (app *application) openAPIHandler(ar *apiRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ar.once.Do(func() {
+			ar.spec, ar.specErr = json.MarshalIndent(ar.openAPI(), "", "\t")
+		})
+		if ar.specErr != nil {
+			app.serverErrorResponse(w, r, ar.specErr)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ar.spec)
+	}
+}
+
+// docsHandler serves the documentation viewer.
+func (app *application) docsHandler() http.Handler {
+	sub, err := fs.Sub(docsFS, "docs")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/docs", http.FileServer(http.FS(sub)))
+}
+
+// openAPIPath converts an httprouter path to an OpenAPI one, "/users/:id" to
+// "/users/{id}", and returns the names of its parameters.
+func openAPIPath(path string) (string, []string) {
+	var names []string
+
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			names = append(names, s[1:])
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), names
+}
+
+func (ar *apiRouter) openAPI() map[string]interface{} {
+	g := &schemaGenerator{components: map[string]interface{}{}}
+	errorResponses := map[string]interface{}{}
+
+	paths := map[string]map[string]interface{}{}
+	for _, rt := range ar.routes {
+		if rt.op == nil {
+			continue
+		}
+
+		path, names := openAPIPath(rt.path)
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(rt.method)] = g.operation(rt, names, errorResponses)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "auth",
+			"version": "1.0.0",
+			"description": "User accounts, authentication tokens, organizations and their administration. " +
+				"The SCIM 2.0 provisioning endpoints under /scim/v2 follow RFC 7644 and aren't described here.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas":   g.components,
+			"responses": errorResponses,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An authentication token from POST /tokens/authentication.",
+				},
+			},
+		},
+	}
+}
+
+func (g *schemaGenerator) operation(rt *route, pathParams []string, errorResponses map[string]interface{}) map[string]interface{} {
+	op := rt.op
+
+	doc := map[string]interface{}{
+		"summary":     op.Summary,
+		"operationId": operationID(rt.method, rt.path),
+		"tags":        []string{operationTag(rt.path)},
+	}
+	if op.Description != "" {
+		doc["description"] = op.Description
+	}
+
+	var params []interface{}
+	for _, name := range pathParams {
+		p := parameter{Name: name, Type: "integer", Required: true}
+		for _, override := range op.Path {
+			if override.Name == name {
+				p = override
+				p.Required = true
+			}
+		}
+		params = append(params, openAPIParameter(p, "path"))
+	}
+	for _, p := range op.Query {
+		params = append(params, openAPIParameter(p, "query"))
+	}
+
+	headers := op.Headers
+	if op.Access == orgPermitted {
+		headers = append(headers, parameter{
+			Name:        "X-Organization",
+			Description: "The slug of the organization the request is made in.",
+			Required:    true,
+		})
+	}
+	for _, p := range headers {
+		params = append(params, openAPIParameter(p, "header"))
+	}
+	if len(params) > 0 {
+		doc["parameters"] = params
+	}
+
+	errors := append([]int(nil), op.Errors...)
+
+	if op.Body != nil {
+		content := map[string]interface{}{}
+		schema := g.schema(reflect.TypeOf(op.Body))
+		for _, mediaType := range negotiate.ReadableTypes() {
+			content[mediaType] = map[string]interface{}{"schema": schema}
+		}
+		if op.Patch {
+			content[jsonio.MergePatch] = map[string]interface{}{"schema": schema}
+			content[jsonio.JSONPatch] = map[string]interface{}{"schema": jsonPatchSchema}
+		}
+		doc["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  content,
+		}
+		errors = append(errors, http.StatusBadRequest, http.StatusUnsupportedMediaType)
+	}
+	for _, sample := range op.Responses {
+		switch sample.(type) {
+		case nil, rawBody, streamed:
+		default:
+			errors = append(errors, http.StatusNotAcceptable)
+		}
+	}
+
+	switch op.Access {
+	case authenticated:
+		errors = append(errors, http.StatusUnauthorized, http.StatusForbidden)
+	case permitted, orgPermitted:
+		errors = append(errors, http.StatusUnauthorized, http.StatusForbidden)
+		doc["x-permission"] = op.Permission
+	}
+	if op.Access == orgPermitted {
+		errors = append(errors, http.StatusBadRequest)
+	}
+	if op.Access != public {
+		doc["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+	}
+	errors = append(errors, http.StatusInternalServerError)
+
+	resps := map[string]interface{}{}
+	for status, sample := range op.Responses {
+		resps[fmt.Sprint(status)] = g.response(status, sample)
+	}
+	for _, status := range errors {
+		name := strings.ReplaceAll(http.StatusText(status), " ", "")
+		errorResponses[name] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content": map[string]interface{}{
+				"application/problem+json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(problem{}))},
+			},
+		}
+		resps[fmt.Sprint(status)] = map[string]interface{}{"$ref": "#/components/responses/" + name}
+	}
+	doc["responses"] = resps
+
+	return doc
+}
+
+func (g *schemaGenerator) response(status int, sample interface{}) map[string]interface{} {
+	resp := map[string]interface{}{"description": http.StatusText(status)}
+
+	switch sample := sample.(type) {
+	case nil:
+	case rawBody:
+		resp["content"] = map[string]interface{}{
+			string(sample): map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+	case streamed:
+		t := reflect.TypeOf(sample.items)
+		resp["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": g.schema(t)},
+			jsonio.NDJSON:      map[string]interface{}{"schema": g.schema(t.Elem())},
+		}
+	default:
+		// The samples are empty, which would make any list fit for CSV: only the
+		// formats which fit any value are documented.
+		content := map[string]interface{}{}
+		schema := g.sample(sample)
+		for _, f := range negotiate.Formats {
+			if f.Fits == nil {
+				content[f.MediaType] = map[string]interface{}{"schema": schema}
+			}
+		}
+		resp["content"] = content
+	}
+	return resp
+}
+
+func openAPIParameter(p parameter, in string) map[string]interface{} {
+	typ := p.Type
+	if typ == "" {
+		typ = "string"
+	}
+
+	doc := map[string]interface{}{
+		"name":     p.Name,
+		"in":       in,
+		"required": p.Required,
+		"schema":   map[string]interface{}{"type": typ},
+	}
+	if p.Description != "" {
+		doc["description"] = p.Description
+	}
+	return doc
+}
+
+// operationID makes an ID such as "postAdminUsersIdPermissions" from a route.
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+
+	for _, s := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '-' || r == ':' || r == '.'
+	}) {
+		b.WriteString(strings.ToUpper(s[:1]) + s[1:])
+	}
+	return b.String()
+}
+
+// operationTag groups the routes by the first segment of their path.
+func operationTag(path string) string {
+	segment := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if segment == "" {
+		return "service"
+	}
+	return segment
+}
+
+// schemaGenerator makes JSON schemas (draft 2020-12, which OpenAPI 3.1 uses) from Go
+// types. Named structs are added to components and referred to.
+type schemaGenerator struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// sample returns the schema of a sample value. Its type is documented, except for
+// envelopes whose keys are documented with the types of their values.
+func (g *schemaGenerator) sample(v interface{}) map[string]interface{} {
+	env, ok := v.(envelope)
+	if !ok {
+		return g.schema(reflect.TypeOf(v))
+	}
+
+	properties := map[string]interface{}{}
+	required := make([]string, 0, len(env))
+	for key, value := range env {
+		properties[key] = g.sample(value)
+		required = append(required, key)
+	}
+	sort.Strings(required)
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := g.components[name]; !ok {
+			// Reserve the name first, the struct may refer to itself.
+			g.components[name] = nil
+			g.components[name] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// object returns the schema of a struct. Its fields are required unless they are
+// pointers or omitted when empty, or their validate tag says they are.
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+
+	g.fields(t, properties, &required)
+	sort.Strings(required)
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+
+		ft := f.Type
+		if f.Anonymous && tag[0] == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, properties, required)
+				continue
+			}
+		}
+
+		name := f.Name
+		if tag[0] != "" {
+			name = tag[0]
+		}
+
+		schema := g.schema(ft)
+		optional := ft.Kind() == reflect.Ptr
+		for _, option := range tag[1:] {
+			switch option {
+			case "omitempty":
+				optional = true
+			case "string":
+				schema = map[string]interface{}{"type": "string"}
+			}
+		}
+
+		rules := strings.Split(f.Tag.Get("validate"), ",")
+		for _, rule := range rules {
+			if rule == "required" {
+				optional = false
+			}
+		}
+		properties[name] = constrain(schema, rules)
+
+		if !optional {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// constrain adds the rules of a validate tag which JSON schema can express to schema,
+// up to a dive.
+func constrain(schema map[string]interface{}, rules []string) map[string]interface{} {
+	if _, ok := schema["$ref"]; ok {
+		return schema
+	}
+
+	for _, rule := range rules {
+		kv := strings.SplitN(rule, "=", 2)
+		name, param := kv[0], ""
+		if len(kv) == 2 {
+			param = kv[1]
+		}
+
+		switch name {
+		case "dive":
+			return schema
+		case "min", "max":
+			setBound(schema, name, json.Number(param))
+		case "len":
+			setBound(schema, "min", json.Number(param))
+			setBound(schema, "max", json.Number(param))
+		case "email":
+			schema["format"] = "email"
+		case "url":
+			schema["format"] = "uri"
+		case "uuid":
+			schema["format"] = "uuid"
+		case "oneof":
+			schema["enum"] = strings.Fields(param)
+		}
+	}
+	return schema
+}
+
+// setBound sets the min or max keyword matching the type of the schema, the bounds of
+// the validator apply to the length of strings and collections.
+func setBound(schema map[string]interface{}, bound string, n json.Number) {
+	var keyword string
+	switch schema["type"] {
+	case "string":
+		keyword = bound + "Length"
+	case "array":
+		keyword = bound + "Items"
+	case "object":
+		keyword = bound + "Properties"
+	default:
+		keyword = map[string]string{"min": "minimum", "max": "maximum"}[bound]
+	}
+	schema[keyword] = n
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	app, _ := newTestApplication(t)
+	router := app.apiRoutes()
+
+	js, err := json.Marshal(router.openAPI())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(js, &spec); err != nil {
+		t.Fatal(err)
+	}
+	paths, _ := spec["paths"].(map[string]interface{})
+
+	documented := 0
+	for _, rt := range router.routes {
+		if rt.op == nil {
+			t.Errorf("%s %s has no operation, document it with Doc", rt.method, rt.path)
+			continue
+		}
+
+		path, _ := openAPIPath(rt.path)
+		item, _ := paths[path].(map[string]interface{})
+		op, ok := item[strings.ToLower(rt.method)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s %s is missing from the document", rt.method, path)
+			continue
+		}
+		documented++
+
+		if op["summary"] == "" {
+			t.Errorf("%s %s has no summary", rt.method, path)
+		}
+		if resps, _ := op["responses"].(map[string]interface{}); len(resps) < 2 {
+			t.Errorf("%s %s documents %d responses; want a success and the errors", rt.method, path, len(resps))
+		}
+	}
+
+	operations := 0
+	for _, item := range paths {
+		operations += len(item.(map[string]interface{}))
+	}
+	if operations != documented {
+		t.Errorf("the document has %d operations; want the %d routes", operations, documented)
+	}
+
+	checkRefs(t, spec, spec)
+}
+
+// checkRefs fails the test for every $ref in node which doesn't resolve in spec.
+func checkRefs(t *testing.T, spec map[string]interface{}, node interface{}) {
+	t.Helper()
+
+	switch node := node.(type) {
+	case map[string]interface{}:
+		if ref, ok := node["$ref"].(string); ok {
+			var target interface{} = spec
+			for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+				m, _ := target.(map[string]interface{})
+				target = m[key]
+			}
+			if target == nil {
+				t.Errorf("%s doesn't resolve", ref)
+			}
+		}
+		for _, child := range node {
+			checkRefs(t, spec, child)
+		}
+	case []interface{}:
+		for _, child := range node {
+			checkRefs(t, spec, child)
+		}
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	status, spec := do(t, app, http.MethodGet, "/openapi.json", "")
+	if status != http.StatusOK || spec["openapi"] != "3.1.0" {
+		t.Fatalf("got status %d and openapi %v; want 200 and 3.1.0", status, spec["openapi"])
+	}
+
+	components := spec["components"].(map[string]interface{})
+	user := components["schemas"].(map[string]interface{})["User"].(map[string]interface{})
+	properties := user["properties"].(map[string]interface{})
+
+	if _, ok := properties["password"]; ok {
+		t.Error("the User schema has the password, which isn't encoded")
+	}
+	if got := properties["name"].(map[string]interface{})["maxLength"]; got != 500.0 {
+		t.Errorf("got name maxLength %v; want 500 from the validate tag", got)
+	}
+	if got := properties["email"].(map[string]interface{})["format"]; got != "email" {
+		t.Errorf("got email format %v; want email", got)
+	}
+	if got := properties["created_at"].(map[string]interface{})["format"]; got != "date-time" {
+		t.Errorf("got created_at format %v; want date-time", got)
+	}
+
+	paths := spec["paths"].(map[string]interface{})
+	op := paths["/org/members/{id}"].(map[string]interface{})["put"].(map[string]interface{})
+	if op["x-permission"] != "org:members:write" {
+		t.Errorf("got x-permission %v; want org:members:write", op["x-permission"])
+	}
+	for _, status := range []string{"200", "400", "401", "403", "404", "409", "422", "500"} {
+		if _, ok := op["responses"].(map[string]interface{})[status]; !ok {
+			t.Errorf("PUT /org/members/{id} doesn't document a %s response", status)
+		}
+	}
+
+	// The viewer is Swagger UI, pointed at the document.
+	for path, want := range map[string]string{
+		"/docs/":                                "swagger-ui-bundle.js",
+		"/docs/swagger-initializer.js":          "openapi.json",
+		"/docs/swagger-ui/swagger-ui.css":       ".swagger-ui",
+		"/docs/swagger-ui/swagger-ui-bundle.js": "SwaggerUIBundle",
+	} {
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("GET %s: got status %d; want the viewer", path, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+)
+
+/*
+Organizations
+
+-Every customer is an organization, users belong to organizations through a membership with
+ a role (owner, admin or member). The permissions of each role are in data.RolePermissions.
+-Requests name their organization with the X-Organization header or the subdomain, see
+ resolveOrganization. Routes which need one are wrapped in requireOrgPermission.
+-An authentication token can be scoped to an organization at login, it is then rejected in
+ any other organization.
+-Members are added by invitation: an email with a token which the invited user accepts once
+ they have an account with that email.
+-Admins with the orgs:write permission create organizations, everything else is managed by
+ the owners and admins of the organization itself.
+*/
+
+const invitationTTL = 7 * 24 * time.Hour
+
+// createOrganizationInput is the request body of createOrganizationHandler.
+type createOrganizationInput struct {
+	Name       string `json:"name"`
+	Slug       string `json:"slug"`
+	OwnerEmail string `json:"owner_email"`
+}
+
+// createOrganizationHandler creates an organization, the user with owner_email becomes
+// its first owner.
+func (app *application) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input createOrganizationInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	org := &data.Organization{
+		Name: input.Name,
+		Slug: strings.ToLower(input.Slug),
+	}
+
+	v := validator.New()
+
+	data.ValidateOrganization(v, org)
+	data.ValidateEmail(v, input.OwnerEmail)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	owner, err := app.models.Users.GetByEmail(r.Context(), input.OwnerEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("owner_email", "unknown_email")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Organizations.Insert(org, owner.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateSlug):
+			v.AddError("slug", "taken")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.EventOrgCreated, app.contextGetUser(r).ID, owner.ID, map[string]string{"organization": org.Slug})
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"organization": org}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	var filters data.Filters
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	orgs, metadata, err := app.models.Organizations.GetAll(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"organizations": orgs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentOrganizationHandler returns the current organization along with the role
+// of the user in it.
+func (app *application) showCurrentOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	org := app.contextGetOrganization(r)
+	membership := app.contextGetMembership(r)
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"organization": org, "role": membership.Role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listMembershipsHandler returns the organizations the authenticated user belongs to.
+func (app *application) listMembershipsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	memberships, err := app.models.Organizations.GetAllMembershipsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"memberships": memberships}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listMembersHandler(w http.ResponseWriter, r *http.Request) {
+	org := app.contextGetOrganization(r)
+
+	members, err := app.models.Organizations.GetMembers(org.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"members": members}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createInvitationInput is the request body of createInvitationHandler.
+type createInvitationInput struct {
+	Email string `json:"email"`
+	Role  string `json:"role,omitempty"`
+}
+
+// createInvitationHandler emails an invitation to join the current organization. Only
+// owners can invite other owners.
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input createInvitationInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Role == "" {
+		input.Role = data.RoleMember
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidateRole(v, input.Role)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	org := app.contextGetOrganization(r)
+	membership := app.contextGetMembership(r)
+
+	if input.Role == data.RoleOwner && membership.Role != data.RoleOwner {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	invitation, err := app.models.Organizations.NewInvitation(org.ID, membership.UserID, input.Email, input.Role, invitationTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.EventMemberInvited, membership.UserID, 0, map[string]string{
+		"organization": org.Slug,
+		"email":        invitation.Email,
+		"role":         invitation.Role,
+	})
+
+	app.background(func() {
+		sender := "auth@example.com"
+		subject := fmt.Sprintf("You have been invited to join %s", org.Name)
+		body := `
+		<h4>you have been invited to join %s as %s, to accept the invitation sign in and use this token</h4>
+		<p>%s</p>
+		<p>the invitation expires on %s</p>
+		`
+
+		_, _, err := app.sendEmail(sender, subject, fmt.Sprintf(body, org.Name, invitation.Role, invitation.Plaintext, invitation.Expiry.Format(time.RFC1123)), invitation.Email)
+
+		if err != nil {
+			log.Println(err)
+		}
+	})
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// acceptInvitationInput is the request body of acceptInvitationHandler.
+type acceptInvitationInput struct {
+	Token string `json:"token"`
+}
+
+// acceptInvitationHandler makes the authenticated user a member of the organization
+// they were invited to. The invitation must have been sent to their email address.
+func (app *application) acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input acceptInvitationInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	invitation, err := app.models.Organizations.GetInvitationForToken(input.Token)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err != nil || !strings.EqualFold(invitation.Email, user.Email) {
+		v.AddError("token", "invalid_invitation")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	membership, err := app.models.Organizations.AcceptInvitation(invitation, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddError("token", "invalid_invitation")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.EventMemberJoined, user.ID, user.ID, map[string]string{
+		"organization_id": strconv.FormatInt(membership.OrganizationID, 10),
+		"role":            membership.Role,
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"membership": membership}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateMemberInput is the request body of updateMemberHandler.
+type updateMemberInput struct {
+	Role string `json:"role"`
+}
+
+// updateMemberHandler changes the role of a member of the current organization.
+func (app *application) updateMemberHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := app.readMember(w, r)
+	if !ok {
+		return
+	}
+
+	var input updateMemberInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateRole(v, input.Role); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	if !app.canManageMember(w, r, target, input.Role) {
+		return
+	}
+
+	oldRole := target.Role
+	target.Role = input.Role
+
+	err = app.models.Organizations.UpdateMemberRole(target)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastOwner):
+			app.lastOwnerResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.EventMemberRoleChanged, app.contextGetUser(r).ID, target.UserID, map[string]string{
+		"organization": app.contextGetOrganization(r).Slug,
+		"old_role":     oldRole,
+		"role":         target.Role,
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"membership": target}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeMemberHandler removes a member from the current organization, revoking the
+// tokens they hold for it.
+func (app *application) removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := app.readMember(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.canManageMember(w, r, target, "") {
+		return
+	}
+
+	err := app.models.Organizations.RemoveMember(target.OrganizationID, target.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastOwner):
+			app.lastOwnerResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.EventMemberRemoved, app.contextGetUser(r).ID, target.UserID, map[string]string{
+		"organization": app.contextGetOrganization(r).Slug,
+		"role":         target.Role,
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "member successfully removed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readMember loads the membership of the user named by the :id parameter in the
+// current organization, and sends a 404 when there is none.
+func (app *application) readMember(w http.ResponseWriter, r *http.Request) (*data.Membership, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	membership, err := app.models.Organizations.GetMembership(app.contextGetOrganization(r).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return membership, true
+}
+
+// canManageMember checks that the current user may change the target membership to
+// newRole, or remove it when newRole is empty. Only owners can touch owners or make
+// new ones. That the last owner isn't demoted or removed, so that the organization is
+// never left without one, is checked by the model along with the update.
+func (app *application) canManageMember(w http.ResponseWriter, r *http.Request, target *data.Membership, newRole string) bool {
+	current := app.contextGetMembership(r)
+
+	if (target.Role == data.RoleOwner || newRole == data.RoleOwner) && current.Role != data.RoleOwner {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/passcheck"
+)
+
+// reloadBreachedPasswords picks up a new version of the breached password corpus, so
+// it can be updated without a deploy: drop the new file in place (with a rename) and
+// it is used within a minute.
+func (app *application) reloadBreachedPasswords(corpus *passcheck.Corpus) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reloaded, err := corpus.ReloadIfChanged()
+		if err != nil {
+			log.Println("reloading breached password corpus:", err)
+			continue
+		}
+		if reloaded {
+			log.Println("breached password corpus reloaded:", corpus)
+		}
+	}
+}
+
+// buildBreachCorpusCommand implements "auth build-breach-corpus [-prefix n] <input>
+// <output>". The input is a sorted list of SHA-1 hashes such as the Have I Been Pwned
+// download. The output is written next to its final name and renamed over it, so a
+// running server never sees a partial file.
+func (app *application) buildBreachCorpusCommand(args []string) error {
+	fs := flag.NewFlagSet("build-breach-corpus", flag.ContinueOnError)
+	prefix := fs.Int("prefix", 8, "the number of bytes of each SHA-1 hash to keep")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: build-breach-corpus [-prefix n] <input> <output>")
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	output := fs.Arg(1)
+	out, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	n, err := passcheck.BuildCorpus(in, out, *prefix)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(out.Name(), output)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("wrote %d hashes to %s", n, output)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// purgeDeletedUsers periodically hard-deletes the accounts whose deletion grace period
+// is over, until ctx is done.
+func (app *application) purgeDeletedUsers(ctx context.Context) {
+	ticker := time.NewTicker(app.config.deletion.purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			app.purgeOnce(ctx)
+		}
+	}
+}
+
+func (app *application) purgeOnce(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	n, err := app.models.Users.PurgeDeleted(ctx, app.config.deletion.gracePeriod)
+	if err != nil {
+		log.Println("purging deleted users:", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("purged %d deleted users", n)
+	}
+}
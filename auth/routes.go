@@ -3,14 +3,296 @@ package main
 import (
 	"net/http"
 
-	"github.com/julienschmidt/httprouter"
+	"github.com/islamghany/go-workshop/auth/internals/data"
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	router := app.apiRoutes()
 
-	router.HandlerFunc(http.MethodPost, "/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodGet, "/", app.hello)
+	// The SCIM endpoints authenticate provisioning clients with their own secrets, so
+	// they are kept out of the user authentication middleware.
+	mux := http.NewServeMux()
+	mux.Handle("/scim/v2/", app.scimHandler())
+	mux.Handle("/", app.authenticate(app.resolveOrganization(router)))
+
+	return app.requestID(mux)
+}
+
+// pagination are the query parameters of the paginated lists.
+var pagination = []parameter{
+	{Name: "page", Type: "integer", Description: "The page to return, from 1."},
+	{Name: "page_size", Type: "integer", Description: "The number of records per page, up to 100."},
+}
+
+// apiRoutes registers the routes of the API along with their documentation, see
+// openapi.go.
+func (app *application) apiRoutes() *apiRouter {
+	router := newAPIRouter()
+
+	router.HandlerFunc(http.MethodPost, "/users", app.validateBody("register_user.json", app.registerUserHandler)).Doc(operation{
+		Summary:   "Register a user",
+		Body:      registerUserInput{},
+		Responses: responses{http.StatusCreated: envelope{"user": data.User{}}},
+		Errors:    []int{http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodGet, "/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler)).Doc(operation{
+		Summary:   "Show the current user",
+		Access:    authenticated,
+		Responses: responses{http.StatusOK: envelope{"user": data.User{}}},
+	})
+	router.HandlerFunc(http.MethodPatch, "/users/me", app.requireAuthenticatedUser(app.validateBody("update_current_user.json", app.updateCurrentUserHandler))).Doc(operation{
+		Summary:     "Update the current user",
+		Description: "Changing the email address or the password requires the current password, and isn't possible while impersonating. The body may also be a JSON Merge Patch or a JSON Patch of the name and email, a patch which doesn't apply gets a 409 and one which sets either to null a 422.",
+		Access:      authenticated,
+		Headers: []parameter{
+			{Name: "If-Match", Description: "The ETag of the user, as returned by GET /users/me."},
+			{Name: "X-Expected-Version", Type: "integer", Description: "The version of the user, when If-Match isn't sent."},
+		},
+		Body:      updateCurrentUserInput{},
+		Patch:     true,
+		Responses: responses{http.StatusOK: envelope{"user": data.User{}}},
+		Errors:    []int{http.StatusForbidden, http.StatusConflict, http.StatusUnprocessableEntity, http.StatusPreconditionRequired},
+	})
+	router.HandlerFunc(http.MethodDelete, "/users/me", app.requireAuthenticatedUser(app.denyImpersonation(app.deleteCurrentUserHandler))).Doc(operation{
+		Summary:     "Delete the current user",
+		Description: "The account is scheduled for deletion and can be restored with the token emailed to the user.",
+		Access:      authenticated,
+		Responses:   responses{http.StatusAccepted: envelope{"message": ""}},
+		Errors:      []int{http.StatusForbidden, http.StatusConflict},
+	})
+	router.HandlerFunc(http.MethodPost, "/users/me/export", app.requireAuthenticatedUser(app.denyImpersonation(app.exportCurrentUserHandler))).Doc(operation{
+		Summary:     "Export the data of the current user",
+		Description: "The export is prepared in the background and a download link is emailed to the user.",
+		Access:      authenticated,
+		Responses:   responses{http.StatusAccepted: envelope{"message": ""}},
+		Errors:      []int{http.StatusForbidden},
+	})
+	router.HandlerFunc(http.MethodGet, "/exports/:id", app.downloadExportHandler).Doc(operation{
+		Summary: "Download a data export",
+		Path:    []parameter{{Name: "id", Description: "The ID of the export, from the emailed link."}},
+		Query: []parameter{
+			{Name: "expires", Type: "integer", Description: "The expiry of the link, from the emailed link.", Required: true},
+			{Name: "signature", Description: "The signature of the link, from the emailed link.", Required: true},
+		},
+		Responses: responses{http.StatusOK: rawBody("application/zip")},
+		Errors:    []int{http.StatusNotFound},
+	})
+	router.HandlerFunc(http.MethodPut, "/users/deletion/cancel", app.validateBody("cancel_user_deletion.json", app.cancelUserDeletionHandler)).Doc(operation{
+		Summary:   "Cancel the deletion of an account",
+		Body:      cancelUserDeletionInput{},
+		Responses: responses{http.StatusOK: envelope{"user": data.User{}}},
+		Errors:    []int{http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodPost, "/tokens/authentication", app.validateBody("create_authentication_token.json", app.createAuthenticationTokenHandler)).Doc(operation{
+		Summary:     "Create an authentication token",
+		Description: "The token is scoped to the organization named by its slug, when one is given.",
+		Body:        createAuthenticationTokenInput{},
+		Responses:   responses{http.StatusCreated: envelope{"authentication_token": data.Token{}}},
+		Errors:      []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodPut, "/users/activated", app.validateBody("activate_user.json", app.activateUserHandler)).Doc(operation{
+		Summary:   "Activate a user",
+		Body:      activateUserInput{},
+		Responses: responses{http.StatusOK: envelope{"user": data.User{}}},
+		Errors:    []int{http.StatusConflict, http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodPut, "/users/setup", app.validateBody("setup_account.json", app.setupAccountHandler)).Doc(operation{
+		Summary:     "Set up an imported account",
+		Description: "Sets the password of a user created by an import, which also activates them.",
+		Body:        setupAccountInput{},
+		Responses:   responses{http.StatusOK: envelope{"user": data.User{}}},
+		Errors:      []int{http.StatusConflict, http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodGet, "/", app.hello).Doc(operation{
+		Summary:   "Say hello",
+		Responses: responses{http.StatusOK: rawBody("text/plain")},
+	})
+
+	router.HandlerFunc(http.MethodGet, "/admin/audit-events", app.requirePermission(data.PermissionAuditRead, app.listAuditEventsHandler)).Doc(operation{
+		Summary:    "List the audit events",
+		Access:     permitted,
+		Permission: data.PermissionAuditRead,
+		Query: append([]parameter{
+			{Name: "actor_id", Type: "integer", Description: "Only the events of this actor."},
+			{Name: "target_id", Type: "integer", Description: "Only the events about this user."},
+			{Name: "event", Description: "Only the events of this type."},
+		}, pagination...),
+		Responses: responses{http.StatusOK: envelope{"audit_events": []data.AuditEvent{}, "metadata": data.Metadata{}}},
+		Errors:    []int{http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodPost, "/admin/users/:id/permissions", app.requirePermission(data.PermissionPermissionsWrite, app.validateBody("grant_permissions.json", app.grantPermissionsHandler))).Doc(operation{
+		Summary:    "Grant permissions to a user",
+		Access:     permitted,
+		Permission: data.PermissionPermissionsWrite,
+		Body:       grantPermissionsInput{},
+		Responses:  responses{http.StatusOK: envelope{"permissions": data.Permissions{}}},
+		Errors:     []int{http.StatusNotFound, http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodPost, "/admin/users/:id/impersonate", app.requirePermission(data.PermissionUsersImpersonate, app.impersonateUserHandler)).Doc(operation{
+		Summary:     "Impersonate a user",
+		Description: "Issues a short lived token acting as the user, which can't reach the sensitive actions.",
+		Access:      permitted,
+		Permission:  data.PermissionUsersImpersonate,
+		Responses:   responses{http.StatusCreated: envelope{"authentication_token": data.Token{}, "user": data.User{}}},
+		Errors:      []int{http.StatusNotFound, http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodPost, "/admin/user-imports", app.requirePermission(data.PermissionUsersImport, app.importUsersHandler)).Doc(operation{
+		Summary: "Import users",
+		Description: "The users are streamed as NDJSON (application/x-ndjson) or a JSON array, up to 100,000 of them. " +
+			"The rows which can't be imported are listed with their index and line, the others are imported regardless. " +
+			"A batch which can't be inserted stops the import with a 500 holding the report so far and the failed range, " +
+			"and a body which can't be read any further with a 400 holding the report and where it stopped, the rows before it imported.",
+		Access:     permitted,
+		Permission: data.PermissionUsersImport,
+		Query:      []parameter{{Name: "invite", Type: "boolean", Description: "Email an account setup link to the users without a password_hash."}},
+		Body:       []userRecord{},
+		Responses:  responses{http.StatusOK: envelope{"imported": 0, "rejected": []importRejection{}}},
+		Errors:     []int{http.StatusUnsupportedMediaType},
+	})
+	router.HandlerFunc(http.MethodGet, "/admin/user-exports", app.requirePermission(data.PermissionUsersExport, app.exportUsersHandler)).Doc(operation{
+		Summary: "Export users",
+		Description: "Every user is streamed as a JSON array, or as NDJSON when the Accept header prefers application/x-ndjson, " +
+			"in the format POST /admin/user-imports takes, without the password hashes. An export which fails halfway reports the error " +
+			"in the Stream-Error trailer, and one which ends well the number of users in the Stream-Count trailer.",
+		Access:     permitted,
+		Permission: data.PermissionUsersExport,
+		Responses:  responses{http.StatusOK: streamed{[]userRecord{}}},
+	})
+	router.HandlerFunc(http.MethodGet, "/admin/metrics", app.requirePermission(data.PermissionMetricsRead, app.showMetricsHandler)).Doc(operation{
+		Summary:    "Show the metrics of the background jobs",
+		Access:     permitted,
+		Permission: data.PermissionMetricsRead,
+		Responses:  responses{http.StatusOK: envelope{"token_sweeper": map[string]float64{}}},
+	})
+
+	router.HandlerFunc(http.MethodPost, "/admin/webhooks", app.requirePermission(data.PermissionWebhooksWrite, app.validateBody("create_webhook_subscription.json", app.createWebhookSubscriptionHandler))).Doc(operation{
+		Summary:    "Subscribe a URL to an event",
+		Access:     permitted,
+		Permission: data.PermissionWebhooksWrite,
+		Body:       createWebhookSubscriptionInput{},
+		Responses:  responses{http.StatusCreated: envelope{"webhook": data.WebhookSubscription{}}},
+		Errors:     []int{http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodGet, "/admin/webhooks", app.requirePermission(data.PermissionWebhooksWrite, app.listWebhookSubscriptionsHandler)).Doc(operation{
+		Summary:    "List the webhook subscriptions",
+		Access:     permitted,
+		Permission: data.PermissionWebhooksWrite,
+		Responses:  responses{http.StatusOK: envelope{"webhooks": []data.WebhookSubscription{}}},
+	})
+	router.HandlerFunc(http.MethodDelete, "/admin/webhooks/:id", app.requirePermission(data.PermissionWebhooksWrite, app.deleteWebhookSubscriptionHandler)).Doc(operation{
+		Summary:    "Delete a webhook subscription",
+		Access:     permitted,
+		Permission: data.PermissionWebhooksWrite,
+		Responses:  responses{http.StatusOK: envelope{"message": ""}},
+		Errors:     []int{http.StatusNotFound},
+	})
+	router.HandlerFunc(http.MethodGet, "/admin/webhooks/:id/deliveries", app.requirePermission(data.PermissionWebhooksWrite, app.listWebhookDeliveriesHandler)).Doc(operation{
+		Summary:    "List the deliveries of a webhook subscription",
+		Access:     permitted,
+		Permission: data.PermissionWebhooksWrite,
+		Query:      pagination,
+		Responses:  responses{http.StatusOK: envelope{"deliveries": []data.WebhookDelivery{}, "metadata": data.Metadata{}}},
+		Errors:     []int{http.StatusNotFound, http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodGet, "/admin/webhook-deliveries/:id/attempts", app.requirePermission(data.PermissionWebhooksWrite, app.listWebhookAttemptsHandler)).Doc(operation{
+		Summary:    "List the attempts of a webhook delivery",
+		Access:     permitted,
+		Permission: data.PermissionWebhooksWrite,
+		Responses:  responses{http.StatusOK: envelope{"attempts": []data.WebhookAttempt{}}},
+		Errors:     []int{http.StatusNotFound},
+	})
+	router.HandlerFunc(http.MethodPost, "/admin/webhook-deliveries/:id/redeliver", app.requirePermission(data.PermissionWebhooksWrite, app.redeliverWebhookHandler)).Doc(operation{
+		Summary:    "Deliver a webhook again",
+		Access:     permitted,
+		Permission: data.PermissionWebhooksWrite,
+		Responses:  responses{http.StatusAccepted: envelope{"delivery": data.WebhookDelivery{}}},
+		Errors:     []int{http.StatusNotFound},
+	})
+
+	router.HandlerFunc(http.MethodPost, "/admin/orgs", app.requirePermission(data.PermissionOrgsWrite, app.validateBody("create_organization.json", app.createOrganizationHandler))).Doc(operation{
+		Summary:    "Create an organization",
+		Access:     permitted,
+		Permission: data.PermissionOrgsWrite,
+		Body:       createOrganizationInput{},
+		Responses:  responses{http.StatusCreated: envelope{"organization": data.Organization{}}},
+		Errors:     []int{http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodGet, "/admin/orgs", app.requirePermission(data.PermissionOrgsWrite, app.listOrganizationsHandler)).Doc(operation{
+		Summary:    "List the organizations",
+		Access:     permitted,
+		Permission: data.PermissionOrgsWrite,
+		Query:      pagination,
+		Responses:  responses{http.StatusOK: envelope{"organizations": []data.Organization{}, "metadata": data.Metadata{}}},
+		Errors:     []int{http.StatusUnprocessableEntity},
+	})
+
+	router.HandlerFunc(http.MethodGet, "/users/me/memberships", app.requireAuthenticatedUser(app.listMembershipsHandler)).Doc(operation{
+		Summary:   "List the organizations of the current user",
+		Access:    authenticated,
+		Responses: responses{http.StatusOK: envelope{"memberships": []data.Membership{}}},
+	})
+	router.HandlerFunc(http.MethodPut, "/invitations/accepted", app.requireAuthenticatedUser(app.denyImpersonation(app.validateBody("accept_invitation.json", app.acceptInvitationHandler)))).Doc(operation{
+		Summary:   "Accept an invitation to an organization",
+		Access:    authenticated,
+		Body:      acceptInvitationInput{},
+		Responses: responses{http.StatusOK: envelope{"membership": data.Membership{}}},
+		Errors:    []int{http.StatusUnprocessableEntity},
+	})
+
+	router.HandlerFunc(http.MethodGet, "/org", app.requireOrgPermission(data.PermissionOrgRead, app.showCurrentOrganizationHandler)).Doc(operation{
+		Summary:    "Show the current organization",
+		Access:     orgPermitted,
+		Permission: data.PermissionOrgRead,
+		Responses:  responses{http.StatusOK: envelope{"organization": data.Organization{}, "role": ""}},
+	})
+	router.HandlerFunc(http.MethodGet, "/org/members", app.requireOrgPermission(data.PermissionOrgMembersRead, app.listMembersHandler)).Doc(operation{
+		Summary:    "List the members of the current organization",
+		Access:     orgPermitted,
+		Permission: data.PermissionOrgMembersRead,
+		Responses:  responses{http.StatusOK: envelope{"members": []data.Membership{}}},
+	})
+	router.HandlerFunc(http.MethodPut, "/org/members/:id", app.requireOrgPermission(data.PermissionOrgMembersWrite, app.validateBody("update_member.json", app.updateMemberHandler))).Doc(operation{
+		Summary:    "Change the role of a member",
+		Access:     orgPermitted,
+		Permission: data.PermissionOrgMembersWrite,
+		Body:       updateMemberInput{},
+		Responses:  responses{http.StatusOK: envelope{"membership": data.Membership{}}},
+		Errors:     []int{http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+	})
+	router.HandlerFunc(http.MethodDelete, "/org/members/:id", app.requireOrgPermission(data.PermissionOrgMembersWrite, app.removeMemberHandler)).Doc(operation{
+		Summary:    "Remove a member",
+		Access:     orgPermitted,
+		Permission: data.PermissionOrgMembersWrite,
+		Responses:  responses{http.StatusOK: envelope{"message": ""}},
+		Errors:     []int{http.StatusNotFound, http.StatusConflict},
+	})
+	router.HandlerFunc(http.MethodPost, "/org/invitations", app.requireOrgPermission(data.PermissionOrgMembersWrite, app.validateBody("create_invitation.json", app.createInvitationHandler))).Doc(operation{
+		Summary:     "Invite someone to the current organization",
+		Description: "The role defaults to member, and only owners can invite owners.",
+		Access:      orgPermitted,
+		Permission:  data.PermissionOrgMembersWrite,
+		Body:        createInvitationInput{},
+		Responses:   responses{http.StatusCreated: envelope{"invitation": data.Invitation{}}},
+		Errors:      []int{http.StatusUnprocessableEntity},
+	})
+
+	router.HandlerFunc(http.MethodGet, "/openapi.json", app.openAPIHandler(router)).Doc(operation{
+		Summary:   "Get this document",
+		Responses: responses{http.StatusOK: rawBody("application/json")},
+	})
+	router.HandlerFunc(http.MethodGet, "/docs/*filepath", app.docsHandler().ServeHTTP).Doc(operation{
+		Summary:   "Browse this document",
+		Path:      []parameter{{Name: "filepath", Description: "The file of the viewer, / for its page."}},
+		Responses: responses{http.StatusOK: rawBody("text/html")},
+		Errors:    []int{http.StatusNotFound},
+	})
+	router.HandlerFunc(http.MethodGet, "/schemas/*filepath", app.schemasHandler().ServeHTTP).Doc(operation{
+		Summary:     "Get the schema of a request body",
+		Description: "The request bodies are checked against these JSON schemas (draft 2020-12), common.json holds their shared definitions.",
+		Path:        []parameter{{Name: "filepath", Description: "The file of the schema, such as /register_user.json."}},
+		Responses:   responses{http.StatusOK: rawBody("application/schema+json")},
+		Errors:      []int{http.StatusNotFound},
+	})
 
 	return router
 }
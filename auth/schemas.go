@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+
+	"github.com/islamghany/go-workshop/auth/internals/jsonschema"
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+	"github.com/islamghany/go-workshop/jsonio"
+)
+
+/*
+Request schemas
+-The request bodies are described by JSON schemas (draft 2020-12) in schemas/, which are embedded
+ in the binary and published under GET /schemas/, so that partners can check their requests
+ before sending them. Shared definitions live in common.json.
+-validateBody checks a body against its schema before the handler decodes it with readInput, and
+ answers the violations with a 422 listing a field error for each, under its JSON pointer, the
+ same way the checks of the handlers are answered.
+-A body which isn't a single JSON value is left to readInput, so that it keeps its 400.
+-XML has no types to check before it is decoded into the input of the handler, so the XML and
+ MessagePack bodies are checked by readInput instead, against the JSON they are decoded
+ through, with the same 422. The patches of a PATCH route are left alone, as they describe
+ changes rather than the input itself.
+-The schemas describe the shape of the bodies. The checks which need code, such as the strength
+ of a password or whether an email address is taken, stay with the handlers.
+*/
+
+//go:embed schemas
+var schemasFS embed.FS
+
+// requestSchemas are the schemas of schemas/, a broken schema stops the server from
+// starting rather than letting requests through unchecked.
+var requestSchemas = mustLoadSchemas()
+
+func mustLoadSchemas() *jsonschema.Set {
+	set, err := jsonschema.Load(schemasFS, "schemas")
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// validateBody checks the request body against the schema loaded from the file name
+// before calling next, which can then read the body as usual.
+func (app *application) validateBody(name string, next http.HandlerFunc) http.HandlerFunc {
+	schema := requestSchemas.Get(name)
+	if schema == nil {
+		panic("no request schema named " + name)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		if jsonio.IsPatch(contentType) {
+			next(w, r)
+			return
+		}
+		if contentType != "" && !jsonio.IsJSON(contentType) {
+			next(w, app.contextSetBodySchema(r, schema))
+			return
+		}
+
+		body, err := jsonio.ReadBody(r, jsonio.MaxBytes(maxBodyBytes))
+		if err != nil {
+			app.badRequestResponse(w, r, bodyError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var doc interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil || dec.Decode(&struct{}{}) != io.EOF {
+			next(w, r)
+			return
+		}
+
+		if err := checkSchema(schema, doc); err != nil {
+			app.failedValidationResponse(w, r, err.v)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// schemaError is the error of a body which doesn't match its schema, with a field
+// error for each violation.
+type schemaError struct {
+	v *validator.Validator
+}
+
+func (e *schemaError) Error() string {
+	return "body doesn't match its schema"
+}
+
+// checkSchema checks a decoded JSON document against schema.
+func checkSchema(schema *jsonschema.Schema, doc interface{}) *schemaError {
+	errs := schema.Validate(doc)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	v := validator.New()
+	addSchemaErrors(v, errs)
+	return &schemaError{v: v}
+}
+
+// schemaCheck is the jsonio.Check option which checks the JSON a body is decoded
+// through against schema.
+func schemaCheck(schema *jsonschema.Schema) jsonio.Option {
+	return jsonio.Check(func(data []byte) error {
+		var doc interface{}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return err
+		}
+
+		if err := checkSchema(schema, doc); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// addSchemaErrors records the schema violations in v, each under the field it was
+// found at.
+func addSchemaErrors(v *validator.Validator, errs []jsonschema.Error) {
+	for _, e := range errs {
+		field := v
+		for _, segment := range e.Path {
+			switch segment := segment.(type) {
+			case int:
+				field = field.Index(segment)
+			case string:
+				field = field.Field(segment)
+			}
+		}
+
+		names := make([]string, 0, len(e.Params))
+		for name := range e.Params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		params := make([]string, 0, 2*len(names))
+		for _, name := range names {
+			params = append(params, name, e.Params[name])
+		}
+		field.AddError("", e.Code, params...)
+	}
+}
+
+// schemasHandler publishes the request schemas.
+func (app *application) schemasHandler() http.Handler {
+	sub, err := fs.Sub(schemasFS, "schemas")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/schemas", http.FileServer(http.FS(sub)))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+)
+
+func TestRequestSchemaErrors(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	status, response := do(t, app, http.MethodPost, "/tokens/authentication",
+		`{"email": "alice@example.com", "password": 42, "organization": null, "remember": true}`)
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d: %v", status, http.StatusUnprocessableEntity, response)
+	}
+
+	var got []string
+	list, _ := response["errors"].([]interface{})
+	for _, item := range list {
+		fe, _ := item.(map[string]interface{})
+		got = append(got, fe["field"].(string)+" "+fe["code"].(string))
+	}
+
+	want := []string{
+		"/organization organization.wrong_type",
+		"/password password.wrong_type",
+		"/remember remember.unknown_field",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// The bodies in other formats than JSON are checked against the schema too, once they
+// are decoded.
+func TestRequestSchemaFormats(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	msgpack := "\x82" +
+		"\xa5email\xb1alice@example.com" +
+		"\xa8password\x2a"
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/xml", `<input><email>alice@example.com</email><password>pa55word</password><remember>true</remember></input>`, "/remember remember.unknown_field"},
+		{"application/msgpack", msgpack, "/password password.wrong_type"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/tokens/authentication", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, r)
+
+		var response struct {
+			Errors []struct {
+				Field string `json:"field"`
+				Code  string `json:"code"`
+			} `json:"errors"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: invalid JSON response: %v\n%s", tt.contentType, err, rr.Body)
+		}
+
+		var got []string
+		for _, fe := range response.Errors {
+			got = append(got, fe.Field+" "+fe.Code)
+		}
+		if rr.Code != http.StatusUnprocessableEntity || strings.Join(got, "\n") != tt.want {
+			t.Errorf("%s: got status %d and errors %q; want %d and %q", tt.contentType, rr.Code, got, http.StatusUnprocessableEntity, tt.want)
+		}
+	}
+}
+
+func TestPublishedSchemas(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	status, schema := do(t, app, http.MethodGet, "/schemas/register_user.json", "")
+	if status != http.StatusOK || schema["type"] != "object" {
+		t.Fatalf("got status %d and %v; want the schema", status, schema)
+	}
+
+	// The enums are copies of lists kept in the data package.
+	status, schema = do(t, app, http.MethodGet, "/schemas/create_webhook_subscription.json", "")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want the schema", status)
+	}
+	event := schema["properties"].(map[string]interface{})["event"].(map[string]interface{})
+	checkEnum(t, "event", event["enum"], data.WebhookEvents)
+
+	status, schema = do(t, app, http.MethodGet, "/schemas/common.json", "")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want the schema", status)
+	}
+	role := schema["$defs"].(map[string]interface{})["role"].(map[string]interface{})
+	var roles []string
+	for name := range data.RolePermissions {
+		roles = append(roles, name)
+	}
+	checkEnum(t, "role", role["enum"], roles)
+}
+
+func checkEnum(t *testing.T, name string, enum interface{}, want []string) {
+	t.Helper()
+
+	var got []string
+	list, _ := enum.([]interface{})
+	for _, value := range list {
+		got = append(got, value.(string))
+	}
+	want = append([]string(nil), want...)
+	sort.Strings(got)
+	sort.Strings(want)
+
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("the %s enum is %v; want %v", name, got, want)
+	}
+}
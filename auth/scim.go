@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/auth/internals/scim"
+)
+
+// scimHandler serves the SCIM 2.0 provisioning endpoints under /scim/v2. Every change
+// made by a provisioning client is audited, with the client name in the metadata.
+func (app *application) scimHandler() http.Handler {
+	h := scim.NewHandler(app.models.Users, app.models.Tokens, app.models.SCIMClients)
+
+	h.ErrorLog = app.logError
+	h.OnChange = func(r *http.Request, client *data.SCIMClient, event string, user *data.User) {
+		metadata := map[string]string{"scim_client": client.Name}
+
+		switch event {
+		case scim.EventCreated:
+			app.audit(r, data.EventUserRegistered, 0, user.ID, metadata)
+			app.enqueueWebhook(data.EventUserRegistered, envelope{"user": user})
+		case scim.EventDeleted:
+			app.audit(r, data.EventUserDeleted, 0, user.ID, metadata)
+			app.enqueueWebhook(data.EventUserDeleted, envelope{"user_id": user.ID})
+		default:
+			metadata["operation"] = event
+			app.audit(r, data.EventUserProvisioned, 0, user.ID, metadata)
+		}
+	}
+
+	return h
+}
+
+// createSCIMClientCommand implements "auth scim-client <name>". It prints the bearer
+// secret to configure in the identity provider, which can't be shown again.
+func (app *application) createSCIMClientCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: scim-client <name>")
+	}
+
+	client, secret, err := app.models.SCIMClients.New(args[0])
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateName) {
+			return fmt.Errorf("a SCIM client named %q already exists", args[0])
+		}
+		return err
+	}
+
+	fmt.Printf("SCIM client %d (%s) created, its bearer secret is:\n%s\n", client.ID, client.Name, secret)
+	return nil
+}
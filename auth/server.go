@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs the server until it receives SIGINT or SIGTERM. It then stops accepting
+// connections, gives the requests in flight up to 20 seconds to finish, stops the
+// background jobs which take a context and waits for the background goroutines.
+func (app *application) serve() error {
+	srv := &http.Server{
+		Addr:         app.config.port,
+		Handler:      app.routes(),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	app.wg.Add(3)
+	go func() {
+		defer app.wg.Done()
+		app.sweepExpiredTokens(ctx)
+	}()
+	go func() {
+		defer app.wg.Done()
+		app.purgeDeletedUsers(ctx)
+	}()
+	go func() {
+		defer app.wg.Done()
+		app.deliverWebhooks(ctx)
+	}()
+
+	shutdownError := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		log.Println("shutting down server:", s)
+		stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		shutdownError <- srv.Shutdown(ctx)
+	}()
+
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	app.wg.Wait()
+
+	log.Println("stopped server")
+	return nil
+}
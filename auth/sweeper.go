@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+)
+
+/*
+Expired token sweeper
+
+-Expired tokens are never matched by a lookup, but nothing deleted them, so the tokens table only grew.
+-Every -token-sweep-interval the sweeper deletes them, -token-sweep-batch rows per statement.
+-A Postgres advisory lock makes sure only one instance sweeps at a time, the others skip their turn.
+-Each sweep is logged and counted in the token_sweeper metrics, served at GET /admin/metrics.
+-The sweeper stops when the server shuts down, after finishing the batch it is on.
+*/
+
+var sweeperMetrics = expvar.NewMap("token_sweeper")
+
+// sweepExpiredTokens runs a sweep every interval until ctx is done.
+func (app *application) sweepExpiredTokens(ctx context.Context) {
+	ticker := time.NewTicker(app.config.tokens.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			app.sweepOnce(ctx)
+		}
+	}
+}
+
+func (app *application) sweepOnce(ctx context.Context) {
+	start := time.Now()
+	n, err := app.models.Tokens.DeleteExpired(ctx, app.config.tokens.sweepBatchSize)
+	duration := time.Since(start)
+
+	if errors.Is(err, data.ErrLocked) {
+		sweeperMetrics.Add("skipped", 1)
+		return
+	}
+
+	sweeperMetrics.Add("runs", 1)
+	sweeperMetrics.Add("deleted", n)
+	sweeperMetrics.Add("duration_ms", duration.Milliseconds())
+
+	lastDuration := new(expvar.Int)
+	lastDuration.Set(duration.Milliseconds())
+	sweeperMetrics.Set("last_duration_ms", lastDuration)
+
+	if err != nil {
+		sweeperMetrics.Add("errors", 1)
+		log.Printf("sweeping expired tokens: deleted %d in %s: %v", n, duration, err)
+		return
+	}
+
+	log.Printf("swept %d expired tokens in %s", n, duration)
+}
+
+// showMetricsHandler reports the metrics of the background jobs. Only these are
+// served, not everything published to expvar, which includes the command line and so
+// the API keys.
+func (app *application) showMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"token_sweeper": json.RawMessage(sweeperMetrics.String()),
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
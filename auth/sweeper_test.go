@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+)
+
+// sweeperMetric returns the current value of a token_sweeper metric.
+func sweeperMetric(name string) int64 {
+	if v, ok := sweeperMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestSweepExpiredTokens(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.config.tokens.sweepInterval = 10 * time.Millisecond
+	app.config.tokens.sweepBatchSize = 100
+
+	ctx := context.Background()
+	user := &data.User{Name: "Alice Smith", Email: "alice@example.com", Activated: true}
+	if err := user.Password.SetRandom(); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := app.models.Tokens.New(ctx, user.ID, -time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := app.models.Tokens.New(ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs, deleted := sweeperMetric("runs"), sweeperMetric("deleted")
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		app.sweepExpiredTokens(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sweeperMetric("runs") == runs {
+		if time.Now().After(deadline) {
+			t.Fatal("the sweeper never ran")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sweeper didn't stop when its context was cancelled")
+	}
+
+	if got := sweeperMetric("deleted") - deleted; got != 1 {
+		t.Errorf("deleted %d tokens; want 1", got)
+	}
+
+	tokens, err := app.models.Tokens.GetAllForUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Expiry != live.Expiry {
+		t.Errorf("got tokens %+v; want only the live one, not %+v", tokens, expired)
+	}
+}
+
+// lockedTokens is a TokenStore whose sweeps always find another instance sweeping.
+type lockedTokens struct {
+	data.TokenStore
+}
+
+func (lockedTokens) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	return 0, data.ErrLocked
+}
+
+func TestSweepSkippedWhenLocked(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.models.Tokens = lockedTokens{app.models.Tokens}
+
+	runs, skipped, errs := sweeperMetric("runs"), sweeperMetric("skipped"), sweeperMetric("errors")
+
+	app.sweepOnce(context.Background())
+
+	if got := sweeperMetric("skipped") - skipped; got != 1 {
+		t.Errorf("skipped %d sweeps; want 1", got)
+	}
+	if sweeperMetric("runs") != runs || sweeperMetric("errors") != errs {
+		t.Error("a skipped sweep was counted as a run")
+	}
+}
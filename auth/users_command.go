@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/auth/internals/i18n"
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+	"github.com/islamghany/go-workshop/jsonio"
+	"github.com/islamghany/go-workshop/negotiate"
+)
+
+/*
+Bulk import and export
+
+-"auth users import" reads users from CSV or JSONL (one JSON object per line) and inserts them
+ in batches with COPY. The columns are name, email, password_hash and activated.
+-password_hash takes the bcrypt hashes of the legacy system as they are, with a cost of at most
+ 16; they are upgraded to the default algorithm on the next login. Other hashes are rejected.
+-With -invite, rows without a password_hash get a random password and are emailed an account
+ setup token to choose their own (see setupAccountHandler). Without it, such rows are rejected.
+-Every row which isn't imported is written to the report (CSV: line, email, error), the rest of
+ the file is still imported.
+-"auth users export" writes every user in the same formats. Only the rows whose hash is still
+ bcrypt can be imported back, the import is meant for the legacy system.
+-POST /admin/user-imports does the same for a body streamed as NDJSON or a JSON array of the
+ rows, up to 100,000 of them, and answers with the rows which weren't imported along with their
+ index and line. The rows are inserted batch by batch as they are read. The import has 10
+ minutes to be read and answered, rather than the timeouts of the server.
+-A batch which can't be inserted stops the import, which answers with a 500 holding the report
+ so far and the range of the failed batch: the rows before it were dealt with, the ones after
+ it weren't read. The command stops the same way.
+-A body which can't be read any further (too many rows, a broken array, a client which goes
+ away) stops the import as well, once the rows before the break are imported. It answers with
+ a 400 holding the report and where the body stopped, unless it stopped before the first row.
+ The command imports the rows before a file which can't be read any further too.
+-GET /admin/user-exports streams every user as a JSON array, or as NDJSON to the clients which
+ prefer application/x-ndjson, without holding them in memory. The password hashes are left out:
+ they only leave the server through the command. A failure halfway is reported in the
+ Stream-Error trailer (and a last {"error": ...} line in NDJSON), as the 200 is already sent; a
+ complete export ends with the Stream-Count trailer, so an export with neither was cut off.
+*/
+
+const (
+	accountSetupTTL = 7 * 24 * time.Hour
+
+	importBatchSize    = 500
+	maxImportRows      = 100_000
+	maxImportItemBytes = 16 * 1024
+	importTimeout      = 10 * time.Minute
+)
+
+// userRecord is a single row of an import or export file.
+type userRecord struct {
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Activated    bool   `json:"activated"`
+}
+
+func newUserRecord(user *data.User) *userRecord {
+	return &userRecord{
+		Name:         user.Name,
+		Email:        user.Email,
+		PasswordHash: user.Password.Encoded(),
+		Activated:    user.Activated,
+	}
+}
+
+var userRecordColumns = []string{"name", "email", "password_hash", "activated"}
+
+// usersCommand implements "auth users import|export".
+func (app *application) usersCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: users import|export [flags] <file>")
+	}
+
+	switch args[0] {
+	case "import":
+		return app.importUsersCommand(args[1:])
+	case "export":
+		return app.exportUsersCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown users command %q", args[0])
+	}
+}
+
+// importUsersCommand implements "auth users import [-format csv|jsonl] [-batch n]
+// [-report file] [-invite] <file>". The file "-" is the standard input.
+func (app *application) importUsersCommand(args []string) error {
+	fs := flag.NewFlagSet("users import", flag.ContinueOnError)
+	format := fs.String("format", "", "csv or jsonl, guessed from the file extension when empty")
+	batchSize := fs.Int("batch", importBatchSize, "the number of users inserted per COPY")
+	reportPath := fs.String("report", "", "where to write the rows which weren't imported, the standard error when empty")
+	invite := fs.Bool("invite", false, "email an account setup link to the users without a password hash")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *batchSize < 1 {
+		return errors.New("usage: users import [-format csv|jsonl] [-batch n] [-report file] [-invite] <file>")
+	}
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	records, err := newUserRecordReader(bufio.NewReader(in), guessFormat(*format, fs.Arg(0)))
+	if err != nil {
+		return err
+	}
+
+	report := csv.NewWriter(os.Stderr)
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		report = csv.NewWriter(f)
+	}
+	report.Write([]string{"line", "email", "error"})
+
+	onReject := func(row importRow, email, message string) {
+		report.Write([]string{strconv.Itoa(row.line), email, message})
+	}
+
+	// Every batch is bounded by the data package, so the import as a whole isn't.
+	ctx := context.Background()
+
+	imp := app.newUserImport(*invite, onReject)
+
+	var readErr, flushErr error
+	for {
+		line, record, err := records.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var rowErr *rowError
+			if !errors.As(err, &rowErr) {
+				// The rows before a file which can't be read any further are
+				// still imported.
+				readErr = fmt.Errorf("line %d: %w", line, err)
+				break
+			}
+			imp.reject(importRow{line: line}, "", rowErr.Error())
+			continue
+		}
+
+		imp.add(importRow{line: line}, record)
+
+		if len(imp.batch) >= *batchSize {
+			if flushErr = imp.flush(ctx); flushErr != nil {
+				break
+			}
+		}
+	}
+
+	if flushErr == nil {
+		flushErr = imp.flush(ctx)
+	}
+	if flushErr != nil {
+		// Keep the report of the rows before the failed batch.
+		report.Flush()
+		return flushErr
+	}
+
+	report.Flush()
+	if err = report.Error(); err != nil {
+		return err
+	}
+
+	// Wait for the account setup emails before exiting.
+	app.wg.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+
+	log.Printf("imported %d users, %d rows rejected", imp.imported, imp.rejected)
+	return nil
+}
+
+// importRow locates a row of an import: its line, and its index among the rows of a
+// body sent to the API.
+type importRow struct {
+	index, line int
+}
+
+// importBatchError is returned by flush when a batch can't be inserted, first and
+// last are its rows.
+type importBatchError struct {
+	first, last importRow
+	err         error
+}
+
+func (e *importBatchError) Error() string {
+	return fmt.Sprintf("the rows of lines %d to %d and after weren't imported: %v", e.first.line, e.last.line, e.err)
+}
+
+func (e *importBatchError) Unwrap() error {
+	return e.err
+}
+
+// importFailure is the batch an import sent to the API stopped at.
+type importFailure struct {
+	FromIndex int    `json:"from_index"`
+	FromLine  int    `json:"from_line"`
+	ToIndex   int    `json:"to_index"`
+	ToLine    int    `json:"to_line"`
+	Error     string `json:"error"`
+}
+
+// importStop is where the body of an import sent to the API stopped being read: the
+// rows before Index were dealt with, the others weren't read.
+type importStop struct {
+	Index int    `json:"index"`
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// importRejection is a row of an import sent to the API which wasn't imported.
+type importRejection struct {
+	Index int    `json:"index"`
+	Line  int    `json:"line"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+// importUsersHandler imports the users of a body streamed as NDJSON or a JSON array,
+// one userRecord per item. With ?invite=true the users without a password_hash are
+// emailed an account setup link.
+func (app *application) importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if err := extendDeadlines(w, importTimeout); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	batch, err := jsonio.ReadBatch(r,
+		jsonio.MaxItems(maxImportRows),
+		jsonio.MaxItemBytes(maxImportItemBytes))
+	if err != nil {
+		var contentTypeErr *jsonio.ContentTypeError
+		if errors.As(err, &contentTypeErr) {
+			app.unsupportedMediaTypeResponse(w, r, contentTypeErr.Allowed)
+			return
+		}
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	rejected := []importRejection{}
+	imp := app.newUserImport(r.URL.Query().Get("invite") == "true", func(row importRow, email, message string) {
+		rejected = append(rejected, importRejection{Index: row.index, Line: row.line, Email: email, Error: message})
+	})
+
+	for {
+		var record userRecord
+		err := batch.Next(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var itemErr *jsonio.ItemError
+		if errors.As(err, &itemErr) {
+			imp.reject(importRow{index: itemErr.Index, line: itemErr.Line}, "", bodyError(itemErr.Err).Error())
+			continue
+		}
+		if err != nil {
+			app.importStoppedResponse(w, r, imp, rejected, batch, err)
+			return
+		}
+
+		imp.add(importRow{index: batch.Index(), line: batch.Line()}, &record)
+
+		if len(imp.batch) >= importBatchSize {
+			if err := imp.flush(r.Context()); err != nil {
+				app.importFailedResponse(w, r, imp, rejected, err)
+				return
+			}
+		}
+	}
+
+	if err := imp.flush(r.Context()); err != nil {
+		app.importFailedResponse(w, r, imp, rejected, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"imported": imp.imported, "rejected": rejected}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// importStoppedResponse answers an import whose body couldn't be read any further
+// with the report so far and where the body stopped, once the rows before it are
+// imported. A body which stopped before its first row is a plain bad request.
+func (app *application) importStoppedResponse(w http.ResponseWriter, r *http.Request, imp *userImport, rejected []importRejection, batch *jsonio.BatchReader, err error) {
+	if batch.Index() == 0 {
+		app.badRequestResponse(w, r, bodyError(err))
+		return
+	}
+
+	if err := imp.flush(r.Context()); err != nil {
+		app.importFailedResponse(w, r, imp, rejected, err)
+		return
+	}
+
+	var message i18n.Message
+	if !errors.As(bodyError(err), &message) {
+		message = i18n.New("bad_request", "reason", err.Error())
+	}
+
+	env := envelope{
+		"imported": imp.imported,
+		"rejected": rejected,
+		"stopped": importStop{
+			Index: batch.Index(),
+			Line:  batch.Line(),
+			Error: message.In(app.language(w, r)),
+		},
+	}
+
+	err = app.writeResponse(w, r, http.StatusBadRequest, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// importFailedResponse answers an import stopped by a batch which couldn't be
+// inserted with the report so far, as the batches before it are kept.
+func (app *application) importFailedResponse(w http.ResponseWriter, r *http.Request, imp *userImport, rejected []importRejection, err error) {
+	var batchErr *importBatchError
+	if !errors.As(err, &batchErr) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logError(r, err)
+
+	env := envelope{
+		"imported": imp.imported,
+		"rejected": rejected,
+		"failed": importFailure{
+			FromIndex: batchErr.first.index,
+			FromLine:  batchErr.first.line,
+			ToIndex:   batchErr.last.index,
+			ToLine:    batchErr.last.line,
+			Error:     i18n.New("server_error").In(app.language(w, r)),
+		},
+	}
+
+	err = app.writeResponse(w, r, http.StatusInternalServerError, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// exportUsersHandler streams every user in the format of the import, without their
+// password hashes.
+func (app *application) exportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	prefs := negotiate.ParseAccept(r.Header.Get("Accept"))
+	ndjson := negotiate.Quality(prefs, jsonio.NDJSON) > negotiate.Quality(prefs, "application/json")
+
+	w.Header().Add("Vary", "Accept")
+	lang := app.language(w, r)
+
+	stream := jsonio.NewStreamWriter(w, r, http.StatusOK, ndjson, nil)
+	err := app.models.Users.Stream(r.Context(), func(user *data.User) error {
+		record := newUserRecord(user)
+		record.PasswordHash = ""
+		return stream.Write(record)
+	})
+	if err != nil {
+		// A client which went away isn't worth logging.
+		if r.Context().Err() == nil {
+			app.logError(r, err)
+		}
+		stream.CloseWithError(errors.New(i18n.New("server_error").In(lang)))
+		return
+	}
+
+	if err := stream.Close(); err != nil && r.Context().Err() == nil {
+		app.logError(r, err)
+	}
+}
+
+// userImport accumulates the valid rows of an import into batches. onReject is told
+// about every row which isn't imported.
+type userImport struct {
+	app      *application
+	invite   bool
+	onReject func(row importRow, email, message string)
+
+	seen    map[string]bool
+	batch   []*data.User
+	rows    []importRow
+	invited map[*data.User]bool
+
+	imported int
+	rejected int
+}
+
+func (app *application) newUserImport(invite bool, onReject func(row importRow, email, message string)) *userImport {
+	return &userImport{
+		app:      app,
+		invite:   invite,
+		onReject: onReject,
+		seen:     make(map[string]bool),
+		invited:  make(map[*data.User]bool),
+	}
+}
+
+func (imp *userImport) reject(row importRow, email, message string) {
+	imp.onReject(row, email, message)
+	imp.rejected++
+}
+
+// add validates a row and adds it to the current batch.
+func (imp *userImport) add(row importRow, record *userRecord) {
+	user := &data.User{
+		Name:      record.Name,
+		Email:     record.Email,
+		Activated: record.Activated,
+	}
+
+	switch {
+	case record.PasswordHash != "":
+		if err := user.Password.SetHash(record.PasswordHash); err != nil {
+			imp.reject(row, record.Email, "password_hash: "+err.Error())
+			return
+		}
+	case imp.invite:
+		if err := user.Password.SetRandom(); err != nil {
+			imp.reject(row, record.Email, err.Error())
+			return
+		}
+		// The account is activated once its owner proves they can read the setup email.
+		user.Activated = false
+	default:
+		imp.reject(row, record.Email, "password_hash: must be provided unless -invite is set")
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		imp.reject(row, record.Email, formatValidationErrors(v))
+		return
+	}
+
+	email := strings.ToLower(user.Email)
+	if imp.seen[email] {
+		imp.reject(row, record.Email, "email: appears more than once in the file")
+		return
+	}
+	imp.seen[email] = true
+
+	imp.batch = append(imp.batch, user)
+	imp.rows = append(imp.rows, row)
+	if record.PasswordHash == "" {
+		imp.invited[user] = true
+	}
+}
+
+// flush inserts the current batch. If the COPY fails it returns an *importBatchError,
+// and the import must stop: the database is unlikely to take the next batch.
+func (imp *userImport) flush(ctx context.Context) error {
+	if len(imp.batch) == 0 {
+		return nil
+	}
+
+	batch, rows := imp.batch, imp.rows
+	imp.batch, imp.rows = nil, nil
+
+	skipped, err := imp.app.models.Users.InsertBatch(ctx, batch)
+	if err != nil {
+		return &importBatchError{first: rows[0], last: rows[len(rows)-1], err: err}
+	}
+
+	isSkipped := make(map[*data.User]bool, len(skipped))
+	for _, user := range skipped {
+		isSkipped[user] = true
+	}
+
+	for i, user := range batch {
+		if isSkipped[user] {
+			delete(imp.invited, user)
+			imp.reject(rows[i], user.Email, "email: a user with this email address already exists")
+			continue
+		}
+		imp.imported++
+
+		if imp.invited[user] {
+			delete(imp.invited, user)
+			if err := imp.app.sendAccountSetup(ctx, user); err != nil {
+				imp.reject(rows[i], user.Email, "imported, but the setup email failed: "+err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// sendAccountSetup creates an account setup token for an imported user and emails it.
+func (app *application) sendAccountSetup(ctx context.Context, user *data.User) error {
+	token, err := app.models.Tokens.New(ctx, user.ID, accountSetupTTL, data.ScopeAccountSetup)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		sender := "auth@example.com"
+		subject := "Your account is ready"
+		body := `
+		<h4>an account has been created for you, choose your password <a href="http://localhost/8000/users/setup/%s">here</a></h4>
+		<p>http://localhost/8000/users/setup/%s</p>
+		<p>the link expires on %s</p>
+		`
+
+		_, _, err := app.sendEmail(sender, subject, fmt.Sprintf(body, token.Plaintext, token.Plaintext, token.Expiry.Format(time.RFC1123)), user.Email)
+
+		if err != nil {
+			log.Println(err)
+		}
+	})
+
+	return nil
+}
+
+// exportUsersCommand implements "auth users export [-format csv|jsonl] <file>". The
+// file "-" is the standard output.
+func (app *application) exportUsersCommand(args []string) error {
+	fs := flag.NewFlagSet("users export", flag.ContinueOnError)
+	format := fs.String("format", "", "csv or jsonl, guessed from the file extension when empty")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: users export [-format csv|jsonl] <file>")
+	}
+
+	out := os.Stdout
+	if fs.Arg(0) != "-" {
+		out, err = os.Create(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	bw := bufio.NewWriter(out)
+
+	var write func(record *userRecord) error
+	flush := bw.Flush
+
+	switch guessFormat(*format, fs.Arg(0)) {
+	case "csv":
+		cw := csv.NewWriter(bw)
+		cw.Write(userRecordColumns)
+		write = func(record *userRecord) error {
+			return cw.Write([]string{record.Name, record.Email, record.PasswordHash, strconv.FormatBool(record.Activated)})
+		}
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+	case "jsonl":
+		enc := json.NewEncoder(bw)
+		write = func(record *userRecord) error {
+			return enc.Encode(record)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	n := 0
+	err = app.models.Users.Stream(context.Background(), func(user *data.User) error {
+		n++
+		return write(newUserRecord(user))
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = flush(); err != nil {
+		return err
+	}
+
+	log.Printf("exported %d users", n)
+	return nil
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// guessFormat returns the format flag, or the one matching the file extension.
+func guessFormat(format, path string) string {
+	if format != "" {
+		return format
+	}
+	switch {
+	case strings.HasSuffix(path, ".jsonl"), strings.HasSuffix(path, ".ndjson"):
+		return "jsonl"
+	default:
+		return "csv"
+	}
+}
+
+// formatValidationErrors flattens the validation errors into one line of the report.
+func formatValidationErrors(v *validator.Validator) string {
+	var parts []string
+	for key, message := range v.Errors {
+		parts = append(parts, key+": "+message.Error())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// rowError is a problem with a single row, which is reported without stopping the
+// import.
+type rowError struct {
+	err error
+}
+
+func (e *rowError) Error() string { return e.err.Error() }
+
+// userRecordReader streams the rows of an import file. next returns the line number
+// along with the record, and io.EOF at the end of the file.
+type userRecordReader struct {
+	next func() (int, *userRecord, error)
+}
+
+func newUserRecordReader(r io.Reader, format string) (*userRecordReader, error) {
+	switch format {
+	case "csv":
+		return newCSVUserReader(r)
+	case "jsonl":
+		return newJSONLUserReader(r), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// newCSVUserReader reads CSV with a header row naming the columns, which can come in
+// any order. name and email are required.
+func newCSVUserReader(r io.Reader) (*userRecordReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header row: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"name", "email"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("the header row has no %q column", name)
+		}
+	}
+
+	field := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	next := func() (int, *userRecord, error) {
+		row, err := cr.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return parseErr.StartLine, nil, &rowError{err}
+			}
+			return 0, nil, err
+		}
+
+		// A quoted field can span several lines, so the row starts where its first
+		// field does.
+		line, _ := cr.FieldPos(0)
+
+		record := &userRecord{
+			Name:         field(row, "name"),
+			Email:        field(row, "email"),
+			PasswordHash: field(row, "password_hash"),
+		}
+
+		if activated := field(row, "activated"); activated != "" {
+			record.Activated, err = strconv.ParseBool(activated)
+			if err != nil {
+				return line, nil, &rowError{errors.New("activated: must be true or false")}
+			}
+		}
+
+		return line, record, nil
+	}
+
+	return &userRecordReader{next: next}, nil
+}
+
+// newJSONLUserReader reads one JSON object per line. Blank lines are skipped, and so
+// are the keys which aren't columns.
+func newJSONLUserReader(r io.Reader) *userRecordReader {
+	batch := jsonio.NewBatchReader(r, true, jsonio.AllowUnknownFields(), jsonio.MaxBytes(0))
+
+	next := func() (int, *userRecord, error) {
+		var record userRecord
+		err := batch.Next(&record)
+
+		var itemErr *jsonio.ItemError
+		switch {
+		case errors.As(err, &itemErr):
+			return itemErr.Line, nil, &rowError{itemErr.Err}
+		case err != nil:
+			return batch.Line(), nil, err
+		}
+		return batch.Line(), &record, nil
+	}
+
+	return &userRecordReader{next: next}
+}
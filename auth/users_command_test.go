@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/jsonio"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestImportUsersHandler(t *testing.T) {
+	app, mailer := newTestApplication(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse battery staple"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Join([]string{
+		`{"name": "Alice", "email": "alice@example.com"}`,
+		`{"name": "Bob", "email": 42}`,
+		``,
+		`{"name": "Carol", "email": "not an email"}`,
+		`{"name": "Dave", "email": "dave@example.com"}`,
+		`{"name": "Alice again", "email": "ALICE@example.com"}`,
+		`{"name": "Erin", "email": "erin@example.com", "password_hash": "` + string(hash) + `"}`,
+		`{"name": "Frank", "email": "frank@example.com", "password_hash": "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5"}`,
+		`{"name": "Grace", "email": "grace@example.com", "password_hash": "$2a$31$` + strings.Repeat("a", 53) + `"}`,
+	}, "\n")
+
+	r := httptest.NewRequest(http.MethodPost, "/admin/user-imports?invite=true", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	app.importUsersHandler(rr, r)
+	app.wg.Wait()
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	var response struct {
+		Imported int               `json:"imported"`
+		Rejected []importRejection `json:"rejected"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Imported != 3 {
+		t.Errorf("imported %d users; want 3", response.Imported)
+	}
+	if len(mailer.sent) != 2 {
+		t.Errorf("sent %d setup emails; want 2", len(mailer.sent))
+	}
+
+	want := []struct{ index, line int }{{1, 2}, {2, 4}, {4, 6}, {6, 8}, {7, 9}}
+	if len(response.Rejected) != len(want) {
+		t.Fatalf("got rejections %+v; want %d of them", response.Rejected, len(want))
+	}
+	for i, rejection := range response.Rejected {
+		if rejection.Index != want[i].index || rejection.Line != want[i].line || rejection.Error == "" {
+			t.Errorf("rejection %d is %+v; want index %d on line %d", i, rejection, want[i].index, want[i].line)
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/admin/user-imports", strings.NewReader("name,email\n"))
+	r.Header.Set("Content-Type", "text/csv")
+	rr = httptest.NewRecorder()
+	app.importUsersHandler(rr, r)
+
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d for a CSV body; want %d", rr.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+// failingBatches is a UserStore whose InsertBatch fails after the first n batches.
+type failingBatches struct {
+	data.UserStore
+	n int
+}
+
+func (f *failingBatches) InsertBatch(ctx context.Context, users []*data.User) ([]*data.User, error) {
+	if f.n == 0 {
+		return nil, errors.New("connection reset by peer")
+	}
+	f.n--
+	return f.UserStore.InsertBatch(ctx, users)
+}
+
+func TestImportUsersHandlerFailedBatch(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.models.Users = &failingBatches{UserStore: app.models.Users, n: 1}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse battery staple"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []string
+	for i := 0; i < importBatchSize+10; i++ {
+		rows = append(rows, fmt.Sprintf(`{"name": "User", "email": "user%d@example.com", "password_hash": "%s"}`, i, hash))
+	}
+	rows[3] = `{"name": "User", "email": 3}`
+
+	r := httptest.NewRequest(http.MethodPost, "/admin/user-imports", strings.NewReader(strings.Join(rows, "\n")))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	app.importUsersHandler(rr, r)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusInternalServerError, rr.Body)
+	}
+
+	var response struct {
+		Imported int               `json:"imported"`
+		Rejected []importRejection `json:"rejected"`
+		Failed   importFailure     `json:"failed"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first batch is kept, the second one holds the rows from index 501 on.
+	if response.Imported != importBatchSize || len(response.Rejected) != 1 || response.Rejected[0].Index != 3 {
+		t.Errorf("got %d imported and rejections %+v; want the first batch and the row 3", response.Imported, response.Rejected)
+	}
+	want := importFailure{FromIndex: 501, FromLine: 502, ToIndex: 509, ToLine: 510, Error: response.Failed.Error}
+	if response.Failed != want || strings.Contains(response.Failed.Error, "connection") {
+		t.Errorf("got failure %+v; want %+v without the database error", response.Failed, want)
+	}
+}
+
+func TestImportUsersHandlerStopped(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse battery staple"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := "[\n" +
+		`  {"name": "Alice", "email": "alice@example.com", "password_hash": "` + string(hash) + `"},` + "\n" +
+		`  {"name": "Bob", "email": 42},` + "\n" +
+		`  {"name": "Carol", "email": "carol@example.com", "password_hash": "` + string(hash) + `"},` + "\n" +
+		`  {"name": "Dave", "email": "dave@example.com",}` + "\n" +
+		"]"
+
+	r := httptest.NewRequest(http.MethodPost, "/admin/user-imports", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	app.importUsersHandler(rr, r)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusBadRequest, rr.Body)
+	}
+
+	var response struct {
+		Imported int               `json:"imported"`
+		Rejected []importRejection `json:"rejected"`
+		Stopped  importStop        `json:"stopped"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rows before the broken one are imported, although they don't fill a batch.
+	if response.Imported != 2 || len(response.Rejected) != 1 || response.Rejected[0].Index != 1 {
+		t.Errorf("got %d imported and rejections %+v; want Alice and Carol, and Bob rejected", response.Imported, response.Rejected)
+	}
+	if response.Stopped.Index != 3 || response.Stopped.Line != 5 || response.Stopped.Error == "" {
+		t.Errorf("got stop %+v; want index 3 on line 5", response.Stopped)
+	}
+	if _, err := app.models.Users.GetByEmail(context.Background(), "carol@example.com"); err != nil {
+		t.Errorf("looking up Carol: %v", err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/admin/user-imports", strings.NewReader(`{"name": "Alice"}`))
+	r.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	app.importUsersHandler(rr, r)
+
+	if rr.Code != http.StatusBadRequest || strings.Contains(rr.Body.String(), `"stopped"`) {
+		t.Errorf("got %d %s for a body which isn't an array; want a plain 400", rr.Code, rr.Body)
+	}
+}
+
+func TestCSVUserReaderLines(t *testing.T) {
+	file := "name,email\n" +
+		"\"Alice\nSmith\",alice@example.com\n" +
+		"\n" +
+		"Bob,bob@example.com\n" +
+		"\"Carol\",carol@\"example.com\n"
+
+	records, err := newUserRecordReader(strings.NewReader(file), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []int
+	for {
+		line, _, err := records.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.As(err, new(*rowError)) {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+
+	if fmt.Sprint(lines) != "[2 5 6]" {
+		t.Errorf("got rows on lines %v; want [2 5 6]", lines)
+	}
+}
+
+func TestExportUsersHandler(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		user := &data.User{Name: "User", Email: email, Activated: true}
+		if err := user.Password.Set("correct horse battery staple"); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.models.Users.Insert(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/user-exports", nil)
+	rr := httptest.NewRecorder()
+	app.exportUsersHandler(rr, r)
+
+	var records []userRecord
+	if err := json.Unmarshal(rr.Body.Bytes(), &records); err != nil {
+		t.Fatalf("got an invalid JSON array: %v\n%s", err, rr.Body)
+	}
+	if len(records) != 2 || records[0].Email != "alice@example.com" || records[0].PasswordHash != "" {
+		t.Errorf("got %+v; want both users without their password hashes", records)
+	}
+	if strings.Contains(rr.Body.String(), "password_hash") {
+		t.Errorf("got %s; want no password_hash", rr.Body)
+	}
+	if got := rr.Result().Trailer.Get(jsonio.StreamCountTrailer); got != "2" {
+		t.Errorf("got Stream-Count %q; want 2", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/admin/user-exports", nil)
+	r.Header.Set("Accept", "application/x-ndjson, application/json;q=0.5")
+	rr = httptest.NewRecorder()
+	app.exportUsersHandler(rr, r)
+
+	if got := rr.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("got Content-Type %q; want application/x-ndjson", got)
+	}
+	lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"email":"bob@example.com"`) {
+		t.Errorf("got lines %q; want one per user", lines)
+	}
+}
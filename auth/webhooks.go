@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/islamghany/go-workshop/auth/internals/data"
+	"github.com/islamghany/go-workshop/auth/internals/validator"
+	"github.com/islamghany/go-workshop/auth/internals/webhook"
+)
+
+/*
+Outgoing webhooks
+
+-An admin subscribes a URL to one of the user lifecycle events (data.WebhookEvents).
+-When the event happens, enqueueWebhook stores one pending delivery per subscription, so the request
+ which triggered it never waits for a receiver.
+-deliverWebhooks claims the due deliveries and posts them, signed with the subscription secret
+ (see the webhook package for the signature format).
+-A delivery which fails is retried with an exponential backoff, and given up on after
+ webhookMaxAttempts. Every attempt is recorded in the delivery log.
+-The deliveries stop when the server shuts down, after the one under way.
+*/
+
+const webhookMaxAttempts = 8
+
+// enqueueWebhook queues the event for delivery to its subscribers. Failing to queue it
+// is logged, but doesn't fail the request which triggered the event.
+func (app *application) enqueueWebhook(event string, payload interface{}) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("encoding %s webhook: %v", event, err)
+		return
+	}
+
+	err = app.models.Webhooks.Enqueue(event, js)
+	if err != nil {
+		log.Printf("queueing %s webhook: %v", event, err)
+	}
+}
+
+// deliverWebhooks polls for due deliveries until ctx is done. A delivery under way is
+// finished, the ones claimed after it are claimed again once their lease is over.
+func (app *application) deliverWebhooks(ctx context.Context) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deliveries, err := app.models.Webhooks.ClaimDue(20, time.Minute)
+		if err != nil {
+			log.Println("claiming webhook deliveries:", err)
+			continue
+		}
+
+		for _, d := range deliveries {
+			if ctx.Err() != nil {
+				return
+			}
+			app.deliverWebhook(client, d)
+		}
+	}
+}
+
+// deliverWebhook makes a single attempt at a delivery and records its outcome.
+func (app *application) deliverWebhook(client *http.Client, d *data.WebhookDelivery) {
+	// The timestamp in the body is the one of the signature, so receivers which store
+	// the payload can still tell when it was sent.
+	sentAt := time.Now()
+	body, err := json.Marshal(struct {
+		ID        int64           `json:"id"`
+		Event     string          `json:"event"`
+		Timestamp int64           `json:"timestamp"`
+		Data      json.RawMessage `json:"data"`
+	}{
+		ID:        d.ID,
+		Event:     d.Event,
+		Timestamp: sentAt.Unix(),
+		Data:      d.Payload,
+	})
+	if err != nil {
+		log.Printf("encoding webhook delivery %d: %v", d.ID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	status, sendErr := webhook.Send(ctx, client, d.URL, d.Secret, sentAt, body)
+
+	attempt := &data.WebhookAttempt{DurationMS: int(time.Since(start).Milliseconds())}
+
+	d.Attempts++
+	d.ResponseCode, d.LastError = nil, nil
+	if status != 0 {
+		d.ResponseCode = &status
+		attempt.ResponseCode = &status
+	}
+
+	switch {
+	case sendErr == nil:
+		d.Status = data.DeliverySucceeded
+	case d.Attempts >= webhookMaxAttempts:
+		d.Status = data.DeliveryFailed
+	default:
+		d.Status = data.DeliveryPending
+		d.NextAttemptAt = time.Now().Add(webhook.Backoff(d.Attempts))
+	}
+
+	if sendErr != nil {
+		message := sendErr.Error()
+		d.LastError = &message
+		attempt.Error = &message
+	}
+
+	err = app.models.Webhooks.RecordAttempt(d, attempt)
+	if err != nil {
+		log.Printf("recording webhook delivery %d: %v", d.ID, err)
+	}
+}
+
+// createWebhookSubscriptionInput is the request body of createWebhookSubscriptionHandler.
+type createWebhookSubscriptionInput struct {
+	Event  string `json:"event"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+func (app *application) createWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var input createWebhookSubscriptionInput
+
+	err := app.readInput(r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	subscription := &data.WebhookSubscription{
+		Event:  input.Event,
+		URL:    input.URL,
+		Secret: input.Secret,
+	}
+
+	// Generate a secret when the client didn't bring its own. It is only ever sent
+	// back in this response.
+	if subscription.Secret == "" {
+		randomBytes := make([]byte, 32)
+		_, err = rand.Read(randomBytes)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		subscription.Secret = base64.RawURLEncoding.EncodeToString(randomBytes)
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhookSubscription(v, subscription); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	err = app.models.Webhooks.InsertSubscription(subscription)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"webhook": subscription}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := app.models.Webhooks.GetAllSubscriptions()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhooks": subscriptions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.DeleteSubscription(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhookDeliveriesHandler returns a page of the deliveries of a subscription.
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	var filters data.Filters
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveriesForSubscription(id, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhookAttemptsHandler returns the delivery log of a single delivery.
+func (app *application) listWebhookAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	attempts, err := app.models.Webhooks.GetAttempts(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"attempts": attempts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// redeliverWebhookHandler queues a delivery again, the worker picks it up on its next
+// tick.
+func (app *application) redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	delivery, err := app.models.Webhooks.Redeliver(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,34 +1,21 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+
+	"github.com/islamghany/go-workshop/jsonio"
+	"github.com/islamghany/go-workshop/negotiate"
 )
 
-type envelope map[string]interface{}
+// envelope is the jsonio.Envelope, under the short name the handlers use.
+type envelope = jsonio.Envelope
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
-	jsonData, err := json.Marshal(data)
-
-	if err != nil {
-		fmt.Println("an error has occur ", err)
-		return err
-	}
-
-	// Append a newline to make it easier to view in terminal applications.
-	jsonData = append(jsonData, '\n')
-
-	// Go does't throw an error when iterating on a nil object so its fine.
-	for key, value := range headers {
-		w.Header()[key] = value
-	}
-
-	w.Header().Set("Content-Type", "application")
-	w.WriteHeader(status)
-	w.Write(jsonData)
-	return nil
+	return jsonio.Write(w, status, data, headers)
 }
+
 func (app *application) logError(r *http.Request, err error) {
 	// Use the PrintError() method to log the error message, and include the current
 	// request method and URL as properties in the log entry.
@@ -37,72 +24,140 @@ func (app *application) logError(r *http.Request, err error) {
 		"request_url":    r.URL.String(),
 	})
 }
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
-	err := app.writeJSON(w, status, env, nil)
 
+// problemTypePrefix is prepended to the error code to make the type of a problem.
+const problemTypePrefix = "urn:go-workshop:handling-error:problem:"
+
+// problem is an RFC 7807 problem details object, Errors lists the fields which failed
+// validation.
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Instance  string       `json:"instance"`
+	Errors    []fieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// wantsProblem reports whether the client should get an application/problem+json
+// response rather than the legacy {"error": ...} envelope, which is only sent to the
+// clients preferring application/json.
+func wantsProblem(r *http.Request) bool {
+	prefs := negotiate.ParseAccept(r.Header.Get("Accept"))
+
+	jsonQ := negotiate.Quality(prefs, "application/json")
+	return jsonQ <= 0 || negotiate.Quality(prefs, "application/problem+json") >= jsonQ
+}
+
+// writeProblem sends p, or the legacy envelope holding message when the client asks
+// for it.
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, p problem, message interface{}) {
+	w.Header().Add("Vary", "Accept")
+
+	if !wantsProblem(r) {
+		err := app.writeJSON(w, p.Status, envelope{"error": message}, nil)
+		if err != nil {
+			app.logError(r, err)
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = requestIDFromContext(r.Context())
+
+	err := app.writeJSON(w, p.Status, p, http.Header{"Content-Type": {"application/problem+json"}})
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
+
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	app.writeProblem(w, r, problem{
+		Type:   problemTypePrefix + code,
+		Status: status,
+		Detail: message,
+	}, message)
+}
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, "server_error", message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, "not_found", message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, "method_not_allowed", message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, "bad_request", err.Error())
 }
 
+// failedValidationResponse sends the errors sorted by field. They are plain messages,
+// so they all get the invalid code.
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	errs := make([]fieldError, 0, len(errors))
+	for field, message := range errors {
+		errs = append(errs, fieldError{Field: field, Code: "invalid", Message: message})
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+
+	app.writeProblem(w, r, problem{
+		Type:   problemTypePrefix + "failed_validation",
+		Status: http.StatusUnprocessableEntity,
+		Detail: "the request contains invalid fields",
+		Errors: errs,
+	}, errors)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, "edit_conflict", message)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponse(w, r, http.StatusTooManyRequests, "rate_limit_exceeded", message)
 }
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_credentials", message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_token", message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "authentication_required", message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, "inactive_account", message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, "not_permitted", message)
 }
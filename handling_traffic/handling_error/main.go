@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"os"
+	"regexp"
 )
 
 type application struct {
@@ -20,7 +24,7 @@ func main() {
 	mux.HandleFunc("/", app.notFoundResponse)
 	app.logger.PrintInfo("the server is running", nil)
 
-	app.logger.PrintFatal(http.ListenAndServe(":8000", app.recoverPanic(mux)), nil)
+	app.logger.PrintFatal(http.ListenAndServe(":8000", app.requestID(app.recoverPanic(mux))), nil)
 
 }
 
@@ -67,3 +71,35 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+type contextKey string
+
+const requestIDContextKey = contextKey("request_id")
+
+// requestIDRX matches the request IDs we accept from clients, anything else is
+// replaced so that it can't be used to inject content into the logs or the headers.
+var requestIDRX = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// requestID gives every request an ID, taken from the X-Request-ID header when the
+// client sent one, which is echoed back in the response and included in the problems.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
+
+	"github.com/islamghany/go-workshop/jsonio"
 )
 
 /*
@@ -116,27 +116,12 @@ at a high level Go’s encoding/json package us with two options for encoding th
 				}
 */
 
+// writeJSON uses json.Marshal as described above, through the jsonio package which also
+// sets the Content-Type header to application/json.
 func writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
-	jsonData, err := json.Marshal(data)
-
-	if err != nil {
-		fmt.Println("an error has occur ", err)
-		return err
-	}
-
-	// Append a newline to make it easier to view in terminal applications.
-	jsonData = append(jsonData, '\n')
-
-	// Go does't throw an error when iterating on a nil object so its fine.
-	for key, value := range headers {
-		w.Header()[key] = value
-	}
-
-	w.Header().Set("Content-Type", "application")
-	w.WriteHeader(status)
-	w.Write(jsonData)
-	return nil
+	return jsonio.Write(w, status, data, headers)
 }
+
 func main() {
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
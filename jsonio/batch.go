@@ -0,0 +1,343 @@
+package jsonio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// DefaultMaxBatchBytes is the largest batch accepted unless told otherwise, 64MB.
+const DefaultMaxBatchBytes = 64 << 20
+
+// NDJSON is the media type of newline delimited JSON, one JSON value per line.
+const NDJSON = "application/x-ndjson"
+
+// ErrNotArray is returned for a JSON batch which isn't an array.
+var ErrNotArray = errors.New("body must be a JSON array")
+
+// ItemError is the error of a single item of a batch: Index counts the items from 0,
+// and Line is the line of the body the item starts on, from 1. Err is one of the
+// errors of Read, such as a *TypeError, and a *TooLargeError for an item larger than
+// the MaxItemBytes limit.
+type ItemError struct {
+	Index int
+	Line  int
+	Err   error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("item %d (line %d): %v", e.Index, e.Line, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// TooManyItemsError is returned for a batch with more than Limit items.
+type TooManyItemsError struct {
+	Limit int
+}
+
+func (e *TooManyItemsError) Error() string {
+	return fmt.Sprintf("body must not contain more than %d items", e.Limit)
+}
+
+// MaxItemBytes sets the largest item of a batch, DefaultMaxBytes by default. An item
+// of a JSON array which is larger ends the batch with a *TooLargeError, as the
+// decoder can't skip it without reading it whole.
+func MaxItemBytes(n int64) Option {
+	return func(o *options) { o.maxItemBytes = n }
+}
+
+// MaxItems sets the largest number of items of a batch, which is unlimited by
+// default.
+func MaxItems(n int) Option {
+	return func(o *options) { o.maxItems = n }
+}
+
+// BatchReader decodes the items of a batch one at a time, without holding the batch
+// in memory. A batch is either NDJSON or a JSON array.
+//
+// An item which can't be decoded doesn't stop the batch: Next reports it with an
+// *ItemError and the following items can still be read. Any other error, such as a
+// *SyntaxError in a JSON array or a *TooLargeError for the batch as a whole, ends it,
+// and Index and Line then locate the item it stopped at. A JSON array is walked with
+// a json.Decoder, which can't go past an item which is badly-formed, so such an item
+// ends the batch where a line of NDJSON would be skipped.
+type BatchReader struct {
+	opts  options
+	index int
+	err   error
+
+	// itemIndex and itemLine locate the last item read.
+	itemIndex, itemLine int
+
+	// lines reads an NDJSON batch, line is the line it is at and truncated is set
+	// when the last line was too long to be kept whole.
+	lines     *bufio.Reader
+	line      int
+	truncated bool
+
+	// dec walks a JSON array read through array, and started is set once its [ is
+	// read.
+	dec     *json.Decoder
+	array   *itemReader
+	started bool
+}
+
+// NewBatchReader reads the batch in r, NDJSON if ndjson is set and a JSON array
+// otherwise. The batch is limited to DefaultMaxBatchBytes unless MaxBytes says
+// otherwise.
+func NewBatchReader(r io.Reader, ndjson bool, opts ...Option) *BatchReader {
+	o := newOptions(append([]Option{MaxBytes(DefaultMaxBatchBytes)}, opts...))
+	body := &limitedReader{r: r, remaining: o.maxBytes, limit: o.maxBytes}
+
+	if ndjson {
+		return &BatchReader{opts: o, lines: bufio.NewReader(body)}
+	}
+
+	array := &itemReader{r: body, limit: o.maxItemBytes}
+	return &BatchReader{opts: o, dec: json.NewDecoder(array), array: array}
+}
+
+// ReadBatch reads the batch in the request body, which is NDJSON or a JSON array
+// according to its Content-Type.
+func ReadBatch(r *http.Request, opts ...Option) (*BatchReader, error) {
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case mediaType == NDJSON:
+		return NewBatchReader(r.Body, true, opts...), nil
+	case IsJSON(contentType):
+		return NewBatchReader(r.Body, false, opts...), nil
+	default:
+		return nil, &ContentTypeError{ContentType: contentType, Allowed: []string{"application/json", NDJSON}}
+	}
+}
+
+// Next decodes the next item into dst, which must be a non-nil pointer. It returns
+// io.EOF after the last item, an *ItemError when the item is skipped, and any other
+// error when the batch can't be read any further.
+func (b *BatchReader) Next(dst interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+
+	var item []byte
+	var line int
+	var err error
+	if b.lines != nil {
+		item, line, err = b.nextLine()
+	} else {
+		item, line, err = b.nextElement()
+	}
+	if err != nil {
+		if err != io.EOF {
+			b.itemIndex, b.itemLine = b.index, line
+		}
+		b.err = err
+		return err
+	}
+
+	if b.opts.maxItems > 0 && b.index >= b.opts.maxItems {
+		b.err = &TooManyItemsError{Limit: b.opts.maxItems}
+		return b.err
+	}
+	index := b.index
+	b.index++
+	b.itemIndex, b.itemLine = index, line
+
+	if b.truncated || b.opts.maxItemBytes > 0 && int64(len(item)) > b.opts.maxItemBytes {
+		return &ItemError{Index: index, Line: line, Err: &TooLargeError{Limit: b.opts.maxItemBytes}}
+	}
+
+	if err := decode(item, dst, b.opts); err != nil {
+		return &ItemError{Index: index, Line: line, Err: err}
+	}
+	return nil
+}
+
+// Index returns the index of the last item read by Next, from 0, or of the item the
+// batch stopped at.
+func (b *BatchReader) Index() int {
+	return b.itemIndex
+}
+
+// Line returns the line of the body the last item read by Next starts on, from 1, or
+// the line the batch stopped at.
+func (b *BatchReader) Line() int {
+	return b.itemLine
+}
+
+// nextLine returns the next line which isn't blank, and its line number.
+func (b *BatchReader) nextLine() ([]byte, int, error) {
+	for {
+		line, err := b.readLine()
+		if err != nil && !(err == io.EOF && len(line) > 0) {
+			return nil, b.line + 1, err
+		}
+
+		b.line++
+		if line = bytes.TrimSpace(line); len(line) > 0 || b.truncated {
+			return line, b.line, nil
+		}
+	}
+}
+
+// readLine reads up to the next newline. Once a line is longer than an item can be
+// the rest of it is dropped, and truncated is set for Next to report it as too large.
+func (b *BatchReader) readLine() ([]byte, error) {
+	var line []byte
+	b.truncated = false
+	for {
+		chunk, err := b.lines.ReadSlice('\n')
+		if b.opts.maxItemBytes > 0 && int64(len(line)+len(chunk)) > b.opts.maxItemBytes+2 {
+			b.truncated = true
+		} else {
+			line = append(line, chunk...)
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// nextElement returns the next element of the array, and the line it starts on.
+func (b *BatchReader) nextElement() ([]byte, int, error) {
+	b.array.reset()
+
+	if !b.started {
+		tok, err := b.dec.Token()
+		if err == io.EOF {
+			return nil, 1, ErrEmptyBody
+		}
+		if err != nil {
+			return b.arrayError(err)
+		}
+		if tok != json.Delim('[') {
+			return nil, b.array.line(0), ErrNotArray
+		}
+		b.started = true
+	}
+
+	if !b.dec.More() {
+		// The closing bracket, then nothing but whitespace.
+		if _, err := b.dec.Token(); err != nil {
+			return b.arrayError(err)
+		}
+		switch _, err := b.dec.Token(); {
+		case err == io.EOF:
+			return nil, 0, io.EOF
+		case errors.As(err, new(*TooLargeError)):
+			return nil, b.array.line(b.dec.InputOffset()), err
+		default:
+			return nil, b.array.line(b.dec.InputOffset()), ErrMultipleValues
+		}
+	}
+
+	var item json.RawMessage
+	if err := b.dec.Decode(&item); err != nil {
+		return b.arrayError(err)
+	}
+
+	return item, b.array.line(b.dec.InputOffset() - int64(len(item))), nil
+}
+
+// arrayError turns an error of the decoder into one of jsonio, along with the line
+// it is on. The decoder doesn't tell where in an item a syntax error is, so it is
+// reported where the item starts.
+func (b *BatchReader) arrayError(err error) ([]byte, int, error) {
+	at := b.array.itemStart(b.dec.InputOffset())
+
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		at = b.array.offset
+		err = &SyntaxError{Offset: at}
+	case err == errItemTooLarge:
+		err = &TooLargeError{Limit: b.opts.maxItemBytes}
+	case errors.As(err, new(*json.SyntaxError)):
+		err = &SyntaxError{Offset: at}
+	}
+	return nil, b.array.line(at), err
+}
+
+// errItemTooLarge is returned by an itemReader which reached its limit.
+var errItemTooLarge = errors.New("jsonio: item too large")
+
+// itemSlack is what an itemReader reads on top of its limit.
+const itemSlack = 64
+
+// itemReader reads a JSON array for the decoder, and keeps it from reading more than
+// limit bytes, plus itemSlack for the separator and the indentation, between two
+// resets. It keeps the bytes it read which line hasn't passed yet, so that the
+// lines and the items can be told apart without the help of the decoder.
+type itemReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+	offset    int64
+
+	// window holds the bytes from the offset start on, and passed counts the lines
+	// before start.
+	window []byte
+	start  int64
+	passed int
+}
+
+// reset allows another item to be read.
+func (ir *itemReader) reset() {
+	ir.remaining = ir.limit + itemSlack
+}
+
+func (ir *itemReader) Read(p []byte) (int, error) {
+	if ir.limit > 0 {
+		if ir.remaining <= 0 {
+			return 0, errItemTooLarge
+		}
+		if int64(len(p)) > ir.remaining {
+			p = p[:ir.remaining]
+		}
+	}
+
+	n, err := ir.r.Read(p)
+	ir.window = append(ir.window, p[:n]...)
+	ir.offset += int64(n)
+	ir.remaining -= int64(n)
+	return n, err
+}
+
+// line returns the line the byte at offset is on, from 1. The bytes before offset
+// are dropped, so offset must not be before the one of a previous call.
+func (ir *itemReader) line(offset int64) int {
+	n := int(offset - ir.start)
+	switch {
+	case n < 0:
+		n = 0
+	case n > len(ir.window):
+		n = len(ir.window)
+	}
+	ir.passed += bytes.Count(ir.window[:n], []byte{'\n'})
+	ir.window = ir.window[n:]
+	ir.start += int64(n)
+	return ir.passed + 1
+}
+
+// itemStart returns the offset of the first byte from offset on which is neither
+// whitespace nor the comma in between two items.
+func (ir *itemReader) itemStart(offset int64) int64 {
+	i := int(offset - ir.start)
+	for i >= 0 && i < len(ir.window) && (isSpace(ir.window[i]) || ir.window[i] == ',') {
+		i++
+	}
+	return ir.start + int64(i)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,219 @@
+package jsonio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readAll reads a batch, describing every item as the title it decoded to or the
+// error it was skipped with.
+func readAll(b *BatchReader) ([]string, error) {
+	var items []string
+	for {
+		var m movie
+		err := b.Next(&m)
+
+		var itemErr *ItemError
+		switch {
+		case err == io.EOF:
+			return items, nil
+		case errors.As(err, &itemErr):
+			items = append(items, fmt.Sprintf("%d@%d: %v", itemErr.Index, itemErr.Line, itemErr.Err))
+		case err != nil:
+			return items, err
+		default:
+			items = append(items, m.Title)
+		}
+	}
+}
+
+func TestBatchReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		ndjson bool
+		body   string
+		opts   []Option
+		want   []string
+		err    error
+	}{
+		{
+			name:   "ndjson",
+			ndjson: true,
+			body:   "{\"title\": \"Moana\"}\n\n  \r\n{\"title\": 1}\n{\"rating\": 5}\n{\"title\": \"Up\"} {}\r\n{\"title\":\n{\"title\": \"Cars\"}",
+			want: []string{
+				"Moana",
+				`1@4: body contains incorrect JSON type for field "title"`,
+				`2@5: body contains unknown key "rating"`,
+				"3@6: body must only contain a single JSON value",
+				"4@7: body contains badly-formed JSON",
+				"Cars",
+			},
+		},
+		{
+			name:   "ndjson too large item",
+			ndjson: true,
+			body:   `{"title": "` + strings.Repeat("a", 10000) + "\"}\n{\"title\": \"Up\"}\n",
+			opts:   []Option{MaxItemBytes(100)},
+			want:   []string{"0@1: body must not be larger than 100 bytes", "Up"},
+		},
+		{
+			name:   "ndjson too large batch",
+			ndjson: true,
+			body:   strings.Repeat("{\"title\": \"Up\"}\n", 10),
+			opts:   []Option{MaxBytes(40)},
+			want:   []string{"Up", "Up"},
+			err:    &TooLargeError{Limit: 40},
+		},
+		{
+			name: "array",
+			body: "[\n  {\"title\": \"Moana\"},\n  {\"title\": 1},\n\n  {\"rating\": 5}, {\"title\": \"Up\"}\n]\n",
+			want: []string{
+				"Moana",
+				`1@3: body contains incorrect JSON type for field "title"`,
+				`2@5: body contains unknown key "rating"`,
+				"Up",
+			},
+		},
+		{
+			name: "empty array",
+			body: " [] ",
+		},
+		{
+			name: "array too large item",
+			body: "[{\"title\": \"Up\"},\n" + `{"title": "` + strings.Repeat("a", 200) + `"}, {"title": "Up"}]`,
+			opts: []Option{MaxItemBytes(100)},
+			want: []string{"Up"},
+			err:  &TooLargeError{Limit: 100},
+		},
+		{
+			name: "array with brackets in strings",
+			body: "[{\"title\": \"]}\\\"\"},\n\"Up\", 42, {\"title\": \"Up\"}]",
+			want: []string{
+				"]}\"",
+				"1@2: body contains incorrect JSON type (at character 4)",
+				"2@2: body contains incorrect JSON type (at character 2)",
+				"Up",
+			},
+		},
+		{
+			name: "array badly-formed item",
+			body: `[{"title": "Up"}, {"title": "Up",}, {"title": "Up"}]`,
+			want: []string{"Up"},
+			err:  &SyntaxError{Offset: 18},
+		},
+		{
+			name: "array missing item",
+			body: `[{"title": "Up"}, ]`,
+			want: []string{"Up"},
+			err:  &SyntaxError{Offset: 18},
+		},
+		{
+			name: "too many items",
+			body: `[{"title": "Up"}, {"title": "Up"}, {"title": "Up"}]`,
+			opts: []Option{MaxItems(2)},
+			want: []string{"Up", "Up"},
+			err:  &TooManyItemsError{Limit: 2},
+		},
+		{
+			name: "not an array",
+			body: `{"title": "Up"}`,
+			err:  ErrNotArray,
+		},
+		{
+			name: "empty",
+			body: ``,
+			err:  ErrEmptyBody,
+		},
+		{
+			name: "unterminated array",
+			body: `[{"title": "Up"}`,
+			want: []string{"Up"},
+			err:  &SyntaxError{Offset: 16},
+		},
+		{
+			name: "broken array",
+			body: `[{"title": "Up"} {"title": "Up"}]`,
+			want: []string{"Up"},
+			err:  &SyntaxError{Offset: 17},
+		},
+		{
+			name: "after the array",
+			body: `[{"title": "Up"}] []`,
+			want: []string{"Up"},
+			err:  ErrMultipleValues,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := readAll(NewBatchReader(strings.NewReader(tt.body), tt.ndjson, tt.opts...))
+
+			if !reflect.DeepEqual(err, tt.err) {
+				t.Errorf("got error %#v; want %#v", err, tt.err)
+			}
+			if strings.Join(items, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got items\n%s\nwant\n%s", strings.Join(items, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestBatchReaderStop(t *testing.T) {
+	tests := []struct {
+		ndjson      bool
+		body        string
+		opts        []Option
+		index, line int
+	}{
+		{false, "[\n  {\"title\": \"Up\"},\n  {\"title\": 1},\n\n  {\"title\" \"Up\"}\n]", nil, 2, 5},
+		{false, "[\n  {\"title\": \"Up\"},\n  {\"title\": \"" + strings.Repeat("a", 200) + "\"}\n]", []Option{MaxItemBytes(100)}, 1, 3},
+		{true, "{\"title\": \"Up\"}\n{\"title\": \"Up\"}\n{\"title\": \"Up\"}\n", []Option{MaxBytes(40)}, 2, 3},
+	}
+
+	for _, tt := range tests {
+		b := NewBatchReader(strings.NewReader(tt.body), tt.ndjson, tt.opts...)
+		_, err := readAll(b)
+		if err == nil {
+			t.Fatalf("%q: got no error", tt.body)
+		}
+		if b.Index() != tt.index || b.Line() != tt.line {
+			t.Errorf("%q: stopped at item %d on line %d; want item %d on line %d", tt.body, b.Index(), b.Line(), tt.index, tt.line)
+		}
+	}
+}
+
+func TestReadBatch(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/x-ndjson", "{\"title\": \"Up\"}\n", "Up"},
+		{"application/json; charset=utf-8", `[{"title": "Up"}]`, "Up"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+
+		b, err := ReadBatch(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.contentType, err)
+		}
+		if items, err := readAll(b); err != nil || len(items) != 1 || items[0] != tt.want {
+			t.Errorf("%s: got %v and %v; want [%s]", tt.contentType, items, err, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(""))
+	r.Header.Set("Content-Type", "text/csv")
+	if _, err := ReadBatch(r); !errors.As(err, new(*ContentTypeError)) {
+		t.Errorf("got %v; want a *ContentTypeError", err)
+	}
+}
@@ -0,0 +1,337 @@
+// Package jsonio reads JSON request bodies and writes JSON responses for the services
+// of the workshop.
+//
+// Read decodes a body into a Go value and turns the many ways it can fail into
+// errors which can be told apart with errors.As and errors.Is, so that callers don't
+// have to match error strings:
+//
+//	*SyntaxError         the body isn't valid JSON
+//	*TypeError           a JSON value doesn't fit the Go value it's decoded into
+//	*UnknownFieldError   the body has a key the Go struct doesn't
+//	*TooLargeError       the body is larger than the limit
+//	*ContentTypeError    the body isn't sent as JSON, when RequireContentType is set
+//	ErrEmptyBody         there is no body
+//	ErrMultipleValues    there is something after the JSON value
+//
+// Their messages are fit to be sent to the client.
+//
+// ReadBatch streams the items of a large body, NDJSON or a JSON array, see
+// BatchReader. StreamWriter does the same the other way, for large responses.
+//
+// ReadPatch applies a JSON Merge Patch or a JSON Patch to a resource, and decodes the
+// result as Read would decode a body.
+package jsonio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxBytes is the largest body Read accepts unless told otherwise, 1MB.
+const DefaultMaxBytes = 1_048_576
+
+// Envelope wraps the data of a response under a key, as in {"user": {...}}, which
+// makes the responses self-documenting and leaves room for other keys.
+type Envelope map[string]interface{}
+
+var (
+	ErrEmptyBody      = errors.New("body must not be empty")
+	ErrMultipleValues = errors.New("body must only contain a single JSON value")
+)
+
+// SyntaxError is returned for a body which isn't valid JSON. Offset is the number of
+// bytes read before the error, or 0 when the body ended too early.
+type SyntaxError struct {
+	Offset int64
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Offset == 0 {
+		return "body contains badly-formed JSON"
+	}
+	return fmt.Sprintf("body contains badly-formed JSON (at character %d)", e.Offset)
+}
+
+// TypeError is returned when a JSON value has the wrong type for the Go value it is
+// decoded into. Field is the path of the field, as in "address.city", if known.
+type TypeError struct {
+	Field  string
+	Offset int64
+}
+
+func (e *TypeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("body contains incorrect JSON type for field %q", e.Field)
+	}
+	return fmt.Sprintf("body contains incorrect JSON type (at character %d)", e.Offset)
+}
+
+// UnknownFieldError is returned for a key which doesn't match any field of the Go
+// struct, unless AllowUnknownFields is set.
+type UnknownFieldError struct {
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("body contains unknown key %q", e.Field)
+}
+
+// TooLargeError is returned for a body larger than Limit bytes.
+type TooLargeError struct {
+	Limit int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("body must not be larger than %d bytes", e.Limit)
+}
+
+// ContentTypeError is returned for a body whose Content-Type isn't one of the Allowed
+// media types, by Read when RequireContentType is set and by ReadBatch.
+type ContentTypeError struct {
+	ContentType string
+	Allowed     []string
+}
+
+func (e *ContentTypeError) Error() string {
+	allowed := strings.Join(e.Allowed, " or ")
+	if e.ContentType == "" {
+		return fmt.Sprintf("body must be sent with a Content-Type of %s", allowed)
+	}
+	return fmt.Sprintf("body must be sent as %s, not %s", allowed, e.ContentType)
+}
+
+type options struct {
+	maxBytes           int64
+	maxItemBytes       int64
+	maxItems           int
+	allowUnknownFields bool
+	requireContentType bool
+	check              func(data []byte) error
+}
+
+// Option changes how Read, ReadBody and the batch readers treat a body.
+type Option func(*options)
+
+// MaxBytes sets the largest body accepted, DefaultMaxBytes by default, or
+// DefaultMaxBatchBytes for a batch. A limit of 0 or less removes it, which is only
+// meant for trusted input such as a file given on the command line.
+func MaxBytes(n int64) Option {
+	return func(o *options) { o.maxBytes = n }
+}
+
+// AllowUnknownFields ignores the keys which don't match any field, instead of
+// rejecting the body.
+func AllowUnknownFields() Option {
+	return func(o *options) { o.allowUnknownFields = true }
+}
+
+// RequireContentType rejects the bodies which aren't sent as JSON.
+func RequireContentType() Option {
+	return func(o *options) { o.requireContentType = true }
+}
+
+// Check has Read and Decode call fn with the JSON of the body before decoding it, and
+// return its error, for example to check the body against a schema. fn is only called
+// with a single JSON value, the other bodies get the errors of Read. The formats of the
+// negotiate package are decoded through JSON, which is then what fn is given.
+func Check(fn func(data []byte) error) Option {
+	return func(o *options) { o.check = fn }
+}
+
+func newOptions(opts []Option) options {
+	o := options{maxBytes: DefaultMaxBytes, maxItemBytes: DefaultMaxBytes}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// IsJSON reports whether a media type, such as the Content-Type of a request, is
+// application/json or a JSON based type such as application/merge-patch+json.
+func IsJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")
+}
+
+// Read decodes the request body, a single JSON value, into dst, which must be a
+// non-nil pointer.
+func Read(r *http.Request, dst interface{}, opts ...Option) error {
+	o := newOptions(opts)
+
+	if o.requireContentType && !IsJSON(r.Header.Get("Content-Type")) {
+		return &ContentTypeError{ContentType: r.Header.Get("Content-Type"), Allowed: []string{"application/json"}}
+	}
+
+	body := &limitedReader{r: r.Body, remaining: o.maxBytes, limit: o.maxBytes}
+
+	// fn needs the whole body, which can't be streamed into the decoder then.
+	if o.check != nil {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		return decode(data, dst, o)
+	}
+
+	// DisallowUnknownFields makes the decoder fail on the keys which can't be mapped
+	// to the destination, instead of silently dropping them.
+	dec := json.NewDecoder(body)
+	if !o.allowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+
+	// Decode again: a body holding a single JSON value ends here, with io.EOF.
+	switch err := dec.Decode(&struct{}{}); {
+	case err == io.EOF:
+		return nil
+	case errors.As(err, new(*TooLargeError)):
+		return err
+	default:
+		return ErrMultipleValues
+	}
+}
+
+// ReadBody returns the request body, for the callers which need its bytes, with the
+// limit and content type checks of Read.
+func ReadBody(r *http.Request, opts ...Option) ([]byte, error) {
+	o := newOptions(opts)
+
+	if o.requireContentType && !IsJSON(r.Header.Get("Content-Type")) {
+		return nil, &ContentTypeError{ContentType: r.Header.Get("Content-Type"), Allowed: []string{"application/json"}}
+	}
+	return io.ReadAll(&limitedReader{r: r.Body, remaining: o.maxBytes, limit: o.maxBytes})
+}
+
+// Decode decodes data, a single JSON value, into dst, which must be a non-nil
+// pointer. It returns the errors of Read, and takes its options but for MaxBytes and
+// RequireContentType, which are about request bodies.
+func Decode(data []byte, dst interface{}, opts ...Option) error {
+	return decode(data, dst, newOptions(opts))
+}
+
+func decode(data []byte, dst interface{}, o options) error {
+	if o.check != nil && json.Valid(data) {
+		if err := o.check(data); err != nil {
+			return err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if !o.allowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+	if dec.Decode(&struct{}{}) != io.EOF {
+		return ErrMultipleValues
+	}
+	return nil
+}
+
+// decodeError triages the errors of json.Decoder.Decode.
+func decodeError(err error) error {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var invalidUnmarshalError *json.InvalidUnmarshalError
+	var tooLargeError *TooLargeError
+
+	switch {
+	case errors.As(err, &tooLargeError):
+		return err
+
+	case errors.As(err, &syntaxError):
+		return &SyntaxError{Offset: syntaxError.Offset}
+
+	// Decode may also return io.ErrUnexpectedEOF for syntax errors, see
+	// https://github.com/golang/go/issues/25956.
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &SyntaxError{}
+
+	case errors.As(err, &unmarshalTypeError):
+		return &TypeError{Field: unmarshalTypeError.Field, Offset: unmarshalTypeError.Offset}
+
+	case errors.Is(err, io.EOF):
+		return ErrEmptyBody
+
+	// The unknown fields have no error type of their own, see
+	// https://github.com/golang/go/issues/29035, so this is the one place where we
+	// look at the message.
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return &UnknownFieldError{Field: strings.Trim(field, `"`)}
+
+	// A destination which isn't a non-nil pointer is a bug of the caller, not a
+	// problem with the body.
+	case errors.As(err, &invalidUnmarshalError):
+		panic(err)
+
+	default:
+		return err
+	}
+}
+
+// limitedReader reads up to limit bytes and fails with a *TooLargeError when there
+// are more.
+type limitedReader struct {
+	r                io.Reader
+	remaining, limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.r.Read(p)
+	}
+	if l.remaining < 0 {
+		return 0, &TooLargeError{Limit: l.limit}
+	}
+
+	// Read one byte more than is left, to find out whether the body goes on.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+
+	if l.remaining < 0 {
+		return n + int(l.remaining), &TooLargeError{Limit: l.limit}
+	}
+	return n, err
+}
+
+// Write sends data as JSON with the status code and the headers. The Content-Type is
+// application/json unless headers set another one, such as application/problem+json.
+func Write(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	// Append a newline to make it easier to view in terminal applications.
+	js = append(js, '\n')
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	w.WriteHeader(status)
+	w.Write(js)
+	return nil
+}
@@ -0,0 +1,151 @@
+package jsonio
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type movie struct {
+	Title  string   `json:"title"`
+	Year   int32    `json:"year"`
+	Genres []string `json:"genres"`
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		opts        []Option
+		want        error
+	}{
+		{name: "valid", body: `{"title": "Moana", "year": 2016}`},
+		{name: "empty", body: ``, want: ErrEmptyBody},
+		{name: "syntax", body: `{"title": "Moana",}`, want: &SyntaxError{Offset: 19}},
+		{name: "truncated", body: `{"title": "Moana"`, want: &SyntaxError{}},
+		{name: "wrong type", body: `{"year": "2016"}`, want: &TypeError{Field: "year", Offset: 15}},
+		{name: "wrong type at", body: `["Moana"]`, want: &TypeError{Offset: 1}},
+		{name: "unknown field", body: `{"rating": 5}`, want: &UnknownFieldError{Field: "rating"}},
+		{name: "unknown field allowed", body: `{"rating": 5}`, opts: []Option{AllowUnknownFields()}},
+		{name: "multiple values", body: `{}{}`, want: ErrMultipleValues},
+		{name: "too large", body: `{"title": "` + strings.Repeat("a", 100) + `"}`, opts: []Option{MaxBytes(64)}, want: &TooLargeError{Limit: 64}},
+		{name: "too large after the value", body: `{}` + strings.Repeat(" ", 100) + `{}`, opts: []Option{MaxBytes(64)}, want: &TooLargeError{Limit: 64}},
+		{name: "exactly the limit", body: `{"title": "abc"}`, opts: []Option{MaxBytes(16)}},
+		{name: "content type", body: `{}`, contentType: "application/json; charset=utf-8", opts: []Option{RequireContentType()}},
+		{name: "json suffix", body: `{}`, contentType: "application/merge-patch+json", opts: []Option{RequireContentType()}},
+		{name: "wrong content type", body: `{}`, contentType: "text/plain", opts: []Option{RequireContentType()}, want: &ContentTypeError{ContentType: "text/plain", Allowed: []string{"application/json"}}},
+		{name: "missing content type", body: `{}`, opts: []Option{RequireContentType()}, want: &ContentTypeError{Allowed: []string{"application/json"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			var m movie
+			err := Read(r, &m, tt.opts...)
+
+			if !reflect.DeepEqual(err, tt.want) {
+				t.Errorf("got error %#v; want %#v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadErrorTypes(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"title": 1}`))
+
+	err := Read(r, &movie{})
+
+	var typeError *TypeError
+	if !errors.As(err, &typeError) || typeError.Field != "title" {
+		t.Fatalf("got %v; want a *TypeError for title", err)
+	}
+	if err.Error() != `body contains incorrect JSON type for field "title"` {
+		t.Errorf("got message %q", err)
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 10)))
+	if b, err := ReadBody(r, MaxBytes(10)); err != nil || len(b) != 10 {
+		t.Errorf("got %d bytes and %v; want the 10 bytes", len(b), err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 11)))
+	if _, err := ReadBody(r, MaxBytes(10)); !errors.As(err, new(*TooLargeError)) {
+		t.Errorf("got %v; want a *TooLargeError", err)
+	}
+}
+
+func TestReadCheck(t *testing.T) {
+	errRejected := errors.New("rejected")
+	var checked []string
+	check := Check(func(data []byte) error {
+		checked = append(checked, string(data))
+		if strings.Contains(string(data), "Cars 2") {
+			return errRejected
+		}
+		return nil
+	})
+
+	tests := []struct {
+		body string
+		want error
+	}{
+		{`{"title": "Moana"}`, nil},
+		{`{"title": "Cars 2"}`, errRejected},
+		{`{"title": "Cars 2",}`, &SyntaxError{Offset: 20}},
+		{``, ErrEmptyBody},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		var m movie
+		if err := Read(r, &m, check); !reflect.DeepEqual(err, tt.want) {
+			t.Errorf("Read(%q) = %v; want %v", tt.body, err, tt.want)
+		}
+	}
+
+	// Only the single JSON values are checked.
+	if want := []string{`{"title": "Moana"}`, `{"title": "Cars 2"}`}; !reflect.DeepEqual(checked, want) {
+		t.Errorf("checked %q; want %q", checked, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rr := httptest.NewRecorder()
+	err := Write(rr, http.StatusCreated, Envelope{"movie": movie{Title: "Moana"}}, http.Header{"Location": {"/movies/1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusCreated)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q; want application/json", got)
+	}
+	if got := rr.Header().Get("Location"); got != "/movies/1" {
+		t.Errorf("got Location %q; want /movies/1", got)
+	}
+	if want := `{"movie":{"title":"Moana","year":0,"genres":null}}` + "\n"; rr.Body.String() != want {
+		t.Errorf("got body %q; want %q", rr.Body, want)
+	}
+
+	rr = httptest.NewRecorder()
+	Write(rr, http.StatusBadRequest, Envelope{}, http.Header{"Content-Type": {"application/problem+json"}})
+	if got := rr.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("got Content-Type %q; want the one from the headers", got)
+	}
+
+	if err := Write(httptest.NewRecorder(), http.StatusOK, make(chan int), nil); err == nil {
+		t.Error("got no error for a value which can't be encoded")
+	}
+}
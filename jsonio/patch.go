@@ -0,0 +1,494 @@
+package jsonio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The media types of the patch documents ReadPatch applies.
+const (
+	MergePatch = "application/merge-patch+json"
+	JSONPatch  = "application/json-patch+json"
+)
+
+var (
+	// ErrPathNotFound is the error of a JSON Patch operation whose path, or from,
+	// doesn't exist in the document.
+	ErrPathNotFound = errors.New("path does not exist")
+
+	// ErrTestFailed is the error of a JSON Patch test operation whose value doesn't
+	// match the document.
+	ErrTestFailed = errors.New("test failed")
+)
+
+// PatchError is returned for a JSON Patch operation which can't be applied. Index
+// counts the operations from 0. Err is ErrPathNotFound or ErrTestFailed when the
+// patch doesn't fit the document, and describes the operation otherwise.
+type PatchError struct {
+	Index int
+	Op    string
+	Path  string
+	Err   error
+}
+
+func (e *PatchError) Error() string {
+	if e.Op == "" {
+		return fmt.Sprintf("patch operation %d: %v", e.Index, e.Err)
+	}
+	return fmt.Sprintf("patch operation %d (%s %s): %v", e.Index, e.Op, e.Path, e.Err)
+}
+
+func (e *PatchError) Unwrap() error {
+	return e.Err
+}
+
+// IsPatch reports whether a Content-Type is one of the patch documents of ReadPatch.
+func IsPatch(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == MergePatch || mediaType == JSONPatch
+}
+
+// ReadPatch applies the patch in the request body to the JSON form of current, the
+// resource as it is, and decodes the result into dst, which must be a non-nil
+// pointer. The body is a JSON Merge Patch (RFC 7386) or a JSON Patch (RFC 6902)
+// according to its Content-Type; a *ContentTypeError is returned for any other. The
+// options are those of Read, and the patch is read and decoded as a body would be.
+func ReadPatch(r *http.Request, current, dst interface{}, opts ...Option) error {
+	contentType := r.Header.Get("Content-Type")
+	if !IsPatch(contentType) {
+		return &ContentTypeError{ContentType: contentType, Allowed: []string{MergePatch, JSONPatch}}
+	}
+
+	patch, err := ReadBody(r, opts...)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == MergePatch {
+		doc, err = ApplyMergePatch(doc, patch)
+	} else {
+		doc, err = ApplyPatch(doc, patch)
+	}
+	if err != nil {
+		return err
+	}
+
+	return Decode(doc, dst, opts...)
+}
+
+// ApplyMergePatch applies a JSON Merge Patch to doc: the members of an object patch
+// replace those of the document, recursively, and the members set to null are
+// removed. A patch which isn't an object replaces the whole document.
+func ApplyMergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decodeValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeValue(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+	return t
+}
+
+// patchOperation is an operation of a JSON Patch. The members are pointers, to tell
+// the missing ones apart, but for Value which is empty when missing and holds null
+// when it is null.
+type patchOperation struct {
+	Op    *string         `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ApplyPatch applies a JSON Patch, an array of add, remove, replace, move, copy and
+// test operations, to doc. The operations are applied in order, and none of them is
+// when one fails.
+func ApplyPatch(doc, patch []byte) ([]byte, error) {
+	target, err := decodeValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(patch); len(trimmed) > 0 && trimmed[0] != '[' {
+		return nil, ErrNotArray
+	}
+
+	// The members an operation doesn't define are ignored, as RFC 6902 requires.
+	var ops []patchOperation
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	if err := dec.Decode(&ops); err != nil {
+		return nil, decodeError(err)
+	}
+	if dec.Decode(&struct{}{}) != io.EOF {
+		return nil, ErrMultipleValues
+	}
+
+	for i, op := range ops {
+		target, err = applyOperation(target, op)
+		if err != nil {
+			e := &PatchError{Index: i, Err: err}
+			if op.Op != nil {
+				e.Op = *op.Op
+			}
+			if op.Path != nil {
+				e.Path = *op.Path
+			}
+			return nil, e
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+func applyOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	if op.Op == nil {
+		return nil, errors.New(`missing "op"`)
+	}
+	if op.Path == nil {
+		return nil, errors.New(`missing "path"`)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch *op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, errors.New(`missing "value"`)
+		}
+		if value, err = decodeValue(op.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	var from []string
+	switch *op.Op {
+	case "move", "copy":
+		if op.From == nil {
+			return nil, errors.New(`missing "from"`)
+		}
+		if from, err = parsePointer(*op.From); err != nil {
+			return nil, err
+		}
+	}
+
+	switch *op.Op {
+	case "add":
+		return addValue(doc, path, value)
+
+	case "remove":
+		doc, _, err = removeValue(doc, path)
+		return doc, err
+
+	case "replace":
+		if _, err := getValue(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, _, err = removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+
+	case "move":
+		if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+			return nil, errors.New("a value can't be moved into itself")
+		}
+		doc, value, err = removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+
+	case "copy":
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopy(value))
+
+	case "test":
+		current, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(current, value) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+
+	default:
+		return nil, fmt.Errorf("unknown op %q", *op.Op)
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens. The empty
+// pointer refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = pointerUnescaper.Replace(token)
+	}
+	return tokens, nil
+}
+
+// pointerUnescaper turns ~1 back into / and ~0 into ~, in that order.
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// arrayIndex returns the index an array token refers to, which must be below max.
+func arrayIndex(token string, max int) (int, error) {
+	if token == "" || len(token) > 1 && token[0] == '0' || strings.TrimLeft(token, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i >= max {
+		return 0, ErrPathNotFound
+	}
+	return i, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, ErrPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+// addValue returns doc with value added at path: set in an object, or inserted in an
+// array, at its end for the index "-".
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token := path[0]
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			node[token] = value
+			return node, nil
+		}
+		child, ok := node[token]
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+		child, err := addValue(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = child
+		return node, nil
+
+	case []interface{}:
+		if len(path) == 1 {
+			i := len(node)
+			if token != "-" {
+				var err error
+				if i, err = arrayIndex(token, len(node)+1); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		i, err := arrayIndex(token, len(node))
+		if err != nil {
+			return nil, err
+		}
+		child, err := addValue(node[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+
+	default:
+		return nil, ErrPathNotFound
+	}
+}
+
+// removeValue returns doc without the value at path, and that value.
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("the whole document can't be removed")
+	}
+	token := path[0]
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !ok {
+			return nil, nil, ErrPathNotFound
+		}
+		if len(path) == 1 {
+			delete(node, token)
+			return node, child, nil
+		}
+		child, removed, err := removeValue(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[token] = child
+		return node, removed, nil
+
+	case []interface{}:
+		i, err := arrayIndex(token, len(node))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := node[i]
+			return append(node[:i], node[i+1:]...), removed, nil
+		}
+		child, removed, err := removeValue(node[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[i] = child
+		return node, removed, nil
+
+	default:
+		return nil, nil, ErrPathNotFound
+	}
+}
+
+// decodeValue decodes a JSON value, keeping its numbers as they are written.
+func decodeValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, decodeError(err)
+	}
+	if dec.Decode(&struct{}{}) != io.EOF {
+		return nil, ErrMultipleValues
+	}
+	return v, nil
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = deepCopy(value)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, value := range v {
+			list[i] = deepCopy(value)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+// jsonEqual reports whether two JSON values are equal, the numbers by their value
+// rather than how they are written.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,188 @@
+package jsonio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sameJSON reports whether two JSON documents hold the same value.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatalf("%s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// The examples of RFC 7386, appendix A.
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, tt := range tests {
+		got, err := ApplyMergePatch([]byte(tt.doc), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("%s + %s: %v", tt.doc, tt.patch, err)
+			continue
+		}
+		if !sameJSON(t, got, []byte(tt.want)) {
+			t.Errorf("%s + %s = %s; want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+
+	if _, err := ApplyMergePatch([]byte(`{}`), []byte(`{"a":`)); !errors.As(err, new(*SyntaxError)) {
+		t.Errorf("got %v for a broken patch; want a *SyntaxError", err)
+	}
+}
+
+// Most of the examples of RFC 6902, appendix A.
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{
+			`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`, `{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`},
+		{`{"foo":null}`, `[{"op":"test","path":"/foo","value":null}]`, `{"foo":null}`},
+		{`{"a":{"b":[1]}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b/0","value":0}]`, `{"a":{"b":[1]},"c":{"b":[0,1]}}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+		{`{"a":1}`, `[]`, `{"a":1}`},
+	}
+
+	for _, tt := range tests {
+		got, err := ApplyPatch([]byte(tt.doc), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("%s + %s: %v", tt.doc, tt.patch, err)
+			continue
+		}
+		if !sameJSON(t, got, []byte(tt.want)) {
+			t.Errorf("%s + %s = %s; want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestApplyPatchErrors(t *testing.T) {
+	tests := []struct {
+		doc, patch string
+		index      int
+		err        error
+	}{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, 0, ErrTestFailed},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, 0, ErrPathNotFound},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/foo"},{"op":"remove","path":"/foo"}]`, 1, ErrPathNotFound},
+		{`{"foo":[1]}`, `[{"op":"replace","path":"/foo/1","value":2}]`, 0, ErrPathNotFound},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/2","value":2}]`, 0, ErrPathNotFound},
+		{`{"foo":[1]}`, `[{"op":"copy","from":"/bar","path":"/baz"}]`, 0, ErrPathNotFound},
+	}
+
+	for _, tt := range tests {
+		_, err := ApplyPatch([]byte(tt.doc), []byte(tt.patch))
+
+		var patchErr *PatchError
+		if !errors.As(err, &patchErr) || patchErr.Index != tt.index || !errors.Is(err, tt.err) {
+			t.Errorf("%s + %s: got %v; want operation %d to fail with %v", tt.doc, tt.patch, err, tt.index, tt.err)
+		}
+	}
+
+	// The operations which can't be applied to any document.
+	for _, patch := range []string{
+		`[{"op":"add","path":"/foo"}]`,
+		`[{"path":"/foo"}]`,
+		`[{"op":"remove"}]`,
+		`[{"op":"move","path":"/foo"}]`,
+		`[{"op":"invent","path":"/foo"}]`,
+		`[{"op":"remove","path":"foo"}]`,
+		`[{"op":"add","path":"/foo/01","value":1}]`,
+		`[{"op":"move","from":"/foo","path":"/foo/0"}]`,
+		`[{"op":"remove","path":""}]`,
+	} {
+		_, err := ApplyPatch([]byte(`{"foo":[1]}`), []byte(patch))
+
+		var patchErr *PatchError
+		if !errors.As(err, &patchErr) || errors.Is(err, ErrPathNotFound) || errors.Is(err, ErrTestFailed) {
+			t.Errorf("%s: got %v; want an invalid operation", patch, err)
+		}
+	}
+
+	if _, err := ApplyPatch([]byte(`{}`), []byte(`{"op":"remove","path":"/foo"}`)); err != ErrNotArray {
+		t.Errorf("got %v for a single operation; want %v", err, ErrNotArray)
+	}
+}
+
+func TestReadPatch(t *testing.T) {
+	current := movie{Title: "Moana", Year: 2016, Genres: []string{"animation"}}
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        movie
+		err         error
+	}{
+		{MergePatch, `{"year": 2017, "genres": null}`, movie{Title: "Moana", Year: 2017}, nil},
+		{JSONPatch + "; charset=utf-8", `[{"op": "add", "path": "/genres/-", "value": "musical"}]`, movie{Title: "Moana", Year: 2016, Genres: []string{"animation", "musical"}}, nil},
+		{MergePatch, `{"rating": 5}`, movie{}, &UnknownFieldError{Field: "rating"}},
+		{MergePatch, `{"year": "soon"}`, movie{}, &TypeError{Field: "year", Offset: 53}},
+		{"application/json", `{"year": 2017}`, movie{}, &ContentTypeError{ContentType: "application/json", Allowed: []string{MergePatch, JSONPatch}}},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+
+		var got movie
+		err := ReadPatch(r, current, &got)
+
+		if !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("%s: got error %#v; want %#v", tt.body, err, tt.err)
+		}
+		if tt.err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v; want %+v", tt.body, got, tt.want)
+		}
+	}
+
+	// The resource isn't changed by the patch.
+	if js, _ := json.Marshal(current); !bytes.Contains(js, []byte(`"genres":["animation"]`)) {
+		t.Errorf("the resource was changed: %s", js)
+	}
+}
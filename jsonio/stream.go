@@ -0,0 +1,224 @@
+package jsonio
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// StreamErrorTrailer is the HTTP trailer a stream which fails halfway reports
+	// its error in.
+	StreamErrorTrailer = "Stream-Error"
+
+	// StreamCountTrailer is the HTTP trailer a stream which ends well reports the
+	// number of values written in. A stream with neither trailer was cut off.
+	StreamCountTrailer = "Stream-Count"
+)
+
+const (
+	// streamBufferSize is how much of a stream is held before it is written out.
+	streamBufferSize = 32 * 1024
+
+	// streamFlushInterval is the longest a written value waits in a buffer, ours or
+	// the server's, before it is flushed to the client.
+	streamFlushInterval = time.Second
+
+	// streamWriteTimeout is how long a client gets to read what is written to it.
+	// The write deadline moves on with the stream, so that a stream which runs for
+	// longer than the WriteTimeout of the server isn't cut off by it. It is moved
+	// through an http.ResponseController, which is why the module needs Go 1.20.
+	streamWriteTimeout = 30 * time.Second
+)
+
+// StreamWriter writes a JSON array or NDJSON one value at a time, for results too
+// large to be marshaled as a whole. The response is sent as soon as the StreamWriter
+// is made, so it can't report an error with the status code: once a stream fails
+// CloseWithError sets the Stream-Error trailer and, in NDJSON, adds a last line of
+// {"error": "..."}. A JSON array which fails is left without its closing bracket, so
+// that a client can't take it for the whole result. A stream which ends well sets
+// the Stream-Count trailer instead.
+//
+// The stream stops when the request context is done, which is when the client goes
+// away or the server shuts down.
+type StreamWriter struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	bw      *bufio.Writer
+	flusher http.Flusher
+	ndjson  bool
+
+	n         int
+	lastFlush time.Time
+	deadline  time.Time
+	err       error
+}
+
+// NewStreamWriter sends the status code and the headers, with a Content-Type of
+// application/x-ndjson if ndjson is set and application/json otherwise, and starts
+// the stream.
+func NewStreamWriter(w http.ResponseWriter, r *http.Request, status int, ndjson bool, headers http.Header) *StreamWriter {
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	if ndjson {
+		w.Header().Set("Content-Type", NDJSON)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Add("Trailer", StreamErrorTrailer)
+	w.Header().Add("Trailer", StreamCountTrailer)
+
+	s := &StreamWriter{
+		ctx:       r.Context(),
+		w:         w,
+		rc:        http.NewResponseController(w),
+		bw:        bufio.NewWriterSize(w, streamBufferSize),
+		ndjson:    ndjson,
+		lastFlush: time.Now(),
+	}
+	s.flusher, _ = w.(http.Flusher)
+	s.extendDeadline()
+	w.WriteHeader(status)
+
+	if !ndjson {
+		s.bw.WriteString("[\n")
+	}
+	return s
+}
+
+// Write adds v to the stream. A value which can't be marshaled is returned as an
+// error and leaves the stream as it was. Once the request context is done, or the
+// client can't be written to, every Write returns that error.
+func (s *StreamWriter) Write(v interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.extendDeadline()
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if !s.ndjson && s.n > 0 {
+		s.bw.WriteString(",\n")
+	}
+	s.bw.Write(js)
+	if s.ndjson {
+		s.bw.WriteByte('\n')
+	}
+	s.n++
+
+	if time.Since(s.lastFlush) >= streamFlushInterval {
+		s.flush()
+	}
+	return s.err
+}
+
+// Count returns the number of values written.
+func (s *StreamWriter) Count() int {
+	return s.n
+}
+
+// Close ends the stream once every value is written.
+func (s *StreamWriter) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+
+	if !s.ndjson {
+		if s.n > 0 {
+			s.bw.WriteByte('\n')
+		}
+		s.bw.WriteString("]\n")
+	}
+	s.flush()
+	s.w.Header().Set(StreamCountTrailer, strconv.Itoa(s.n))
+	return s.err
+}
+
+// CloseWithError ends a stream which failed with err, whose message is sent to the
+// client. It is sent as well when the request context is done, for a server which
+// shuts down still has a client to tell; one which went away doesn't read it.
+func (s *StreamWriter) CloseWithError(err error) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.ndjson {
+		js, _ := json.Marshal(Envelope{"error": err.Error()})
+		s.bw.Write(js)
+		s.bw.WriteByte('\n')
+	}
+	s.flush()
+	s.w.Header().Set(StreamErrorTrailer, err.Error())
+	return s.err
+}
+
+// flush writes out the buffer and pushes it past the buffers of the server.
+func (s *StreamWriter) flush() {
+	s.extendDeadline()
+	if err := s.bw.Flush(); err != nil {
+		s.err = err
+		return
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	s.lastFlush = time.Now()
+}
+
+// extendDeadline moves the write deadline of the connection on, at most once per
+// flush interval. A ResponseWriter which has no deadline is left as it is.
+func (s *StreamWriter) extendDeadline() {
+	if time.Until(s.deadline) > streamWriteTimeout-streamFlushInterval {
+		return
+	}
+	s.deadline = time.Now().Add(streamWriteTimeout)
+	s.rc.SetWriteDeadline(s.deadline)
+}
+
+// Stream writes every value each emits to a StreamWriter, and closes it with the
+// error each returns, if any. The error is returned as well, for the caller to log.
+func Stream(w http.ResponseWriter, r *http.Request, status int, ndjson bool, headers http.Header, each func(emit func(v interface{}) error) error) error {
+	s := NewStreamWriter(w, r, status, ndjson, headers)
+
+	if err := each(s.Write); err != nil {
+		s.CloseWithError(err)
+		return err
+	}
+	return s.Close()
+}
+
+// StreamChan writes the values received from values to a StreamWriter until the
+// channel is closed. A value which is an error ends the stream with it, and is
+// returned. The channel isn't drained when the stream stops early, so the sender
+// should give up once the request context is done.
+func StreamChan(w http.ResponseWriter, r *http.Request, status int, ndjson bool, headers http.Header, values <-chan interface{}) error {
+	return Stream(w, r, status, ndjson, headers, func(emit func(v interface{}) error) error {
+		for {
+			select {
+			case <-r.Context().Done():
+				return r.Context().Err()
+			case v, ok := <-values:
+				if !ok {
+					return nil
+				}
+				if err, isErr := v.(error); isErr {
+					return err
+				}
+				if err := emit(v); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package jsonio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	titles := []string{"Moana", "Up"}
+	each := func(fail error) func(emit func(v interface{}) error) error {
+		return func(emit func(v interface{}) error) error {
+			for _, title := range titles {
+				if err := emit(movie{Title: title}); err != nil {
+					return err
+				}
+			}
+			return fail
+		}
+	}
+
+	tests := []struct {
+		name    string
+		ndjson  bool
+		fail    error
+		body    string
+		trailer string
+		count   string
+	}{
+		{
+			name: "array",
+			body: "[\n" +
+				`{"title":"Moana","year":0,"genres":null},` + "\n" +
+				`{"title":"Up","year":0,"genres":null}` + "\n" +
+				"]\n",
+			count: "2",
+		},
+		{
+			name:   "ndjson",
+			ndjson: true,
+			body: `{"title":"Moana","year":0,"genres":null}` + "\n" +
+				`{"title":"Up","year":0,"genres":null}` + "\n",
+			count: "2",
+		},
+		{
+			name: "array error",
+			fail: errors.New("the database went away"),
+			body: "[\n" +
+				`{"title":"Moana","year":0,"genres":null},` + "\n" +
+				`{"title":"Up","year":0,"genres":null}`,
+			trailer: "the database went away",
+		},
+		{
+			name:   "ndjson error",
+			ndjson: true,
+			fail:   errors.New("the database went away"),
+			body: `{"title":"Moana","year":0,"genres":null}` + "\n" +
+				`{"title":"Up","year":0,"genres":null}` + "\n" +
+				`{"error":"the database went away"}` + "\n",
+			trailer: "the database went away",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			err := Stream(rr, r, http.StatusOK, tt.ndjson, nil, each(tt.fail))
+			if err != tt.fail {
+				t.Errorf("got error %v; want %v", err, tt.fail)
+			}
+
+			if rr.Body.String() != tt.body {
+				t.Errorf("got body\n%s\nwant\n%s", rr.Body, tt.body)
+			}
+			if !rr.Flushed {
+				t.Error("the stream wasn't flushed")
+			}
+
+			res := rr.Result()
+			if got := res.Trailer.Get(StreamErrorTrailer); got != tt.trailer {
+				t.Errorf("got trailer %q; want %q", got, tt.trailer)
+			}
+			if got := res.Trailer.Get(StreamCountTrailer); got != tt.count {
+				t.Errorf("got count trailer %q; want %q", got, tt.count)
+			}
+			if got, want := res.Header.Get("Content-Type"), map[bool]string{false: "application/json", true: NDJSON}[tt.ndjson]; got != want {
+				t.Errorf("got Content-Type %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestStreamEmptyArray(t *testing.T) {
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	NewStreamWriter(rr, r, http.StatusOK, false, nil).Close()
+
+	var got []interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("got %q; want an empty array", rr.Body)
+	}
+}
+
+func TestStreamChan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+
+	// The sender is never done: the stream ends when the request is cancelled.
+	values := make(chan interface{})
+	go func() {
+		values <- movie{Title: "Moana"}
+		cancel()
+	}()
+
+	err := StreamChan(rr, r, http.StatusOK, true, nil, values)
+	if err != context.Canceled {
+		t.Errorf("got error %v; want %v", err, context.Canceled)
+	}
+	// A server which shuts down still tells its client why the stream ended.
+	if got := rr.Result().Trailer.Get(StreamErrorTrailer); got != context.Canceled.Error() {
+		t.Errorf("got trailer %q for a cancelled request; want %q", got, context.Canceled)
+	}
+	if !strings.HasSuffix(rr.Body.String(), `{"error":"context canceled"}`+"\n") {
+		t.Errorf("got body %q; want it to end with the error", rr.Body)
+	}
+
+	values = make(chan interface{}, 2)
+	values <- movie{Title: "Up"}
+	values <- errors.New("the export failed")
+	rr = httptest.NewRecorder()
+
+	err = StreamChan(rr, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, true, nil, values)
+	if err == nil || err.Error() != "the export failed" {
+		t.Errorf("got error %v; want the one sent", err)
+	}
+}
@@ -0,0 +1,110 @@
+package negotiate
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+)
+
+// CSV writes tables: a list of flat objects, whose members are neither lists nor
+// objects, or an object with a single list member which is one, as in
+// {"users": [...], "metadata": {...}}. The other members of the object, such as the
+// pagination metadata, are left out. The columns are the keys of the objects in the
+// order they first appear in, under a header row.
+//
+// Strings which a spreadsheet would take for a formula are prefixed with a quote.
+var CSV = Format{
+	MediaType:   "text/csv",
+	ContentType: "text/csv; charset=utf-8",
+	Encode:      encodeCSV,
+	Fits:        func(v interface{}) bool { _, ok := table(v); return ok },
+}
+
+// table returns the rows of a tree which can be written as CSV.
+func table(v interface{}) ([]object, bool) {
+	if obj, ok := v.(object); ok {
+		var list []interface{}
+		for _, m := range obj {
+			if l, ok := m.value.([]interface{}); ok {
+				if list != nil {
+					return nil, false
+				}
+				list = l
+			}
+		}
+		if list == nil {
+			return nil, false
+		}
+		v = list
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	rows := make([]object, len(list))
+	for i, item := range list {
+		row, ok := item.(object)
+		if !ok {
+			return nil, false
+		}
+		for _, m := range row {
+			switch m.value.(type) {
+			case object, []interface{}:
+				return nil, false
+			}
+		}
+		rows[i] = row
+	}
+	return rows, true
+}
+
+func encodeCSV(w *bytes.Buffer, v interface{}) error {
+	rows, _ := table(v)
+
+	var columns []string
+	index := make(map[string]int)
+	for _, row := range rows {
+		for _, m := range row {
+			if _, ok := index[m.key]; !ok {
+				index[m.key] = len(columns)
+				columns = append(columns, m.key)
+			}
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for _, m := range row {
+			record[index[m.key]] = csvCell(m.value)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		if v != "" && bytes.IndexByte([]byte("=+-@\t\r"), v[0]) >= 0 {
+			return "'" + v
+		}
+		return v
+	default:
+		return ""
+	}
+}
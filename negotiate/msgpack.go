@@ -0,0 +1,307 @@
+package negotiate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/islamghany/go-workshop/jsonio"
+)
+
+// MessagePack writes the tree in the MessagePack format (https://msgpack.org): a
+// number is written as the smallest integer which holds it, or else as a float64.
+// A body may use any type of the format but the extension types; the keys of its maps
+// must be strings.
+var MessagePack = Format{
+	MediaType:   "application/msgpack",
+	Aliases:     []string{"application/x-msgpack", "application/vnd.msgpack"},
+	ContentType: "application/msgpack",
+	Encode:      encodeMsgpack,
+	Decode:      decodeMsgpack,
+}
+
+func encodeMsgpack(w *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		w.WriteByte(0xc0)
+	case bool:
+		if v {
+			w.WriteByte(0xc3)
+		} else {
+			w.WriteByte(0xc2)
+		}
+	case json.Number:
+		return writeMsgpackNumber(w, v)
+	case string:
+		writeMsgpackHeader(w, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		w.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(w, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := encodeMsgpack(w, item); err != nil {
+				return err
+			}
+		}
+	case object:
+		writeMsgpackHeader(w, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, m := range v {
+			encodeMsgpack(w, m.key)
+			if err := encodeMsgpack(w, m.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: can't encode %T", v)
+	}
+	return nil
+}
+
+// writeMsgpackHeader writes the type and length of a string, an array or a map: in the
+// fix type itself when n is below fixLimit, or else with a length of 8 (if the type
+// has one), 16 or 32 bits.
+func writeMsgpackHeader(w *bytes.Buffer, n int, fix byte, fixLimit int, b8, b16, b32 byte) {
+	switch {
+	case n < fixLimit:
+		w.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		w.WriteByte(b8)
+		w.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(b16)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(b32)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackNumber(w *bytes.Buffer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		switch {
+		case i >= 0 && i <= 0x7f:
+			w.WriteByte(byte(i))
+		case i < 0 && i >= -32:
+			w.WriteByte(byte(int8(i)))
+		case i >= math.MinInt8 && i <= math.MaxInt8:
+			w.WriteByte(0xd0)
+			w.WriteByte(byte(int8(i)))
+		case i >= math.MinInt16 && i <= math.MaxInt16:
+			w.WriteByte(0xd1)
+			binary.Write(w, binary.BigEndian, int16(i))
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			w.WriteByte(0xd2)
+			binary.Write(w, binary.BigEndian, int32(i))
+		default:
+			w.WriteByte(0xd3)
+			binary.Write(w, binary.BigEndian, i)
+		}
+		return nil
+	}
+
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		w.WriteByte(0xcf)
+		binary.Write(w, binary.BigEndian, u)
+		return nil
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	w.WriteByte(0xcb)
+	binary.Write(w, binary.BigEndian, f)
+	return nil
+}
+
+func decodeMsgpack(data []byte, dst interface{}, opts ...jsonio.Option) error {
+	d := &msgpackDecoder{data: data}
+
+	v, err := d.value(0)
+	if err != nil {
+		return &MalformedError{Format: "MessagePack", Err: err}
+	}
+	if d.off != len(data) {
+		return jsonio.ErrMultipleValues
+	}
+
+	// NaN and the infinities can't be decoded into anything through JSON.
+	if err := decodeVia(v, dst, opts); err != nil {
+		var unsupported *json.UnsupportedValueError
+		if errors.As(err, &unsupported) {
+			return &MalformedError{Format: "MessagePack", Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+var errMsgpackTruncated = errors.New("unexpected end of data")
+
+// msgpackDecoder reads the tree of a MessagePack value.
+type msgpackDecoder struct {
+	data []byte
+	off  int
+}
+
+// next returns the next n bytes.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.off < n {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// length reads the length of a string, a binary, an array or a map.
+func (d *msgpackDecoder) length(size int) (int, error) {
+	u, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if u > uint64(len(d.data)) {
+		return 0, errMsgpackTruncated
+	}
+	return int(u), nil
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return json.Number(strconv.Itoa(int(c))), nil
+	case c >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(c)))), nil
+	case c&0xf0 == 0x80:
+		return d.object(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.list(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.string(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(n)
+		return append([]byte(nil), b...), err
+
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		return json.Number(strconv.FormatUint(u, 10)), err
+
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.uint(size)
+		// Sign-extend the integer from its size to 64 bits.
+		shift := uint(64 - 8*size)
+		return json.Number(strconv.FormatInt(int64(u<<shift)>>shift, 10)), err
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.string(n)
+
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.list(n, depth)
+
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(n, depth)
+	}
+
+	return nil, fmt.Errorf("unsupported type 0x%02x at byte %d", c, d.off-1)
+}
+
+func (d *msgpackDecoder) string(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) list(n int, depth int) (interface{}, error) {
+	list := []interface{}{}
+	for i := 0; i < n; i++ {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (d *msgpackDecoder) object(n int, depth int) (interface{}, error) {
+	obj := object{}
+	for i := 0; i < n; i++ {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key of type %T, not a string", key)
+		}
+
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		obj = append(obj, member{key: s, value: v})
+	}
+	return obj, nil
+}
@@ -0,0 +1,132 @@
+package negotiate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/islamghany/go-workshop/jsonio"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	type numbers struct {
+		Small    int64   `json:"small"`
+		Negative int64   `json:"negative"`
+		Int16    int64   `json:"int16"`
+		Min      int64   `json:"min"`
+		Max      uint64  `json:"max"`
+		Float    float64 `json:"float"`
+		Text     string  `json:"text"`
+		List     []int   `json:"list"`
+		Bytes    []byte  `json:"bytes"`
+	}
+
+	want := numbers{
+		Small:    7,
+		Negative: -33,
+		Int16:    -1000,
+		Min:      math.MinInt64,
+		Max:      math.MaxUint64,
+		Float:    -0.25,
+		Text:     strings.Repeat("ü", 100),
+		List:     make([]int, 20),
+		Bytes:    []byte{0, 1, 2},
+	}
+
+	tree, err := parse(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, tree); err != nil {
+		t.Fatal(err)
+	}
+
+	var got numbers
+	if err := decodeMsgpack(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestMsgpackDecode(t *testing.T) {
+	var tests = []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{"fixmap", "\x81\xa1a\x93\xc0\xc2\xff", map[string]interface{}{"a": []interface{}{nil, false, -1.0}}},
+		{"uint8", "\xcc\xff", 255.0},
+		{"int32", "\xd2\xff\xff\xff\xfe", -2.0},
+		{"float32", "\xca\x3f\xc0\x00\x00", 1.5},
+		{"str8", "\xd9\x03abc", "abc"},
+		{"bin8", "\xc4\x02hi", "aGk="},
+		{"map16", "\xde\x00\x01\xa1a\x01", map[string]interface{}{"a": 1.0}},
+	}
+
+	for _, tt := range tests {
+		var got interface{}
+		if err := decodeMsgpack([]byte(tt.data), &got); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v; want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMsgpackErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		data string
+	}{
+		{"truncated", "\x92\x01"},
+		{"truncated string", "\xa5abc"},
+		{"huge length", "\xdd\xff\xff\xff\xff"},
+		{"extension", "\xd4\x01\x00"},
+		{"number key", "\x81\x01\x01"},
+		{"nan", "\xcb\x7f\xf8\x00\x00\x00\x00\x00\x01"},
+		{"too deep", strings.Repeat("\x91", maxDepth+2) + "\xc0"},
+	}
+
+	for _, tt := range tests {
+		var got interface{}
+		err := decodeMsgpack([]byte(tt.data), &got)
+
+		var malformed *MalformedError
+		if !errors.As(err, &malformed) || malformed.Format != "MessagePack" {
+			t.Errorf("%s: got %v; want a *MalformedError", tt.name, err)
+		}
+	}
+
+	var got interface{}
+	if err := decodeMsgpack([]byte("\x01\x02"), &got); err != jsonio.ErrMultipleValues {
+		t.Errorf("got %v for two values; want %v", err, jsonio.ErrMultipleValues)
+	}
+}
+
+func TestMsgpackEncodeLengths(t *testing.T) {
+	for _, n := range []int{15, 16, 65535, 65536} {
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = json.Number("1")
+		}
+
+		var buf bytes.Buffer
+		if err := encodeMsgpack(&buf, list); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []int
+		if err := decodeMsgpack(buf.Bytes(), &got); err != nil || len(got) != n {
+			t.Errorf("a list of %d: got %d items and %v", n, len(got), err)
+		}
+	}
+}
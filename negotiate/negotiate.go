@@ -0,0 +1,340 @@
+// Package negotiate picks the format of a response from the Accept header of the
+// request, and reads request bodies in the format their Content-Type names. It builds
+// on the jsonio package: the values are described by their JSON encoding, struct tags
+// and all, and only then written as XML, CSV or MessagePack, so that every format
+// carries the same fields under the same names.
+//
+// The formats are
+//
+//	JSON          application/json
+//	XML           application/xml, also read as text/xml
+//	CSV           text/csv, for responses only, and only for tables (see CSV)
+//	MessagePack   application/msgpack, also read as application/x-msgpack and
+//	              application/vnd.msgpack
+//
+// Write returns a *NotAcceptableError when none of the formats the value can be
+// written in is acceptable, and Read a *jsonio.ContentTypeError when the body is in
+// a format which can't be read.
+//
+// ParseAccept and Quality are there for the choices the formats don't cover, such as
+// between the problem and the envelope of an error, or between languages.
+package negotiate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/islamghany/go-workshop/jsonio"
+)
+
+// Format is a representation of the values of a response or a request body.
+type Format struct {
+	// MediaType names the format in the Accept and Content-Type headers, Aliases
+	// are the other names it goes by.
+	MediaType string
+	Aliases   []string
+
+	// ContentType is the Content-Type of the responses written in the format.
+	ContentType string
+
+	// Encode writes the tree of a value, as made by parse. Fits reports whether the
+	// tree can be written in the format at all, and is nil when any tree can.
+	Encode func(w *bytes.Buffer, v interface{}) error
+	Fits   func(v interface{}) bool
+
+	// Decode decodes a request body into dst, and is nil for the formats which
+	// can't be read.
+	Decode func(data []byte, dst interface{}, opts ...jsonio.Option) error
+}
+
+// Formats are the formats of Write and Read, in the order of preference: JSON is
+// sent to the clients which don't say what they accept, or accept anything.
+var Formats = []Format{JSON, XML, MessagePack, CSV}
+
+var JSON = Format{
+	MediaType:   "application/json",
+	ContentType: "application/json",
+	Encode:      encodeJSON,
+	Decode:      jsonio.Decode,
+}
+
+// MalformedError is returned for a body which isn't valid in its Format, other than
+// JSON whose errors are those of jsonio.
+type MalformedError struct {
+	Format string
+	Err    error
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("body contains badly-formed %s: %v", e.Format, e.Err)
+}
+
+func (e *MalformedError) Unwrap() error {
+	return e.Err
+}
+
+// NotAcceptableError is returned by Write when the Accept header rules out every
+// format the response could be written in. Available lists their media types.
+type NotAcceptableError struct {
+	Available []string
+}
+
+func (e *NotAcceptableError) Error() string {
+	return fmt.Sprintf("the response can only be sent as %s", strings.Join(e.Available, ", "))
+}
+
+// Preference is an entry of an Accept header, or of one of its kin such as
+// Accept-Language: a value, lower-cased, such as text/* or ar-eg, and its q value.
+type Preference struct {
+	Value string
+	Q     float64
+}
+
+// ParseAccept returns the entries of an Accept, Accept-Language or Accept-Encoding
+// header, in the order they are given. The entries which can't be parsed are left
+// out, and a q value which can't be parsed counts as 1.
+func ParseAccept(header string) []Preference {
+	var prefs []Preference
+	for _, part := range strings.Split(header, ",") {
+		value, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+				q = f
+			}
+		}
+		prefs = append(prefs, Preference{Value: value, Q: q})
+	}
+	return prefs
+}
+
+// Quality returns the q value the entries of an Accept header give a media type:
+// the one of the most specific media range which matches it, or 0 when none does.
+func Quality(prefs []Preference, mediaType string) float64 {
+	return quality(prefs, mediaType, false)
+}
+
+// quality is Quality, but when exact is set only the media ranges which name the
+// media type itself count.
+func quality(prefs []Preference, mediaType string, exact bool) float64 {
+	typ, subtype := splitMediaType(mediaType)
+	if typ == "" {
+		return 0
+	}
+
+	q, specificity := 0.0, -1
+	for _, p := range prefs {
+		if p.Value == "*" {
+			p.Value = "*/*"
+		}
+		rangeType, rangeSubtype := splitMediaType(p.Value)
+
+		s := -1
+		switch {
+		case rangeType == typ && rangeSubtype == subtype:
+			s = 2
+		case rangeType == typ && rangeSubtype == "*":
+			s = 1
+		case rangeType == "*" && rangeSubtype == "*":
+			s = 0
+		}
+		if s > specificity && (s == 2 || !exact) {
+			q, specificity = p.Q, s
+		}
+	}
+	return q
+}
+
+// splitMediaType splits a media type into its type and subtype. A value without a
+// slash has no subtype, and so matches no media type.
+func splitMediaType(mediaType string) (string, string) {
+	slash := strings.IndexByte(mediaType, '/')
+	if slash < 0 {
+		return "", ""
+	}
+	return strings.ToLower(mediaType[:slash]), strings.ToLower(mediaType[slash+1:])
+}
+
+// Select returns the format of formats the Accept header prefers. Formats which are
+// as acceptable as one another are picked in the order they are given in, and every
+// format is acceptable when there is no Accept header, or none which can be parsed.
+// The aliases of a format only count when they are named, so that text/* doesn't
+// pick XML through text/xml.
+func Select(accept string, formats []Format) (Format, bool) {
+	prefs := ParseAccept(accept)
+	if len(prefs) == 0 {
+		if len(formats) == 0 {
+			return Format{}, false
+		}
+		return formats[0], true
+	}
+
+	best, bestQ := Format{}, 0.0
+	for _, f := range formats {
+		q := quality(prefs, f.MediaType, false)
+		for _, alias := range f.Aliases {
+			if aq := quality(prefs, alias, true); aq > q {
+				q = aq
+			}
+		}
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// Write sends data with the status code and the headers, in the format the request
+// prefers among those data can be written in. When none of them is acceptable it
+// writes nothing and returns a *NotAcceptableError, for the caller to answer with a
+// 406 which varies by Accept as well.
+func Write(w http.ResponseWriter, r *http.Request, status int, data interface{}, headers http.Header) error {
+	v, err := parse(data)
+	if err != nil {
+		return err
+	}
+
+	var fits []Format
+	for _, f := range Formats {
+		if f.Fits == nil || f.Fits(v) {
+			fits = append(fits, f)
+		}
+	}
+
+	f, ok := Select(r.Header.Get("Accept"), fits)
+	if !ok {
+		available := make([]string, len(fits))
+		for i, f := range fits {
+			available[i] = f.MediaType
+		}
+		return &NotAcceptableError{Available: available}
+	}
+
+	var buf bytes.Buffer
+	if err := f.Encode(&buf, v); err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Add("Vary", "Accept")
+
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+	return nil
+}
+
+// Read decodes the request body into dst, which must be a non-nil pointer, in the
+// format of its Content-Type. A body without a Content-Type is read as JSON, as are
+// the JSON based types such as application/merge-patch+json. The options are those of
+// jsonio.Read, and apply to every format.
+func Read(r *http.Request, dst interface{}, opts ...jsonio.Option) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" || jsonio.IsJSON(contentType) {
+		return jsonio.Read(r, dst, opts...)
+	}
+
+	f, ok := formatOf(contentType)
+	if !ok {
+		return &jsonio.ContentTypeError{ContentType: contentType, Allowed: ReadableTypes()}
+	}
+
+	body, err := jsonio.ReadBody(r, opts...)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return jsonio.ErrEmptyBody
+	}
+	return f.Decode(body, dst, opts...)
+}
+
+// formatOf returns the readable format a Content-Type names.
+func formatOf(contentType string) (Format, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return Format{}, false
+	}
+
+	for _, f := range Formats {
+		if f.Decode == nil {
+			continue
+		}
+		if f.MediaType == mediaType {
+			return f, true
+		}
+		for _, alias := range f.Aliases {
+			if alias == mediaType {
+				return f, true
+			}
+		}
+	}
+	return Format{}, false
+}
+
+// ReadableTypes returns the media types Read accepts, aliases left out.
+func ReadableTypes() []string {
+	var types []string
+	for _, f := range Formats {
+		if f.Decode != nil {
+			types = append(types, f.MediaType)
+		}
+	}
+	return types
+}
+
+// WritableTypes returns the media types data can be written in by Write, in the order
+// of preference.
+func WritableTypes(data interface{}) []string {
+	v, err := parse(data)
+	if err != nil {
+		return nil
+	}
+
+	var types []string
+	for _, f := range Formats {
+		if f.Fits == nil || f.Fits(v) {
+			types = append(types, f.MediaType)
+		}
+	}
+	return types
+}
+
+// encodeJSON writes the tree as JSON, with the newline of jsonio.Write.
+func encodeJSON(w *bytes.Buffer, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Write(js)
+	w.WriteByte('\n')
+	return nil
+}
+
+// errTooDeep is returned for bodies which nest more than maxDepth levels.
+var errTooDeep = errors.New("too deeply nested")
+
+// maxDepth is the deepest a body read as XML or MessagePack may nest.
+const maxDepth = 1000
+
+// decodeVia decodes a tree read from another format into dst, through its JSON
+// encoding so that dst is filled in, and checked, the way jsonio would.
+func decodeVia(tree interface{}, dst interface{}, opts []jsonio.Option) error {
+	js, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return jsonio.Decode(js, dst, opts...)
+}
@@ -0,0 +1,246 @@
+package negotiate
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/islamghany/go-workshop/jsonio"
+)
+
+type movie struct {
+	ID      int64    `json:"id"`
+	Title   string   `json:"title"`
+	Year    int32    `json:"year,omitempty"`
+	Genres  []string `json:"genres,omitempty"`
+	Runtime *float64 `json:"runtime"`
+	Watched bool     `json:"watched"`
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/xml", "application/xml"},
+		{"text/xml", "application/xml"},
+		{"application/*;q=0.5, text/csv", "text/csv"},
+		{"application/json;q=0.2, application/msgpack;q=0.8", "application/msgpack"},
+		{"application/x-msgpack", "application/msgpack"},
+		{"text/*, application/xml;q=0.9", "text/csv"},
+		{"*/*;q=0.1, application/json;q=0", "application/xml"},
+		{"text/html", ""},
+		{"image/*", ""},
+		{"not a media type", "application/json"},
+	}
+
+	for _, tt := range tests {
+		f, ok := Select(tt.accept, Formats)
+		if got := f.MediaType; ok != (tt.want != "") || got != tt.want {
+			t.Errorf("Select(%q) = %q, %t; want %q", tt.accept, got, ok, tt.want)
+		}
+	}
+}
+
+func TestParseAccept(t *testing.T) {
+	got := ParseAccept("text/html, Application/JSON;q=0.5, bad/;q=1, ar-EG;q=0.2, *;q=2")
+	want := []Preference{{"text/html", 1}, {"application/json", 0.5}, {"ar-eg", 0.2}, {"*", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	tests := []struct {
+		accept    string
+		mediaType string
+		want      float64
+	}{
+		{"", "application/json", 0},
+		{"*/*;q=0.3", "application/json", 0.3},
+		{"*;q=0.3", "application/json", 0.3},
+		{"application/*;q=0.5, */*;q=0.1", "application/json", 0.5},
+		{"application/*;q=0.5, application/json;q=0", "application/json", 0},
+		{"application/problem+json", "application/json", 0},
+		{"ar, en", "application/json", 0},
+	}
+	for _, tt := range tests {
+		if got := Quality(ParseAccept(tt.accept), tt.mediaType); got != tt.want {
+			t.Errorf("Quality(%q, %q) = %v; want %v", tt.accept, tt.mediaType, got, tt.want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	runtime := 107.5
+	movies := jsonio.Envelope{"movies": []movie{
+		{ID: 1, Title: "Moana", Year: 2016, Genres: []string{"animation"}, Runtime: &runtime},
+		{ID: 2, Title: "=HYPERLINK()", Watched: true},
+	}}
+
+	tests := []struct {
+		name        string
+		accept      string
+		data        interface{}
+		contentType string
+		body        string
+	}{
+		{
+			name:        "json",
+			data:        movies,
+			contentType: "application/json",
+			body: `{"movies":[{"id":1,"title":"Moana","year":2016,"genres":["animation"],"runtime":107.5,"watched":false},` +
+				`{"id":2,"title":"=HYPERLINK()","runtime":null,"watched":true}]}` + "\n",
+		},
+		{
+			name:        "xml",
+			accept:      "application/xml",
+			data:        jsonio.Envelope{"movie": movies["movies"].([]movie)[0], "a b": "<&>"},
+			contentType: "application/xml; charset=utf-8",
+			body: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<response><entry key="a b">&lt;&amp;&gt;</entry><movie><id>1</id><title>Moana</title><year>2016</year>` +
+				`<genres><item>animation</item></genres><runtime>107.5</runtime><watched>false</watched></movie></response>` + "\n",
+		},
+		{
+			name:   "csv",
+			accept: "text/csv",
+			data: jsonio.Envelope{
+				"movies":   []movie{{ID: 1, Title: "Moana", Runtime: &runtime}, {ID: 2, Title: "=HYPERLINK()", Year: 1999, Watched: true}},
+				"metadata": jsonio.Envelope{"total": 2},
+			},
+			contentType: "text/csv; charset=utf-8",
+			body:        "id,title,runtime,watched,year\n1,Moana,107.5,false,\n2,'=HYPERLINK(),,true,1999\n",
+		},
+		{
+			name:        "msgpack",
+			accept:      "application/msgpack",
+			data:        jsonio.Envelope{"id": 1, "ok": true, "tags": []string{}},
+			contentType: "application/msgpack",
+			body:        "\x83\xa2id\x01\xa2ok\xc3\xa4tags\x90",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+
+			if err := Write(rr, r, http.StatusOK, tt.data, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %q; want %q", got, tt.contentType)
+			}
+			if got := rr.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("got Vary %q; want Accept", got)
+			}
+			if rr.Body.String() != tt.body {
+				t.Errorf("got body\n%q\nwant\n%q", rr.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestWriteNotAcceptable(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "text/csv")
+	rr := httptest.NewRecorder()
+
+	// A single movie isn't a table, so it can't be sent as CSV.
+	err := Write(rr, r, http.StatusOK, jsonio.Envelope{"movie": movie{Title: "Moana"}}, nil)
+
+	var notAcceptable *NotAcceptableError
+	if !errors.As(err, &notAcceptable) {
+		t.Fatalf("got %v; want a *NotAcceptableError", err)
+	}
+	if want := []string{"application/json", "application/xml", "application/msgpack"}; !reflect.DeepEqual(notAcceptable.Available, want) {
+		t.Errorf("got the alternatives %v; want %v", notAcceptable.Available, want)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("got body %q; want nothing written", rr.Body)
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        movie
+		err         error
+	}{
+		{
+			name: "no content type",
+			body: `{"title": "Moana"}`,
+			want: movie{Title: "Moana"},
+		},
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"title": "Moana", "year": 2016}`,
+			want:        movie{Title: "Moana", Year: 2016},
+		},
+		{
+			name:        "xml",
+			contentType: "text/xml",
+			body:        `<movie><title> Moana </title><year>2016</year><genres><item>animation</item></genres><watched>true</watched></movie>`,
+			want:        movie{Title: " Moana ", Year: 2016, Genres: []string{"animation"}, Watched: true},
+		},
+		{
+			name:        "msgpack",
+			contentType: "application/x-msgpack",
+			body:        "\x82\xa5title\xa5Moana\xa4year\xcd\x07\xe0",
+			want:        movie{Title: "Moana", Year: 2016},
+		},
+		{
+			name:        "csv",
+			contentType: "text/csv",
+			body:        "title\nMoana\n",
+			err:         &jsonio.ContentTypeError{ContentType: "text/csv", Allowed: []string{"application/json", "application/xml", "application/msgpack"}},
+		},
+		{
+			name:        "empty",
+			contentType: "application/xml",
+			body:        " \n",
+			err:         jsonio.ErrEmptyBody,
+		},
+		{
+			name:        "xml wrong type",
+			contentType: "application/xml",
+			body:        `<movie><year>soon</year></movie>`,
+			err:         &jsonio.TypeError{Field: "year", Offset: 14},
+		},
+		{
+			name:        "xml unknown field",
+			contentType: "application/xml",
+			body:        `<movie><rating>5</rating></movie>`,
+			err:         &jsonio.UnknownFieldError{Field: "rating"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			var got movie
+			err := Read(r, &got)
+
+			if !reflect.DeepEqual(err, tt.err) {
+				t.Errorf("got error %#v; want %#v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
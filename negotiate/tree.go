@@ -0,0 +1,94 @@
+package negotiate
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// The formats write and read values as trees of nil, bool, json.Number, string,
+// []interface{} and object, the values of a JSON document. Trees read from a format
+// may also hold the other numbers, and []byte.
+
+// object is a JSON object whose members keep their order, which is the order of the
+// fields of the struct it was encoded from.
+type object []member
+
+type member struct {
+	key   string
+	value interface{}
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(m.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// parse returns the tree of data's JSON encoding.
+func parse(data interface{}) (interface{}, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	return parseValue(dec)
+}
+
+func parseValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			v, err := parseValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+
+	case json.Delim('{'):
+		obj := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := parseValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, member{key: key.(string), value: v})
+		}
+		_, err := dec.Token()
+		return obj, err
+
+	default:
+		return tok, nil
+	}
+}
@@ -0,0 +1,336 @@
+package negotiate
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/islamghany/go-workshop/jsonio"
+)
+
+// XML writes the tree under a <response> element: the members of an object are
+// elements named after their keys, the items of a list are <item> elements, and null
+// is an empty element with a nil="true" attribute. A key which isn't a valid element
+// name is written as an <entry> element with the key in its key attribute.
+//
+// XML has no types, so a body is read into the fields its elements are named after,
+// the way JSON would be, with the text of each element taken for a number or a
+// boolean when the field is one. The name of the root element doesn't matter.
+var XML = Format{
+	MediaType:   "application/xml",
+	Aliases:     []string{"text/xml"},
+	ContentType: "application/xml; charset=utf-8",
+	Encode:      encodeXML,
+	Decode:      decodeXML,
+}
+
+func encodeXML(w *bytes.Buffer, v interface{}) error {
+	w.WriteString(xml.Header)
+	writeXMLElement(w, "response", v)
+	w.WriteByte('\n')
+	return nil
+}
+
+func writeXMLElement(w *bytes.Buffer, name string, v interface{}) {
+	w.WriteByte('<')
+	if isXMLName(name) {
+		w.WriteString(name)
+	} else {
+		w.WriteString(`entry key="`)
+		xml.EscapeText(w, []byte(name))
+		w.WriteByte('"')
+		name = "entry"
+	}
+
+	switch v := v.(type) {
+	case nil:
+		w.WriteString(` nil="true"/>`)
+		return
+	case object:
+		w.WriteByte('>')
+		for _, m := range v {
+			writeXMLElement(w, m.key, m.value)
+		}
+	case []interface{}:
+		w.WriteByte('>')
+		for _, item := range v {
+			writeXMLElement(w, "item", item)
+		}
+	case string:
+		w.WriteByte('>')
+		xml.EscapeText(w, []byte(v))
+	case json.Number:
+		w.WriteByte('>')
+		w.WriteString(v.String())
+	case bool:
+		w.WriteByte('>')
+		w.WriteString(strconv.FormatBool(v))
+	}
+
+	w.WriteString("</")
+	w.WriteString(name)
+	w.WriteByte('>')
+}
+
+// isXMLName reports whether name can be written as an element name as it is.
+func isXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+		case i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// xmlNode is an element of an XML body.
+type xmlNode struct {
+	name     string
+	nil      bool
+	text     string
+	children []*xmlNode
+}
+
+func decodeXML(data []byte, dst interface{}, opts ...jsonio.Option) error {
+	root, err := parseXML(data)
+	if err != nil {
+		return &MalformedError{Format: "XML", Err: err}
+	}
+	return decodeVia(xmlValue(root, reflect.TypeOf(dst)), dst, opts)
+}
+
+// parseXML returns the root element of an XML document.
+func parseXML(data []byte) (*xmlNode, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 && root != nil {
+				return nil, errors.New("more than one root element")
+			}
+			if len(stack) >= maxDepth {
+				return nil, errTooDeep
+			}
+
+			n := &xmlNode{name: tok.Name.Local}
+			for _, attr := range tok.Attr {
+				switch {
+				case attr.Name.Local == "key" && n.name == "entry":
+					n.name = attr.Value
+				case attr.Name.Local == "nil":
+					n.nil = attr.Value == "true"
+				}
+			}
+
+			if len(stack) == 0 {
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+			stack = append(stack, n)
+
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(tok)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("no root element")
+	}
+	return root, nil
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// xmlValue returns the tree of an element which is decoded into a value of type t, or
+// of an element of unknown type when t is nil.
+func xmlValue(n *xmlNode, t reflect.Type) interface{} {
+	if n.nil {
+		return nil
+	}
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return xmlAny(n)
+	}
+
+	// An element which holds text where children are expected is passed on as a
+	// string, for jsonio to report the type mismatch.
+	text := strings.TrimSpace(n.text)
+	if len(n.children) == 0 && text != "" {
+		switch t.Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+			if t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.Uint8 {
+				return n.text
+			}
+		}
+	}
+
+	if pt := reflect.PtrTo(t); pt.Implements(jsonUnmarshalerType) || pt.Implements(textUnmarshalerType) {
+		if len(n.children) > 0 {
+			return xmlAny(n)
+		}
+		return n.text
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj := object{}
+		for _, c := range n.children {
+			obj = append(obj, member{key: c.name, value: xmlValue(c, fieldType(t, c.name))})
+		}
+		return obj
+
+	case reflect.Map:
+		obj := object{}
+		for _, c := range n.children {
+			obj = append(obj, member{key: c.name, value: xmlValue(c, t.Elem())})
+		}
+		return obj
+
+	case reflect.Slice, reflect.Array:
+		// Bytes are base64 text, as in JSON.
+		if t.Elem().Kind() == reflect.Uint8 {
+			return text
+		}
+		list := []interface{}{}
+		for _, c := range n.children {
+			list = append(list, xmlValue(c, t.Elem()))
+		}
+		return list
+
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(text); err == nil {
+			return b
+		}
+		return n.text
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if text != "" && (text[0] == '-' || text[0] >= '0' && text[0] <= '9') && json.Valid([]byte(text)) {
+			return json.Number(text)
+		}
+		return n.text
+
+	case reflect.String:
+		return n.text
+
+	default:
+		return xmlAny(n)
+	}
+}
+
+// xmlAny returns the tree of an element whose type isn't known: its text, the list
+// of its children when they are all <item> elements, or else the object they make.
+func xmlAny(n *xmlNode) interface{} {
+	if n.nil {
+		return nil
+	}
+	if len(n.children) == 0 {
+		return n.text
+	}
+
+	isList := true
+	for _, c := range n.children {
+		isList = isList && c.name == "item"
+	}
+	if isList {
+		list := []interface{}{}
+		for _, c := range n.children {
+			list = append(list, xmlAny(c))
+		}
+		return list
+	}
+
+	obj := object{}
+	for _, c := range n.children {
+		obj = append(obj, member{key: c.name, value: xmlAny(c)})
+	}
+	return obj
+}
+
+// fieldType returns the type of the field of the struct type t which JSON would
+// decode the key name into, preferring an exact match to a case-insensitive one, or
+// nil when there is none.
+func fieldType(t reflect.Type, name string) reflect.Type {
+	var folded reflect.Type
+
+	var find func(t reflect.Type, depth int) reflect.Type
+	find = func(t reflect.Type, depth int) reflect.Type {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			key := strings.Split(tag, ",")[0]
+
+			// The fields of an embedded struct are promoted, as with encoding/json.
+			if f.Anonymous && key == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct && depth < 10 {
+					if found := find(ft, depth+1); found != nil {
+						return found
+					}
+					continue
+				}
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+
+			if key == "" {
+				key = f.Name
+			}
+			if key == name {
+				return f.Type
+			}
+			if folded == nil && strings.EqualFold(key, name) {
+				folded = f.Type
+			}
+		}
+		return nil
+	}
+
+	if found := find(t, 0); found != nil {
+		return found
+	}
+	return folded
+}
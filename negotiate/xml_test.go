@@ -0,0 +1,86 @@
+package negotiate
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type base struct {
+	ID int64 `json:"id"`
+}
+
+type review struct {
+	base
+	Author    string            `json:"author"`
+	Score     float64           `json:"score"`
+	Tags      map[string]int    `json:"tags"`
+	CreatedAt time.Time         `json:"created_at"`
+	Reply     *review           `json:"reply"`
+	Extra     interface{}       `json:"extra"`
+	Labels    map[string]string `json:"-"`
+}
+
+func TestXMLRoundTrip(t *testing.T) {
+	want := review{
+		base:      base{ID: 3},
+		Author:    "Alice & Bob",
+		Score:     4.5,
+		Tags:      map[string]int{"funny": 2, "2 stars": 1},
+		CreatedAt: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		Extra:     []interface{}{"a", map[string]interface{}{"b": "c"}},
+	}
+
+	tree, err := parse(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	encodeXML(&buf, tree)
+
+	var got review
+	if err := decodeXML(buf.Bytes(), &got); err != nil {
+		t.Fatalf("%v\n%s", err, buf.Bytes())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v\n%s", got, want, buf.Bytes())
+	}
+}
+
+func TestXMLDecode(t *testing.T) {
+	var got review
+	err := decodeXML([]byte(`<?xml version="1.0"?>
+<!-- a review -->
+<review>
+	<ID>1</ID>
+	<author>Alice</author>
+	<reply><author>Bob</author><score>1e1</score></reply>
+	<extra nil="true"/>
+</review>`), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := review{base: base{ID: 1}, Author: "Alice", Reply: &review{Author: "Bob", Score: 10}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestXMLErrors(t *testing.T) {
+	for _, body := range []string{
+		`<review><author>Alice</review>`,
+		`<review/><review/>`,
+		`just text`,
+	} {
+		var got review
+		err := decodeXML([]byte(body), &got)
+
+		var malformed *MalformedError
+		if !errors.As(err, &malformed) || malformed.Format != "XML" {
+			t.Errorf("%s: got %v; want a *MalformedError", body, err)
+		}
+	}
+}